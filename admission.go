@@ -0,0 +1,58 @@
+package main
+
+import (
+    "context"
+    "log"
+    "os"
+    "strconv"
+)
+
+// Admission control bounds the number of transfers waiting to be executed.
+// Below the soft limit any tenant may queue as much as it likes. Above it,
+// each tenant with queued work is held to an equal share of the capacity so
+// one busy client cannot crowd out the others, and at capacity nothing more
+// is accepted. Held transfers wait for people and deferred ones for a lower
+// base fee, not for workers, so neither counts until it is released.
+//
+// The backlog is read from the database, so concurrent submissions can
+// overshoot the limits by the number of requests in flight.
+
+var (
+    queueCapacity  = envInt("QUEUE_CAPACITY", 1000)
+    queueSoftLimit = envInt("QUEUE_SOFT_LIMIT", queueCapacity*8/10)
+)
+
+func envInt(name string, def int) int {
+    v := os.Getenv(name)
+    if v == "" {
+        return def
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil || n < 1 {
+        log.Println("Ignoring invalid", name, v)
+        return def
+    }
+    return n
+}
+
+func admitTransfer(ctx context.Context, tenant string) error {
+    var total, mine, tenants int
+    err := db.QueryRowContext(ctx, `SELECT COUNT(*), COUNT(*) FILTER (WHERE COALESCE(client_id, '') = $1),
+        COUNT(DISTINCT COALESCE(client_id, '')) FILTER (WHERE COALESCE(client_id, '') <> $1)
+        FROM transfers WHERE status = 'processing' OR status = 'pending' AND `+deferralReleased(2),
+        tenant, heads.baseFeeParam()).Scan(&total, &mine, &tenants)
+    if err != nil {
+        return err
+    }
+    
+    if total >= queueCapacity {
+        return &requestError{503, "Transfer queue is full"}
+    }
+    if total < queueSoftLimit {
+        return nil
+    }
+    if fairShare := queueCapacity / (tenants + 1); mine >= fairShare {
+        return &requestError{429, "Too many queued transfers for this client"}
+    }
+    return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+    "context"
+    "math/big"
+    "testing"
+    "time"
+)
+
+func TestAdmitTransfer(t *testing.T) {
+    testDB(t)
+    defer func(capacity, soft int) { queueCapacity, queueSoftLimit = capacity, soft }(queueCapacity, queueSoftLimit)
+    queueCapacity, queueSoftLimit = 10, 8
+    defer func(h *headMonitor) { heads = h }(heads)
+    heads = &headMonitor{baseFee: big.NewInt(50e9)}
+    for _, id := range []string{"a", "b", "c"} {
+        addClient(t, &APIClient{ID: id})
+    }
+    
+    tests := []struct {
+        name   string
+        // One client id per transfer, "-" for a held one of a, "d" for one of
+        // a deferred until the base fee falls and "D" for one of a released
+        // by its deadline.
+        queued string
+        tenant string
+        status int
+    }{
+        {"below the soft limit", "aaaaaaa", "a", 0},
+        {"held transfers do not count", "aaaaaaa-----", "a", 0},
+        {"deferred transfers do not count", "aaaaaaaddddd", "a", 0},
+        {"released deferred transfers count", "aaaaaDDDbbb", "a", 503},
+        {"over its share", "aaaaabbb", "a", 429},
+        {"under its share", "aaaaabbb", "b", 0},
+        {"new tenant", "aaaaabbb", "c", 0},
+        {"share shrinks with more tenants", "aaaabbbcc", "a", 429},
+        {"processing counts", "aaaaaaaaaP", "b", 503},
+        {"at capacity", "aaaaabbbbb", "c", 503},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            mustExec(t, "DELETE FROM transfers")
+            for _, c := range tt.queued {
+                status, client := "pending", string(c)
+                var maxBaseFee, deadline interface{}
+                switch c {
+                case '-':
+                    status, client = "held", "a"
+                case 'P':
+                    status, client = "processing", "a"
+                case 'd':
+                    client, maxBaseFee, deadline = "a", "10000000000", time.Now().Add(time.Hour)
+                case 'D':
+                    client, maxBaseFee, deadline = "a", "10000000000", time.Now().Add(-time.Minute)
+                }
+                mustExec(t, `INSERT INTO transfers (from_address, to_address, amount, status, client_id, max_base_fee, deadline)
+                    VALUES ('0x1', '0x2', 1, $1, $2, $3, $4)`, status, client, maxBaseFee, deadline)
+            }
+            err := admitTransfer(context.Background(), tt.tenant)
+            status := 0
+            if re, ok := err.(*requestError); ok {
+                status = re.status
+            } else if err != nil {
+                t.Fatal(err)
+            }
+            if status != tt.status {
+                t.Fatalf("got status %d, want %d", status, tt.status)
+            }
+        })
+    }
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+    "context"
+    "database/sql/driver"
+    "errors"
+    "net/http"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// A circuit breaker opens after a run of consecutive failures and rejects
+// calls until its cooldown has passed. It then lets a single probe through
+// (half-open): success closes it again, failure re-opens it for another
+// cooldown. A call its caller cancelled tells nothing about the dependency:
+// it leaves the state as it was and frees the probe slot for the next call.
+
+const (
+    breakerClosed   = "closed"
+    breakerOpen     = "open"
+    breakerHalfOpen = "half-open"
+)
+
+var errBreakerOpen = errors.New("circuit breaker open")
+
+type circuitBreaker struct {
+    name      string
+    threshold int
+    cooldown  time.Duration
+    
+    mu       sync.Mutex
+    state    string
+    failures int
+    openedAt time.Time
+    probing  bool
+}
+
+var (
+    chainBreaker = newCircuitBreaker("chain")
+    storeBreaker = newCircuitBreaker("store")
+)
+
+func newCircuitBreaker(name string) *circuitBreaker {
+    b := &circuitBreaker{name: name, threshold: 5, cooldown: 30 * time.Second, state: breakerClosed}
+    if n, err := strconv.Atoi(os.Getenv("BREAKER_THRESHOLD")); err == nil && n > 0 {
+        b.threshold = n
+    }
+    if d, err := time.ParseDuration(os.Getenv("BREAKER_COOLDOWN")); err == nil && d > 0 {
+        b.cooldown = d
+    }
+    return b
+}
+
+// allow reports whether a call may proceed. Once the cooldown has passed only
+// the first caller is let through, as the probe.
+func (b *circuitBreaker) allow() bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    switch b.state {
+    case breakerOpen:
+        if time.Since(b.openedAt) < b.cooldown {
+            return false
+        }
+        b.state = breakerHalfOpen
+        b.probing = true
+        return true
+    case breakerHalfOpen:
+        if b.probing {
+            return false
+        }
+        b.probing = true
+        return true
+    }
+    return true
+}
+
+func (b *circuitBreaker) record(failed bool) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if !failed {
+        b.state, b.failures, b.probing = breakerClosed, 0, false
+        return
+    }
+    b.failures++
+    if b.state == breakerHalfOpen || b.failures >= b.threshold {
+        b.state, b.openedAt, b.probing = breakerOpen, time.Now(), false
+    }
+}
+
+// cancel ends a call abandoned by its caller without recording an outcome.
+func (b *circuitBreaker) cancel() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.probing = false
+}
+
+// finish records the outcome of a call that allow let through.
+func (b *circuitBreaker) finish(err error, failed bool) {
+    if errors.Is(err, context.Canceled) {
+        b.cancel()
+        return
+    }
+    b.record(failed)
+}
+
+func (b *circuitBreaker) do(fn func() error) error {
+    if !b.allow() {
+        return errBreakerOpen
+    }
+    err := fn()
+    b.finish(err, err != nil)
+    return err
+}
+
+// isOpen reports whether calls are currently being rejected. A breaker whose
+// cooldown has passed counts as closed so that work can arrive to probe it.
+func (b *circuitBreaker) isOpen() bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.state == breakerOpen && time.Since(b.openedAt) < b.cooldown
+}
+
+// retryAfter is how long until an open breaker will let a probe through.
+func (b *circuitBreaker) retryAfter() time.Duration {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.state != breakerOpen {
+        return 0
+    }
+    return b.cooldown - time.Since(b.openedAt)
+}
+
+func (b *circuitBreaker) status() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.state == breakerOpen && time.Since(b.openedAt) >= b.cooldown {
+        return breakerHalfOpen
+    }
+    return b.state
+}
+
+// breakerTransport guards every request the RPC client makes to the node.
+// JSON-RPC errors such as reverts arrive with HTTP 200 and are not failures.
+type breakerTransport struct {
+    base    http.RoundTripper
+    breaker *circuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    if !t.breaker.allow() {
+        return nil, errBreakerOpen
+    }
+    resp, err := t.base.RoundTrip(req)
+    t.breaker.finish(err, err != nil || resp.StatusCode >= 500)
+    return resp, err
+}
+
+// breakerConnector guards opening database connections. When the database
+// goes away pooled connections fail with driver.ErrBadConn and database/sql
+// opens new ones, so connection attempts see every outage.
+//
+// Only connection attempts are guarded. Queries on connections already open
+// are neither counted nor rejected: a database that accepts connections but
+// fails or stalls queries does not open the breaker, and while it is open,
+// idle pooled connections still serve queries. Query timeouts are left to
+// the callers' contexts.
+type breakerConnector struct {
+    dsn     string
+    driver  driver.Driver
+    breaker *circuitBreaker
+}
+
+func (c *breakerConnector) Connect(ctx context.Context) (driver.Conn, error) {
+    var conn driver.Conn
+    err := c.breaker.do(func() error {
+        var err error
+        conn, err = c.driver.Open(c.dsn)
+        return err
+    })
+    return conn, err
+}
+
+func (c *breakerConnector) Driver() driver.Driver {
+    return c.driver
+}
+
+func (ws *WalletService) HandleHealth(w http.ResponseWriter, r *http.Request) {
+    health := map[string]string{
+        chainBreaker.name: chainBreaker.status(),
+        storeBreaker.name: storeBreaker.status(),
+    }
+    if chainBreaker.isOpen() || storeBreaker.isOpen() {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(503)
+    }
+    writeJSON(w, health)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "testing"
+    "time"
+)
+
+// errCooldown stands for the cooldown passing in a sequence of calls.
+var errCooldown = errors.New("cooldown passes")
+
+func TestCircuitBreaker(t *testing.T) {
+    failure := errors.New("connection refused")
+    canceled := fmt.Errorf("call: %w", context.Canceled)
+    tests := []struct {
+        name   string
+        calls  []error
+        state  string
+        probes bool
+    }{
+        {"opens at the threshold", []error{failure, failure, failure}, breakerOpen, false},
+        {"success resets the count", []error{failure, failure, nil, failure, failure}, breakerClosed, true},
+        {"cancellations are not failures", []error{failure, failure, canceled, canceled, canceled}, breakerClosed, true},
+        {"failed probe re-opens", []error{failure, failure, failure, errCooldown, failure}, breakerOpen, false},
+        {"cancelled probe stays half-open", []error{failure, failure, failure, errCooldown, canceled}, breakerHalfOpen, true},
+        {"probe success closes", []error{failure, failure, failure, errCooldown, nil}, breakerClosed, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            b := &circuitBreaker{name: "test", threshold: 3, cooldown: time.Hour, state: breakerClosed}
+            for _, err := range tt.calls {
+                if err == errCooldown {
+                    b.openedAt = b.openedAt.Add(-b.cooldown)
+                    continue
+                }
+                b.do(func() error { return err })
+            }
+            if b.state != tt.state {
+                t.Fatalf("state %s, want %s", b.state, tt.state)
+            }
+            if probes := b.allow(); probes != tt.probes {
+                t.Fatalf("next call allowed %v, want %v", probes, tt.probes)
+            }
+        })
+    }
+}
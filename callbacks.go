@@ -0,0 +1,242 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "syscall"
+    "time"
+)
+
+// Callbacks tell a caller how its transfer ended without it having to poll.
+// When a transfer with a callback_url reaches its final outcome (confirmed,
+// failed, rejected or dropped), the outcome is written to the callbacks table
+// in the same transaction as the status change, and a background loop POSTs
+// it until the receiver answers 2xx or the attempts run out. Replicas claim
+// deliveries with SKIP LOCKED, so each attempt is made once.
+//
+// Callback URLs must resolve to public addresses. They are checked when
+// they are registered and again on every connection, so a name that later
+// resolves to an internal address is refused too.
+//
+// Each delivery carries X-Signature-Timestamp and X-Signature headers, the
+// signature being hex HMAC-SHA256 over "<timestamp>.<body>" keyed with
+// CALLBACK_SECRET.
+
+var (
+    callbackSecret      = os.Getenv("CALLBACK_SECRET")
+    callbackMaxAttempts = envInt("CALLBACK_MAX_ATTEMPTS", 8)
+    callbackClient      = &http.Client{Timeout: 10 * time.Second, Transport: publicTransport()}
+    callbackWake        = make(chan struct{}, 1)
+    
+    // callbackLease is how long a claimed delivery is left to its replica
+    // before another may retry it.
+    callbackLease = time.Minute
+)
+
+var errPrivateAddress = errors.New("address is not public")
+
+// nonPublicNets are ranges the net package does not classify: "this
+// network" and carrier-grade NAT shared address space.
+var nonPublicNets = []*net.IPNet{
+    {IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+    {IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+}
+
+// isPublicIP reports whether ip is routable on the internet: not loopback,
+// private, link-local, multicast, unspecified, "this network" or
+// carrier-grade NAT.
+func isPublicIP(ip net.IP) bool {
+    if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+        ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+        return false
+    }
+    for _, n := range nonPublicNets {
+        if n.Contains(ip) {
+            return false
+        }
+    }
+    return true
+}
+
+// allowedIP decides which addresses outgoing requests to user-supplied URLs
+// may reach. Tests replace it to talk to local servers.
+var allowedIP = isPublicIP
+
+// checkPublicHost resolves the host of u and refuses it unless every address
+// it resolves to is allowed.
+func checkPublicHost(ctx context.Context, u *url.URL) error {
+    addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+    if err != nil {
+        return err
+    }
+    for _, addr := range addrs {
+        if !allowedIP(addr.IP) {
+            return errPrivateAddress
+        }
+    }
+    return nil
+}
+
+// publicDialer connects only to allowed addresses, checked on the address
+// actually connected to so that DNS changes and redirects cannot reach
+// internal hosts.
+func publicDialer() *net.Dialer {
+    return &net.Dialer{
+        Timeout: 10 * time.Second,
+        Control: func(network, address string, _ syscall.RawConn) error {
+            host, _, err := net.SplitHostPort(address)
+            if err != nil {
+                return err
+            }
+            if ip := net.ParseIP(host); ip == nil || !allowedIP(ip) {
+                return errPrivateAddress
+            }
+            return nil
+        },
+    }
+}
+
+// publicTransport makes HTTP requests through publicDialer.
+func publicTransport() *http.Transport {
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.Proxy = nil
+    transport.DialContext = publicDialer().DialContext
+    return transport
+}
+
+func validateCallbackURL(ctx context.Context, raw string) error {
+    if raw == "" {
+        return nil
+    }
+    if callbackSecret == "" {
+        return &requestError{400, "Callbacks are not configured"}
+    }
+    u, err := url.Parse(raw)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        return &requestError{400, "Invalid callback_url"}
+    }
+    if err := checkPublicHost(ctx, u); err != nil {
+        return &requestError{400, "callback_url must resolve to a public address"}
+    }
+    return nil
+}
+
+// queueCallback records the outcome of a transfer for delivery if the caller
+// asked for a callback. Call it inside the transaction that gives the
+// transfer its final status, and wakeCallbacks once that has committed.
+func queueCallback(ctx context.Context, ex execer, id int64) error {
+    _, err := ex.ExecContext(ctx, `INSERT INTO callbacks (transfer_id, url, payload)
+        SELECT id, callback_url, json_build_object('id', id, 'status', status, 'tx_hash', tx_hash,
+            'from', from_address, 'to', to_address, 'amount', amount, 'amount_wei', `+amountWeiSQL+`, 'settled_at', now())::text
+        FROM transfers WHERE id = $1 AND callback_url IS NOT NULL`, id)
+    return err
+}
+
+func wakeCallbacks() {
+    select {
+    case callbackWake <- struct{}{}:
+    default:
+    }
+}
+
+func signCallback(timestamp string, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(callbackSecret))
+    mac.Write([]byte(timestamp + "."))
+    mac.Write(body)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// callbackBackoff doubles from 10s up to an hour between attempts.
+func callbackBackoff(attempts int) time.Duration {
+    d := 10 * time.Second << uint(attempts)
+    if attempts > 8 || d > time.Hour {
+        return time.Hour
+    }
+    return d
+}
+
+func runCallbacks() {
+    ticker := time.NewTicker(5 * time.Second)
+    defer ticker.Stop()
+    for {
+        if err := deliverCallbacks(); err != nil {
+            log.Println("Delivering callbacks failed:", err)
+        }
+        select {
+        case <-ticker.C:
+        case <-callbackWake:
+        }
+    }
+}
+
+// deliverCallbacks makes one attempt at up to 50 due callbacks. Each is
+// claimed by pushing its next attempt past the lease, skipping rows another
+// replica has locked, so no callback is posted twice at the same time.
+func deliverCallbacks() error {
+    type delivery struct {
+        id       int64
+        url      string
+        payload  string
+        attempts int
+    }
+    for i := 0; i < 50; i++ {
+        var d delivery
+        err := db.QueryRow(`UPDATE callbacks SET next_attempt = now() + make_interval(secs => $1)
+            WHERE id = (SELECT id FROM callbacks WHERE status = 'pending' AND next_attempt <= now()
+                ORDER BY next_attempt LIMIT 1 FOR UPDATE SKIP LOCKED)
+            RETURNING id, url, payload, attempts`, callbackLease.Seconds()).Scan(&d.id, &d.url, &d.payload, &d.attempts)
+        if err == sql.ErrNoRows {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        
+        err = postCallback(d.url, []byte(d.payload))
+        if err == nil {
+            db.Exec("UPDATE callbacks SET status = 'delivered', attempts = attempts + 1, delivered_at = now(), last_error = NULL WHERE id = $1", d.id)
+            continue
+        }
+        status := "pending"
+        if d.attempts+1 >= callbackMaxAttempts {
+            status = "failed"
+            log.Println("Giving up on callback", d.id, "to", d.url+":", err)
+        }
+        db.Exec("UPDATE callbacks SET status = $2, attempts = attempts + 1, next_attempt = $3, last_error = $4 WHERE id = $1",
+            d.id, status, time.Now().Add(callbackBackoff(d.attempts)), err.Error())
+    }
+    return nil
+}
+
+func postCallback(target string, body []byte) error {
+    req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Signature-Timestamp", timestamp)
+    req.Header.Set("X-Signature", signCallback(timestamp, body))
+    
+    resp, err := callbackClient.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return fmt.Errorf("callback returned %s", resp.Status)
+    }
+    return nil
+}
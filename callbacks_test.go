@@ -0,0 +1,163 @@
+package main
+
+import (
+    "context"
+    "math/big"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "testing"
+
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestIsPublicIP(t *testing.T) {
+    tests := []struct {
+        ip     string
+        public bool
+    }{
+        {"8.8.8.8", true},
+        {"2001:4860:4860::8888", true},
+        {"127.0.0.1", false},
+        {"10.1.2.3", false},
+        {"169.254.169.254", false},
+        {"0.0.0.0", false},
+        {"0.1.2.3", false},
+        {"100.64.0.1", false},
+        {"100.127.255.254", false},
+        {"100.128.0.1", true},
+        {"::ffff:100.64.0.1", false},
+        {"fd00::1", false},
+    }
+    for _, tt := range tests {
+        if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.public {
+            t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.public)
+        }
+    }
+}
+
+func TestCallbackURLsMustBePublic(t *testing.T) {
+    defer func(secret string) { callbackSecret = secret }(callbackSecret)
+    callbackSecret = "secret"
+    tests := []struct {
+        url string
+        ok  bool
+    }{
+        {"https://8.8.8.8/hook", true},
+        {"http://127.0.0.1:8545/", false},
+        {"http://10.0.0.5/hook", false},
+        {"http://192.168.1.1/hook", false},
+        {"http://169.254.169.254/latest/meta-data", false},
+        {"http://[::1]/hook", false},
+        {"http://[fe80::1]/hook", false},
+        {"http://0.0.0.0/hook", false},
+        {"http://localhost/hook", false},
+        {"ftp://8.8.8.8/hook", false},
+    }
+    for _, tt := range tests {
+        err := validateCallbackURL(context.Background(), tt.url)
+        if (err == nil) != tt.ok {
+            t.Errorf("%s: got %v, want allowed %v", tt.url, err, tt.ok)
+        }
+    }
+}
+
+func TestCallbackDeliveryRefusesPrivateAddresses(t *testing.T) {
+    hits := 0
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits++ }))
+    defer srv.Close()
+    // The URL passed validation once; it now points at a local address.
+    if err := postCallback(srv.URL, []byte("{}")); err == nil || hits != 0 {
+        t.Fatalf("got %v with %d requests, want the connection refused", err, hits)
+    }
+}
+
+func TestCallbacksOnlyForFinalOutcome(t *testing.T) {
+    testDB(t)
+    testKeyStore(t)
+    ctx := context.Background()
+    newTransfer := func(status string) int64 {
+        var id int64
+        err := db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status, callback_url)
+            VALUES ('0x1111111111111111111111111111111111111111', '0x2222222222222222222222222222222222222222', 1, $1, 'https://8.8.8.8/hook')
+            RETURNING id`, status).Scan(&id)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return id
+    }
+    callbacks := func(id int64) int {
+        return countRows(t, "SELECT COUNT(*) FROM callbacks WHERE transfer_id = "+strconv.FormatInt(id, 10))
+    }
+    
+    to := common.HexToAddress("0x2222222222222222222222222222222222222222")
+    tx := types.NewTx(&types.DynamicFeeTx{ChainID: big.NewInt(1337), GasFeeCap: big.NewInt(1), Gas: 21000, To: &to, Value: big.NewInt(1)})
+    settled := newTransfer("processing")
+    if err := completeTransfer(ctx, settled, tx); err != nil {
+        t.Fatal(err)
+    }
+    if n := callbacks(settled); n != 0 {
+        t.Fatalf("%d callbacks at broadcast, want none before settlement", n)
+    }
+    receipt := &types.Receipt{Status: types.ReceiptStatusSuccessful, BlockNumber: big.NewInt(10), TxHash: tx.Hash()}
+    for i := 0; i < 2; i++ {
+        if err := settleReceipt(ctx, settled, receipt, 20, 1); err != nil {
+            t.Fatal(err)
+        }
+    }
+    
+    failed := newTransfer("processing")
+    for i := 0; i < 2; i++ {
+        if err := failTransfer(ctx, failed, "test"); err != nil {
+            t.Fatal(err)
+        }
+    }
+    
+    rejected := newTransfer("held")
+    if w := serve(new(WalletService).HandleRejectTransfer, &APIClient{ID: "admin", Admin: true}, "POST",
+        "/transfers/reject?id="+strconv.FormatInt(rejected, 10), ""); w.Code != 200 {
+        t.Fatalf("reject: status %d", w.Code)
+    }
+    
+    for name, id := range map[string]int64{"settled": settled, "failed": failed, "rejected": rejected} {
+        if n := callbacks(id); n != 1 {
+            t.Errorf("%s transfer has %d callbacks, want 1", name, n)
+        }
+    }
+}
+
+func TestDeliverCallbacksClaimsEachOnce(t *testing.T) {
+    testDB(t)
+    defer func(allowed func(net.IP) bool) { allowedIP = allowed }(allowedIP)
+    allowedIP = func(net.IP) bool { return true }
+    var hits int32
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { atomic.AddInt32(&hits, 1) }))
+    defer srv.Close()
+    
+    var id int64
+    db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status) VALUES ('0x1', '0x2', 1, 'failed') RETURNING id`).Scan(&id)
+    for i := 0; i < 10; i++ {
+        mustExec(t, "INSERT INTO callbacks (transfer_id, url, payload) VALUES ($1, $2, '{}')", id, srv.URL)
+    }
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if err := deliverCallbacks(); err != nil {
+                t.Error(err)
+            }
+        }()
+    }
+    wg.Wait()
+    if hits != 10 {
+        t.Errorf("receiver got %d posts, want 10", hits)
+    }
+    if n := countRows(t, "SELECT COUNT(*) FROM callbacks WHERE status = 'delivered' AND attempts = 1"); n != 10 {
+        t.Errorf("%d callbacks delivered once, want 10", n)
+    }
+}
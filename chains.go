@@ -0,0 +1,376 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/ethereum/go-ethereum/ethclient"
+    "github.com/ethereum/go-ethereum/rpc"
+    "github.com/gorilla/websocket"
+)
+
+// The chain registry describes the networks a tenant works with. Tenants
+// register their own chains, and admins register global ones (client '')
+// through the API or the CHAINS_FILE JSON file read at startup. A tenant's
+// own definition takes precedence over a global one with the same chain ID.
+//
+// A transfer names its chain with chain_id and is sent on it as the caller
+// defines it: its confirmations settle the transfer and its fee model decides
+// whether it is signed as an EIP-1559 or a legacy transaction. The connected
+// chain, the node the service is started against, is the default and is
+// always known, described by EXPLORER_URL and CONFIRMATIONS unless registered
+// explicitly. Any other chain is reached through the first of its RPC URLs
+// that can be dialled; a tenant's own chains only over public addresses.
+// Transfers and nonces store the chain as 0 for the connected chain and as
+// the chain ID otherwise. Base fee deferral, deposit scanning, sweeps and the
+// JSON-RPC endpoint work on the connected chain only.
+//
+// Every RPC URL registered through the API is dialled once and must be a
+// public host reporting the declared chain ID. CHAINS_FILE is the operator's
+// own configuration and may name private hosts.
+
+const (
+    feeModelEIP1559 = "eip1559"
+    feeModelLegacy  = "legacy"
+)
+
+type Currency struct {
+    Symbol   string `json:"symbol"`
+    Decimals int    `json:"decimals"`
+}
+
+type Chain struct {
+    Client        string   `json:"client"`
+    ChainID       int64    `json:"chain_id"`
+    Name          string   `json:"name"`
+    RPCURLs       []string `json:"rpc_urls"`
+    Currency      Currency `json:"currency"`
+    FeeModel      string   `json:"fee_model"`
+    Confirmations int      `json:"confirmations"`
+    ExplorerURL   string   `json:"explorer_url,omitempty"`
+}
+
+func defaultChain() *Chain {
+    return &Chain{
+        ChainID:       chainID.Int64(),
+        Name:          "default",
+        Currency:      Currency{Symbol: "ETH", Decimals: 18},
+        FeeModel:      feeModelEIP1559,
+        Confirmations: envInt("CONFIRMATIONS", 12),
+        ExplorerURL:   strings.TrimRight(os.Getenv("EXPLORER_URL"), "/"),
+    }
+}
+
+func (c *Chain) txURL(hash string) string {
+    if c.ExplorerURL == "" || hash == "" {
+        return ""
+    }
+    return c.ExplorerURL + "/tx/" + hash
+}
+
+func (c *Chain) addressURL(address string) string {
+    if c.ExplorerURL == "" {
+        return ""
+    }
+    return c.ExplorerURL + "/address/" + address
+}
+
+// lookupChain returns the client's definition of the chain, falling back to
+// the global one and then to the connected chain. It returns nil for an
+// unknown chain.
+func lookupChain(ctx context.Context, client string, id int64) (*Chain, error) {
+    c := &Chain{}
+    var urls string
+    err := db.QueryRowContext(ctx, `SELECT client_id, chain_id, name, rpc_urls, currency_symbol, currency_decimals, fee_model, confirmations,
+        COALESCE(explorer_url, '') FROM chains WHERE client_id IN ($1, '') AND chain_id = $2 ORDER BY client_id = $1 DESC LIMIT 1`, client, id).
+        Scan(&c.Client, &c.ChainID, &c.Name, &urls, &c.Currency.Symbol, &c.Currency.Decimals, &c.FeeModel, &c.Confirmations, &c.ExplorerURL)
+    if err == sql.ErrNoRows {
+        if chainID != nil && id == chainID.Int64() {
+            return defaultChain(), nil
+        }
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal([]byte(urls), &c.RPCURLs); err != nil {
+        return nil, fmt.Errorf("chain %d: rpc_urls: %v", id, err)
+    }
+    return c, nil
+}
+
+// validateChain checks the definition and that every RPC URL answers with
+// the declared chain ID. Unless private is set the URLs must resolve to
+// public addresses, and every failure gets the same error so that
+// registration cannot be used to probe hosts and ports.
+func validateChain(ctx context.Context, c *Chain, private bool) error {
+    if c.ChainID <= 0 || c.Name == "" || c.Currency.Symbol == "" || c.Currency.Decimals < 0 || c.Confirmations < 0 {
+        return &requestError{400, "Invalid chain definition"}
+    }
+    if c.FeeModel == "" {
+        c.FeeModel = feeModelEIP1559
+    }
+    if c.FeeModel != feeModelEIP1559 && c.FeeModel != feeModelLegacy {
+        return &requestError{400, "fee_model must be eip1559 or legacy"}
+    }
+    if c.ExplorerURL != "" {
+        u, err := url.Parse(c.ExplorerURL)
+        if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+            return &requestError{400, "Invalid explorer_url"}
+        }
+        c.ExplorerURL = strings.TrimRight(c.ExplorerURL, "/")
+    }
+    if len(c.RPCURLs) == 0 {
+        return &requestError{400, "At least one RPC URL is required"}
+    }
+    for _, rawurl := range c.RPCURLs {
+        if err := checkChainRPC(ctx, rawurl, c.ChainID, private); err != nil {
+            log.Println("Chain", c.ChainID, "RPC URL", rawurl, "refused:", err)
+            return &requestError{400, fmt.Sprintf("%s is not a reachable public RPC endpoint for chain %d", rawurl, c.ChainID)}
+        }
+    }
+    return nil
+}
+
+func checkChainRPC(ctx context.Context, rawurl string, want int64, private bool) error {
+    ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+    defer cancel()
+    rpcClient, err := dialChainRPC(ctx, rawurl, private)
+    if err != nil {
+        return err
+    }
+    defer rpcClient.Close()
+    got, err := ethclient.NewClient(rpcClient).ChainID(ctx)
+    if err != nil {
+        return err
+    }
+    if !got.IsInt64() || got.Int64() != want {
+        return fmt.Errorf("reports chain id %s, not %d", got, want)
+    }
+    return nil
+}
+
+// dialChainRPC connects to a chain's RPC URL. Unless private is set, the host
+// must resolve to public addresses and the connection may only reach those.
+func dialChainRPC(ctx context.Context, rawurl string, private bool) (*rpc.Client, error) {
+    u, err := url.Parse(rawurl)
+    if err != nil || u.Host == "" {
+        return nil, fmt.Errorf("invalid URL")
+    }
+    switch u.Scheme {
+    case "http", "https", "ws", "wss":
+    default:
+        return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+    }
+    var options []rpc.ClientOption
+    if !private {
+        if err := checkPublicHost(ctx, u); err != nil {
+            return nil, err
+        }
+        options = append(options, rpc.WithHTTPClient(&http.Client{Transport: publicTransport()}),
+            rpc.WithWebsocketDialer(websocket.Dialer{NetDialContext: publicDialer().DialContext}))
+    }
+    return rpc.DialOptions(ctx, rawurl, options...)
+}
+
+// A chainConn is a chain as a client defines it together with a node
+// connection for it. key is the chain as stored with transfers and nonces.
+type chainConn struct {
+    *Chain
+    eth *ethclient.Client
+    key int64
+}
+
+var (
+    chainClientsMu sync.Mutex
+    chainClients   = map[string]*ethclient.Client{}
+)
+
+// openChain connects to chain id as client defines it, 0 meaning the
+// connected chain. An unknown chain is a request error.
+func openChain(ctx context.Context, client string, id int64) (*chainConn, error) {
+    key := id
+    if id == 0 || id == chainID.Int64() {
+        id, key = chainID.Int64(), 0
+    }
+    c, err := lookupChain(ctx, client, id)
+    if err != nil {
+        return nil, err
+    }
+    if c == nil {
+        return nil, &requestError{400, fmt.Sprintf("Unknown chain %d", id)}
+    }
+    if key == 0 {
+        return &chainConn{Chain: c, eth: ethClient}, nil
+    }
+    eth, err := chainClient(ctx, c)
+    if err != nil {
+        return nil, err
+    }
+    return &chainConn{Chain: c, eth: eth, key: key}, nil
+}
+
+// chainClient returns a client for a chain other than the connected one,
+// dialling its RPC URLs in order the first time the definition is used.
+func chainClient(ctx context.Context, c *Chain) (*ethclient.Client, error) {
+    cacheKey := fmt.Sprint(c.Client, c.ChainID, c.RPCURLs)
+    chainClientsMu.Lock()
+    eth, ok := chainClients[cacheKey]
+    chainClientsMu.Unlock()
+    if ok {
+        return eth, nil
+    }
+    
+    ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+    defer cancel()
+    err := fmt.Errorf("no RPC URL")
+    for _, rawurl := range c.RPCURLs {
+        var rpcClient *rpc.Client
+        if rpcClient, err = dialChainRPC(ctx, rawurl, c.Client == ""); err != nil {
+            log.Println("Chain", c.ChainID, "RPC URL", rawurl, "unavailable:", err)
+            continue
+        }
+        eth = ethclient.NewClient(rpcClient)
+        chainClientsMu.Lock()
+        if cached, ok := chainClients[cacheKey]; ok {
+            rpcClient.Close()
+            eth = cached
+        } else {
+            chainClients[cacheKey] = eth
+        }
+        chainClientsMu.Unlock()
+        return eth, nil
+    }
+    return nil, fmt.Errorf("chain %d unavailable: %v", c.ChainID, err)
+}
+
+// storedChainID is the chain ID of a chain stored as key.
+func storedChainID(key int64) int64 {
+    if key == 0 {
+        return chainID.Int64()
+    }
+    return key
+}
+
+func saveChain(ctx context.Context, c *Chain) error {
+    urls, _ := json.Marshal(c.RPCURLs)
+    _, err := db.ExecContext(ctx, `INSERT INTO chains (client_id, chain_id, name, rpc_urls, currency_symbol, currency_decimals, fee_model,
+            confirmations, explorer_url)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''))
+        ON CONFLICT (client_id, chain_id) DO UPDATE SET name = $3, rpc_urls = $4, currency_symbol = $5, currency_decimals = $6,
+            fee_model = $7, confirmations = $8, explorer_url = NULLIF($9, '')`,
+        c.Client, c.ChainID, c.Name, string(urls), c.Currency.Symbol, c.Currency.Decimals, c.FeeModel, c.Confirmations, c.ExplorerURL)
+    return err
+}
+
+// loadChainsFile registers the global chains listed in CHAINS_FILE. Chains
+// that fail validation are logged and skipped.
+func loadChainsFile() error {
+    path := os.Getenv("CHAINS_FILE")
+    if path == "" {
+        return nil
+    }
+    raw, err := os.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    var chains []Chain
+    if err := json.Unmarshal(raw, &chains); err != nil {
+        return fmt.Errorf("%s: %v", path, err)
+    }
+    ctx := context.Background()
+    for i := range chains {
+        c := &chains[i]
+        c.Client = ""
+        if err := validateChain(ctx, c, true); err != nil {
+            log.Println("Skipping chain", c.ChainID, "from", path+":", err)
+            continue
+        }
+        if err := saveChain(ctx, c); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// HandleChains lists the chains visible to the caller, registers one, or
+// with DELETE removes one of the caller's (?chain_id=). Admins may register
+// and remove global chains by leaving client empty.
+func (ws *WalletService) HandleChains(w http.ResponseWriter, r *http.Request) {
+    client := clientFromContext(r.Context())
+    admin := client != nil && client.Admin
+    switch r.Method {
+    case http.MethodPost:
+        var c Chain
+        if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+            http.Error(w, "Invalid request", 400)
+            return
+        }
+        if !admin {
+            c.Client = clientID(r.Context())
+        }
+        if err := validateChain(r.Context(), &c, false); err != nil {
+            writeError(w, err)
+            return
+        }
+        if err := saveChain(r.Context(), &c); err != nil {
+            writeError(w, err)
+            return
+        }
+        w.Write([]byte("Chain saved"))
+    case http.MethodDelete:
+        id, err := strconv.ParseInt(r.URL.Query().Get("chain_id"), 10, 64)
+        if err != nil {
+            http.Error(w, "Invalid chain_id", 400)
+            return
+        }
+        owner := clientID(r.Context())
+        if admin {
+            owner = r.URL.Query().Get("client")
+        }
+        res, err := db.ExecContext(r.Context(), "DELETE FROM chains WHERE client_id = $1 AND chain_id = $2", owner, id)
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+            http.Error(w, "Chain not found", 404)
+            return
+        }
+        w.Write([]byte("Chain removed"))
+    default:
+        rows, err := db.QueryContext(r.Context(), `SELECT client_id, chain_id, name, rpc_urls, currency_symbol, currency_decimals, fee_model,
+            confirmations, COALESCE(explorer_url, '') FROM chains WHERE client_id IN ($1, '') ORDER BY chain_id, client_id`, clientID(r.Context()))
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        defer rows.Close()
+        chains := []Chain{}
+        for rows.Next() {
+            var c Chain
+            var urls string
+            if err := rows.Scan(&c.Client, &c.ChainID, &c.Name, &urls, &c.Currency.Symbol, &c.Currency.Decimals, &c.FeeModel,
+                &c.Confirmations, &c.ExplorerURL); err != nil {
+                writeError(w, err)
+                return
+            }
+            if err := json.Unmarshal([]byte(urls), &c.RPCURLs); err != nil {
+                writeError(w, err)
+                return
+            }
+            chains = append(chains, c)
+        }
+        writeJSON(w, chains)
+    }
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "math/big"
+    "net"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/common/hexutil"
+    "github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestChainRPCURLsMustBePublic(t *testing.T) {
+    node := &fakeNode{handlers: map[string]func([]json.RawMessage) (interface{}, error){}, calls: map[string]int{}}
+    node.respond("eth_chainId", "0x539")
+    srv := httptest.NewServer(node)
+    defer srv.Close()
+    closed := httptest.NewServer(node)
+    closed.Close()
+    ctx := context.Background()
+    chain := func(id int64, url string) *Chain {
+        return &Chain{ChainID: id, Name: "test", Currency: Currency{Symbol: "ETH", Decimals: 18}, RPCURLs: []string{url}}
+    }
+    
+    if err := validateChain(ctx, chain(1337, srv.URL), false); err == nil {
+        t.Fatal("a loopback RPC URL was accepted")
+    }
+    if n := node.count("eth_chainId"); n != 0 {
+        t.Fatalf("the loopback RPC URL was called %d times", n)
+    }
+    if err := validateChain(ctx, chain(1337, srv.URL), true); err != nil {
+        t.Fatalf("CHAINS_FILE chain on a private host: %v", err)
+    }
+    
+    // Whatever went wrong, the caller learns nothing about the host.
+    defer func(allowed func(net.IP) bool) { allowedIP = allowed }(allowedIP)
+    allowedIP = func(net.IP) bool { return true }
+    if err := validateChain(ctx, chain(1337, srv.URL), false); err != nil {
+        t.Fatal(err)
+    }
+    wrongChain := validateChain(ctx, chain(5, srv.URL), false)
+    refused := validateChain(ctx, chain(5, closed.URL), false)
+    if wrongChain == nil || refused == nil {
+        t.Fatalf("got %v and %v, want both refused", wrongChain, refused)
+    }
+    if strings.Replace(wrongChain.Error(), srv.URL, "", 1) != strings.Replace(refused.Error(), closed.URL, "", 1) {
+        t.Errorf("errors differ: %q and %q", wrongChain, refused)
+    }
+}
+
+func TestLookupChainReportsCorruptRPCURLs(t *testing.T) {
+    testDB(t)
+    mustExec(t, `INSERT INTO chains (client_id, chain_id, name, rpc_urls, currency_symbol) VALUES ('', 5, 'test', 'not json', 'ETH')`)
+    if c, err := lookupChain(context.Background(), "", 5); err == nil {
+        t.Fatalf("got %+v, want an error", c)
+    }
+}
+
+func TestTransfersFollowTheirTenantsChain(t *testing.T) {
+    testDB(t)
+    testKeyStore(t)
+    node := testNode(t)
+    t.Setenv("CONFIRMATIONS", "12")
+    mustExec(t, `INSERT INTO chains (client_id, chain_id, name, rpc_urls, currency_symbol, fee_model, confirmations)
+        VALUES ('legacy', 1337, 'test', '[]', 'ETH', 'legacy', 2)`)
+    account, err := keyStore.NewAccount("")
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyStore.Unlock(account, "")
+    to := common.HexToAddress("0x2222222222222222222222222222222222222222")
+    testFees(t, node, big.NewInt(1e9), big.NewInt(1e9))
+    node.respond("eth_getTransactionCount", "0x0")
+    node.handle("eth_sendRawTransaction", func(params []json.RawMessage) (interface{}, error) {
+        return common.Hash{}.Hex(), nil
+    })
+    ctx := context.Background()
+    
+    sent := map[string]*types.Transaction{}
+    for i, client := range []string{"legacy", "other"} {
+        var id int64
+        err := db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status, client_id)
+            VALUES ($1, $2, 1, 'processing', $3) RETURNING id`, account.Address.Hex(), to.Hex(), client).Scan(&id)
+        if err != nil {
+            t.Fatal(err)
+        }
+        node.respond("eth_getTransactionCount", hexutil.EncodeUint64(uint64(i)))
+        tx, err := sendTransfer(ctx, connectedChain(t, client), id, TransactionRequest{From: account.Address.Hex(), To: to.Hex(), Amount: 1, ClientID: client})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if err := completeTransfer(ctx, id, tx); err != nil {
+            t.Fatal(err)
+        }
+        sent[client] = tx
+    }
+    if sent["legacy"].Type() != types.LegacyTxType || sent["other"].Type() != types.DynamicFeeTxType {
+        t.Fatalf("transaction types %d and %d, want legacy for the legacy tenant only", sent["legacy"].Type(), sent["other"].Type())
+    }
+    
+    // Both mined in block 10; at head 11 that is two confirmations.
+    var receipts []*types.Receipt
+    for _, tx := range sent {
+        receipts = append(receipts, &types.Receipt{Status: types.ReceiptStatusSuccessful, TxHash: tx.Hash(), BlockNumber: big.NewInt(10)})
+    }
+    testMined(node, big.NewInt(1e9), receipts...)
+    node.respond("eth_blockNumber", "0xb")
+    if err := advanceSagas(ctx); err != nil {
+        t.Fatal(err)
+    }
+    for client, want := range map[string]int{"legacy": 1, "other": 0} {
+        n := countRows(t, `SELECT COUNT(*) FROM transfer_steps s JOIN transfers t ON t.id = s.transfer_id
+            WHERE t.client_id = $1 AND s.step = $2`, client, stepConfirmed)
+        if n != want {
+            t.Errorf("%s: %d confirmed transfers at 2 confirmations, want %d", client, n, want)
+        }
+    }
+}
+
+func TestTransfersAreSentOnTheirChain(t *testing.T) {
+    testDB(t)
+    testKeyStore(t)
+    node := testNode(t)
+    other, url := startNode(t, 10)
+    mustExec(t, `INSERT INTO chains (chain_id, name, rpc_urls, currency_symbol, fee_model, confirmations)
+        VALUES (10, 'other', $1, 'ETH', 'legacy', 1)`, `["`+url+`"]`)
+    account, err := keyStore.NewAccount("")
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyStore.Unlock(account, "")
+    to := common.HexToAddress("0x2222222222222222222222222222222222222222")
+    other.respond("eth_getTransactionCount", "0x0")
+    other.respond("eth_maxPriorityFeePerGas", hexBig(big.NewInt(1e9)))
+    other.handle("eth_getBlockByNumber", func([]json.RawMessage) (interface{}, error) {
+        return &types.Header{Number: big.NewInt(9), Difficulty: new(big.Int), BaseFee: big.NewInt(2e9)}, nil
+    })
+    var sent *types.Transaction
+    other.handle("eth_sendRawTransaction", func(params []json.RawMessage) (interface{}, error) {
+        var raw hexutil.Bytes
+        if err := json.Unmarshal(params[0], &raw); err != nil {
+            return nil, err
+        }
+        sent = new(types.Transaction)
+        if err := sent.UnmarshalBinary(raw); err != nil {
+            return nil, err
+        }
+        return sent.Hash().Hex(), nil
+    })
+    
+    _, _, _, err = submitTransfer(context.Background(), TransactionRequest{From: account.Address.Hex(), To: to.Hex(), Amount: 1, ChainID: 99})
+    if re, ok := err.(*requestError); !ok || re.status != 400 {
+        t.Fatalf("unknown chain: %v, want 400", err)
+    }
+    
+    var id int64
+    err = db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status, chain_id)
+        VALUES ($1, $2, 1, 'processing', 10) RETURNING id`, account.Address.Hex(), to.Hex()).Scan(&id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    processTransaction(id, TransactionRequest{From: account.Address.Hex(), To: to.Hex(), Amount: 1, ChainID: 10})
+    if sent == nil || node.count("eth_sendRawTransaction") != 0 {
+        t.Fatal("the transfer was not sent to its chain's node")
+    }
+    if sent.ChainId().Int64() != 10 || sent.Type() != types.LegacyTxType {
+        t.Errorf("sent a type %d transaction for chain %s, want a legacy one for chain 10", sent.Type(), sent.ChainId())
+    }
+    if n := countRows(t, "SELECT COUNT(*) FROM nonces WHERE address = $1 AND chain_id = 10 AND nonce = 0", nonceKey(account.Address)); n != 1 {
+        t.Error("the nonce was not recorded for chain 10")
+    }
+    
+    // The receipt is looked up on the transfer's chain too.
+    testMined(other, nil, &types.Receipt{Status: types.ReceiptStatusSuccessful, TxHash: sent.Hash(), BlockNumber: big.NewInt(10)})
+    other.respond("eth_blockNumber", "0xa")
+    if err := advanceSagas(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if n := countRows(t, "SELECT COUNT(*) FROM transfer_steps WHERE transfer_id = $1 AND step = $2", id, stepConfirmed); n != 1 {
+        t.Error("the transfer was not confirmed from its chain's receipt")
+    }
+}
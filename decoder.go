@@ -0,0 +1,404 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "math/big"
+    "net/http"
+    "strings"
+
+    "github.com/ethereum/go-ethereum/accounts/abi"
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/common/hexutil"
+    "github.com/ethereum/go-ethereum/crypto"
+    "github.com/lib/pq"
+)
+
+// Calldata is decoded with the ABI registered for the called contract when
+// there is one, and otherwise with the 4-byte signature database, which is
+// seeded with the common token methods below. Signatures may name their
+// parameters, e.g. "transfer(address to,uint256 amount)".
+var builtinSignatures = []string{
+    "transfer(address to,uint256 amount)",
+    "transferFrom(address from,address to,uint256 amount)",
+    "approve(address spender,uint256 amount)",
+    "increaseAllowance(address spender,uint256 amount)",
+    "decreaseAllowance(address spender,uint256 amount)",
+    "safeTransferFrom(address from,address to,uint256 tokenId)",
+    "setApprovalForAll(address operator,bool approved)",
+    "deposit()",
+    "withdraw(uint256 amount)",
+}
+
+type Token struct {
+    Address  string `json:"address"`
+    Symbol   string `json:"symbol"`
+    Decimals int    `json:"decimals"`
+}
+
+type DecodedArg struct {
+    Name    string `json:"name,omitempty"`
+    Type    string `json:"type"`
+    Value   string `json:"value"`
+    Display string `json:"display,omitempty"`
+}
+
+type DecodedCall struct {
+    Contract string       `json:"contract,omitempty"`
+    Method   string       `json:"method"`
+    Selector string       `json:"selector"`
+    Args     []DecodedArg `json:"args"`
+    Source   string       `json:"source"`
+}
+
+func selectorOf(signature string) string {
+    return hexutil.Encode(crypto.Keccak256([]byte(canonicalSignature(signature)))[:4])
+}
+
+// canonicalSignature strips parameter names, leaving the form that is
+// hashed into the selector.
+func canonicalSignature(signature string) string {
+    open := strings.Index(signature, "(")
+    if open < 0 || !strings.HasSuffix(signature, ")") {
+        return signature
+    }
+    params := splitParams(signature[open+1 : len(signature)-1])
+    for i, p := range params {
+        params[i] = strings.Fields(p)[0]
+    }
+    return signature[:open] + "(" + strings.Join(params, ",") + ")"
+}
+
+func splitParams(s string) []string {
+    var params []string
+    for _, p := range strings.Split(s, ",") {
+        if p = strings.TrimSpace(p); p != "" {
+            params = append(params, p)
+        }
+    }
+    return params
+}
+
+// signatureArguments builds ABI arguments from a textual signature. Tuple
+// parameters cannot be expressed this way and are rejected.
+func signatureArguments(signature string) (string, abi.Arguments, error) {
+    open := strings.Index(signature, "(")
+    if open < 0 || !strings.HasSuffix(signature, ")") || strings.Contains(signature[open+1:len(signature)-1], "(") {
+        return "", nil, fmt.Errorf("unsupported signature %q", signature)
+    }
+    var args abi.Arguments
+    for _, p := range splitParams(signature[open+1 : len(signature)-1]) {
+        fields := strings.Fields(p)
+        typ, err := abi.NewType(fields[0], "", nil)
+        if err != nil {
+            return "", nil, err
+        }
+        arg := abi.Argument{Type: typ}
+        if len(fields) > 1 {
+            arg.Name = fields[len(fields)-1]
+        }
+        args = append(args, arg)
+    }
+    return signature[:open], args, nil
+}
+
+func lookupToken(ctx context.Context, address string) (*Token, error) {
+    t := &Token{}
+    err := db.QueryRowContext(ctx, "SELECT address, symbol, decimals FROM tokens WHERE address = $1", strings.ToLower(address)).
+        Scan(&t.Address, &t.Symbol, &t.Decimals)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return t, nil
+}
+
+func isAmountArg(name string) bool {
+    name = strings.ToLower(strings.TrimLeft(name, "_"))
+    return strings.Contains(name, "amount") || name == "value" || name == "wad"
+}
+
+func formatArg(arg abi.Argument, value interface{}, token *Token) DecodedArg {
+    d := DecodedArg{Name: arg.Name, Type: arg.Type.String()}
+    switch v := value.(type) {
+    case common.Address:
+        d.Value = v.Hex()
+    case *big.Int:
+        d.Value = v.String()
+        if token != nil && isAmountArg(arg.Name) {
+            d.Display = formatUnits(v, token.Decimals) + " " + token.Symbol
+        }
+    case []byte:
+        d.Value = hexutil.Encode(v)
+    case [32]byte:
+        d.Value = hexutil.Encode(v[:])
+    default:
+        raw, err := json.Marshal(v)
+        if err != nil {
+            d.Value = fmt.Sprint(v)
+        } else {
+            d.Value = string(raw)
+        }
+    }
+    return d
+}
+
+// callDecoder holds everything needed to decode calls to a set of contracts,
+// loaded up front so a page of transfers costs three queries instead of
+// three per transfer.
+type callDecoder struct {
+    tokens     map[string]*Token
+    names      map[string]string
+    abis       map[string]string
+    signatures map[string][]string
+}
+
+// loadDecoder loads the tokens and ABIs registered for the contracts in to
+// and the signatures known for the selectors of calldata.
+func loadDecoder(ctx context.Context, to []string, calldata []string) (*callDecoder, error) {
+    d := &callDecoder{tokens: map[string]*Token{}, names: map[string]string{}, abis: map[string]string{}, signatures: map[string][]string{}}
+    addresses := make([]string, len(to))
+    for i, address := range to {
+        addresses[i] = strings.ToLower(address)
+    }
+    selectors := []string{}
+    for _, data := range calldata {
+        if input := common.FromHex(data); len(input) >= 4 {
+            selectors = append(selectors, hexutil.Encode(input[:4]))
+        }
+    }
+    
+    rows, err := db.QueryContext(ctx, "SELECT address, symbol, decimals FROM tokens WHERE address = ANY($1)", pq.Array(addresses))
+    if err != nil {
+        return nil, err
+    }
+    for rows.Next() {
+        t := &Token{}
+        if err := rows.Scan(&t.Address, &t.Symbol, &t.Decimals); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        d.tokens[t.Address] = t
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    
+    rows, err = db.QueryContext(ctx, "SELECT address, name, abi::text FROM abi_registry WHERE address = ANY($1)", pq.Array(addresses))
+    if err != nil {
+        return nil, err
+    }
+    for rows.Next() {
+        var address, name, contractABI string
+        if err := rows.Scan(&address, &name, &contractABI); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        d.names[address], d.abis[address] = name, contractABI
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    
+    for _, signature := range builtinSignatures {
+        selector := selectorOf(signature)
+        d.signatures[selector] = append(d.signatures[selector], signature)
+    }
+    rows, err = db.QueryContext(ctx, "SELECT selector, signature FROM method_signatures WHERE selector = ANY($1) ORDER BY signature", pq.Array(selectors))
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var selector, signature string
+        if err := rows.Scan(&selector, &signature); err != nil {
+            return nil, err
+        }
+        d.signatures[selector] = append(d.signatures[selector], signature)
+    }
+    return d, rows.Err()
+}
+
+// decode decodes calldata sent to the contract at to. It returns nil when
+// data is empty or no known method matches its selector, and an error when
+// the registered ABI is unusable or the calldata does not fit the method.
+func (d *callDecoder) decode(to, data string) (*DecodedCall, error) {
+    input := common.FromHex(data)
+    if len(input) < 4 {
+        return nil, nil
+    }
+    call := &DecodedCall{Selector: hexutil.Encode(input[:4])}
+    
+    to = strings.ToLower(to)
+    token := d.tokens[to]
+    if token != nil {
+        call.Contract = token.Symbol
+    }
+    if name := d.names[to]; name != "" {
+        call.Contract = name
+    }
+    
+    var name string
+    var args abi.Arguments
+    if contractABI := d.abis[to]; contractABI != "" {
+        parsed, err := abi.JSON(strings.NewReader(contractABI))
+        if err != nil {
+            return nil, err
+        }
+        if method, err := parsed.MethodById(input[:4]); err == nil {
+            name, args, call.Source = method.RawName, method.Inputs, "abi"
+        }
+    }
+    
+    if call.Source == "" {
+        for _, signature := range d.signatures[call.Selector] {
+            n, a, err := signatureArguments(signature)
+            if err != nil {
+                continue
+            }
+            if _, err := a.Unpack(input[4:]); err == nil {
+                name, args, call.Source = n, a, "signature"
+                break
+            }
+        }
+    }
+    if call.Source == "" {
+        return nil, nil
+    }
+    
+    values, err := args.Unpack(input[4:])
+    if err != nil {
+        return nil, err
+    }
+    call.Method = name
+    call.Args = []DecodedArg{}
+    for i, arg := range args {
+        call.Args = append(call.Args, formatArg(arg, values[i], token))
+    }
+    return call, nil
+}
+
+// decodeCall decodes a single call. Use loadDecoder directly to decode many.
+func decodeCall(ctx context.Context, to, data string) (*DecodedCall, error) {
+    d, err := loadDecoder(ctx, []string{to}, []string{data})
+    if err != nil {
+        return nil, err
+    }
+    return d.decode(to, data)
+}
+
+func (ws *WalletService) HandleDecode(w http.ResponseWriter, r *http.Request) {
+    call, err := decodeCall(r.Context(), r.URL.Query().Get("to"), r.URL.Query().Get("data"))
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if call == nil {
+        http.Error(w, "Unknown method", 404)
+        return
+    }
+    writeJSON(w, call)
+}
+
+func (ws *WalletService) HandleRegisterABI(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", 405)
+        return
+    }
+    if !requireAdmin(w, r) {
+        return
+    }
+    var body struct {
+        Address string          `json:"address"`
+        Name    string          `json:"name"`
+        ABI     json.RawMessage `json:"abi"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !common.IsHexAddress(body.Address) {
+        http.Error(w, "Invalid request", 400)
+        return
+    }
+    if _, err := abi.JSON(strings.NewReader(string(body.ABI))); err != nil {
+        http.Error(w, "Invalid ABI: "+err.Error(), 400)
+        return
+    }
+    _, err := db.ExecContext(r.Context(), `INSERT INTO abi_registry (address, name, abi) VALUES ($1, $2, $3)
+        ON CONFLICT (address) DO UPDATE SET name = $2, abi = $3`, strings.ToLower(body.Address), body.Name, string(body.ABI))
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    w.Write([]byte("ABI registered"))
+}
+
+func (ws *WalletService) HandleRegisterSignature(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", 405)
+        return
+    }
+    if !requireAdmin(w, r) {
+        return
+    }
+    var body struct {
+        Signature string `json:"signature"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        http.Error(w, "Invalid request", 400)
+        return
+    }
+    if _, _, err := signatureArguments(body.Signature); err != nil {
+        http.Error(w, err.Error(), 400)
+        return
+    }
+    selector := selectorOf(body.Signature)
+    _, err := db.ExecContext(r.Context(), "INSERT INTO method_signatures (selector, signature) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+        selector, body.Signature)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJSON(w, map[string]string{"selector": selector})
+}
+
+func (ws *WalletService) HandleTokens(w http.ResponseWriter, r *http.Request) {
+    if r.Method == http.MethodPost {
+        if !requireAdmin(w, r) {
+            return
+        }
+        var t Token
+        if err := json.NewDecoder(r.Body).Decode(&t); err != nil || !common.IsHexAddress(t.Address) || t.Decimals < 0 {
+            http.Error(w, "Invalid request", 400)
+            return
+        }
+        _, err := db.ExecContext(r.Context(), `INSERT INTO tokens (address, symbol, decimals) VALUES ($1, $2, $3)
+            ON CONFLICT (address) DO UPDATE SET symbol = $2, decimals = $3`, strings.ToLower(t.Address), t.Symbol, t.Decimals)
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        w.Write([]byte("Token saved"))
+        return
+    }
+    
+    rows, err := db.QueryContext(r.Context(), "SELECT address, symbol, decimals FROM tokens ORDER BY symbol")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer rows.Close()
+    tokens := []Token{}
+    for rows.Next() {
+        var t Token
+        if err := rows.Scan(&t.Address, &t.Symbol, &t.Decimals); err != nil {
+            writeError(w, err)
+            return
+        }
+        tokens = append(tokens, t)
+    }
+    writeJSON(w, tokens)
+}
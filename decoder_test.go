@@ -0,0 +1,80 @@
+package main
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+)
+
+const decodeToken = "0x3333333333333333333333333333333333333333"
+
+func TestCallDecoder(t *testing.T) {
+    transfer := selectorOf("transfer(address,uint256)")
+    d := &callDecoder{
+        tokens:     map[string]*Token{decodeToken: {Address: decodeToken, Symbol: "TKN", Decimals: 6}},
+        names:      map[string]string{},
+        abis:       map[string]string{"0x4444444444444444444444444444444444444444": "not json"},
+        signatures: map[string][]string{transfer: {"transfer(address to,uint256 amount)"}},
+    }
+    args := strings.Repeat("0", 24) + strings.Repeat("1", 40) + strings.Repeat("0", 56) + "000f4240"
+    tests := []struct {
+        name    string
+        to      string
+        data    string
+        method  string
+        display string
+        err     bool
+    }{
+        {"token transfer", decodeToken, transfer + args, "transfer", "1 TKN", false},
+        {"unknown selector", decodeToken, "0xdeadbeef" + args, "", "", false},
+        {"short arguments", decodeToken, transfer + args[:10], "", "", false},
+        {"broken abi", "0x4444444444444444444444444444444444444444", transfer + args, "", "", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            call, err := d.decode(tt.to, tt.data)
+            if (err != nil) != tt.err {
+                t.Fatalf("got error %v, want error %v", err, tt.err)
+            }
+            method, display := "", ""
+            if call != nil {
+                method, display = call.Method, call.Args[1].Display
+            }
+            if method != tt.method || display != tt.display {
+                t.Fatalf("decoded %q %q, want %q %q", method, display, tt.method, tt.display)
+            }
+        })
+    }
+}
+
+func TestListTransfersReportsDecodeErrors(t *testing.T) {
+    testDB(t)
+    testNode(t)
+    broken := "0x4444444444444444444444444444444444444444"
+    mustExec(t, `INSERT INTO abi_registry (address, abi) VALUES ($1, '[{"type":"function","name":"f","inputs":[{"name":"x","type":"uint256"}]}]')`, broken)
+    selector := selectorOf("f(uint256)")
+    mustExec(t, `INSERT INTO transfers (from_address, to_address, amount, status, data) VALUES
+        ('0xa', $1, 0, 'pending', $2), ('0xa', $3, 0, 'pending', $4)`,
+        broken, selector+"01", decodeToken, selectorOf("approve(address,uint256)")+strings.Repeat("0", 128))
+    
+    w := serve(new(WalletService).HandleListTransfers, nil, "GET", "/transfers", "")
+    if w.Code != 200 {
+        t.Fatalf("status %d, want the listing despite the bad calldata (%s)", w.Code, w.Body)
+    }
+    var transfers []Transfer
+    if err := json.Unmarshal(w.Body.Bytes(), &transfers); err != nil {
+        t.Fatal(err)
+    }
+    for _, tr := range transfers {
+        switch tr.To {
+        case broken:
+            if tr.DecodeError == "" || tr.Decoded != nil {
+                t.Errorf("truncated calldata: got %+v, want a decode error", tr)
+            }
+        case decodeToken:
+            if tr.Decoded == nil || tr.Decoded.Method != "approve" {
+                t.Errorf("approve: got %+v, want it decoded", tr)
+            }
+        }
+    }
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+    "context"
+    "log"
+    "math/big"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/ethereum/go-ethereum"
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/core/types"
+)
+
+// The deposit scanner follows the chain and records every incoming native or
+// ERC-20 transfer to a managed wallet. A deposit is flagged as likely address
+// poisoning when it is dust and its sender is a lookalike of an address the
+// wallet has sent to, since that sender is exactly what ends up being copied
+// from the wallet's history.
+//
+// Scanning stays the chain's confirmations behind the head, starts there when
+// first run and covers at most depositScanBatch blocks per pass. The hash of
+// the last scanned block is kept; when the chain no longer has it, a reorg
+// went deeper than the confirmations, so the deposits of the last
+// confirmations blocks are dropped and scanned again.
+
+const depositScanBatch = 100
+
+// depositTopicChunk is how many wallets one log query asks about, keeping
+// the topic filter within what nodes accept.
+const depositTopicChunk = 500
+
+// dustWei is the default native amount below which a deposit counts as dust.
+var dustWei = envBig("DUST_THRESHOLD_WEI", big.NewInt(1e12))
+
+func envBig(name string, def *big.Int) *big.Int {
+    v := os.Getenv(name)
+    if v == "" {
+        return def
+    }
+    n, ok := new(big.Int).SetString(v, 10)
+    if !ok || n.Sign() < 0 {
+        log.Println("Ignoring invalid", name, v)
+        return def
+    }
+    return n
+}
+
+type Deposit struct {
+    ID        int64     `json:"id"`
+    TxHash    string    `json:"tx_hash"`
+    Wallet    string    `json:"wallet"`
+    Sender    string    `json:"sender"`
+    Asset     string    `json:"asset"`
+    Amount    string    `json:"amount"`
+    Block     int64     `json:"block"`
+    Dust      bool      `json:"dust"`
+    Resembles string    `json:"resembles,omitempty"`
+    Flagged   bool      `json:"flagged"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+func managedAddresses(ctx context.Context) (map[common.Address]bool, error) {
+    managed := map[common.Address]bool{}
+    for _, account := range keyStore.Accounts() {
+        managed[account.Address] = true
+    }
+    rows, err := db.QueryContext(ctx, "SELECT address FROM wallets")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var address string
+        if err := rows.Scan(&address); err != nil {
+            return nil, err
+        }
+        if common.IsHexAddress(address) {
+            managed[common.HexToAddress(address)] = true
+        }
+    }
+    return managed, rows.Err()
+}
+
+func recordDeposit(ctx context.Context, d Deposit, logIndex int, amount *big.Int) error {
+    dust, err := isDust(ctx, d.Asset, amount)
+    if err != nil {
+        return err
+    }
+    resembles := ""
+    if dust {
+        if resembles, err = findLookalike(ctx, d.Wallet, d.Sender, time.Now()); err != nil {
+            return err
+        }
+    }
+    flagged := dust && resembles != ""
+    if flagged {
+        log.Println("Possible address poisoning: dust deposit to", d.Wallet, "from", d.Sender, "resembling", resembles)
+    }
+    _, err = db.ExecContext(ctx, `INSERT INTO deposits (tx_hash, log_index, wallet, sender, asset, amount, block_number, dust, resembles, flagged)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10) ON CONFLICT (tx_hash, log_index) DO NOTHING`,
+        d.TxHash, logIndex, d.Wallet, d.Sender, d.Asset, amount.String(), d.Block, dust, resembles, flagged)
+    return err
+}
+
+func scanDeposits(ctx context.Context) error {
+    chain, err := lookupChain(ctx, "", chainID.Int64())
+    if err != nil {
+        return err
+    }
+    head, err := ethClient.BlockNumber(ctx)
+    if err != nil {
+        return err
+    }
+    confirmations := uint64(chain.Confirmations)
+    if head < confirmations {
+        return nil
+    }
+    head -= confirmations
+    var last int64
+    var hash string
+    err = db.QueryRowContext(ctx, `INSERT INTO scanner_state (name, block) VALUES ('deposits', $1)
+        ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name RETURNING block, COALESCE(hash, '')`, int64(head)).Scan(&last, &hash)
+    if err != nil {
+        return err
+    }
+    if hash != "" {
+        header, err := ethClient.HeaderByNumber(ctx, big.NewInt(last))
+        if err != nil {
+            return err
+        }
+        if header.Hash().Hex() != hash {
+            return rewindDeposits(ctx, last-int64(confirmations))
+        }
+    }
+    if uint64(last) >= head {
+        return nil
+    }
+    from, to := uint64(last)+1, head
+    if to-from >= depositScanBatch {
+        to = from + depositScanBatch - 1
+    }
+    
+    managed, err := managedAddresses(ctx)
+    if err != nil || len(managed) == 0 {
+        return err
+    }
+    signer := types.LatestSignerForChainID(chainID)
+    for n := from; n <= to; n++ {
+        block, err := ethClient.BlockByNumber(ctx, new(big.Int).SetUint64(n))
+        if err != nil {
+            return err
+        }
+        hash = block.Hash().Hex()
+        for _, tx := range block.Transactions() {
+            if tx.To() == nil || !managed[*tx.To()] || tx.Value().Sign() == 0 {
+                continue
+            }
+            sender, err := types.Sender(signer, tx)
+            if err != nil {
+                continue
+            }
+            d := Deposit{TxHash: tx.Hash().Hex(), Wallet: tx.To().Hex(), Sender: sender.Hex(), Asset: "ETH", Block: int64(n)}
+            if err := recordDeposit(ctx, d, -1, tx.Value()); err != nil {
+                return err
+            }
+        }
+    }
+    
+    var recipients []common.Hash
+    for address := range managed {
+        recipients = append(recipients, common.BytesToHash(address.Bytes()))
+    }
+    var logs []types.Log
+    for len(recipients) > 0 {
+        chunk := recipients
+        if len(chunk) > depositTopicChunk {
+            chunk = chunk[:depositTopicChunk]
+        }
+        recipients = recipients[len(chunk):]
+        found, err := ethClient.FilterLogs(ctx, ethereum.FilterQuery{
+            FromBlock: new(big.Int).SetUint64(from),
+            ToBlock:   new(big.Int).SetUint64(to),
+            Topics:    [][]common.Hash{{transferEventTopic}, nil, chunk},
+        })
+        if err != nil {
+            return err
+        }
+        logs = append(logs, found...)
+    }
+    for _, l := range logs {
+        if len(l.Topics) != 3 || l.Removed {
+            continue
+        }
+        d := Deposit{
+            TxHash: l.TxHash.Hex(),
+            Wallet: common.BytesToAddress(l.Topics[2].Bytes()).Hex(),
+            Sender: common.BytesToAddress(l.Topics[1].Bytes()).Hex(),
+            Asset:  strings.ToLower(l.Address.Hex()),
+            Block:  int64(l.BlockNumber),
+        }
+        if err := recordDeposit(ctx, d, int(l.Index), new(big.Int).SetBytes(l.Data)); err != nil {
+            return err
+        }
+    }
+    
+    _, err = db.ExecContext(ctx, "UPDATE scanner_state SET block = $1, hash = $2 WHERE name = 'deposits'", int64(to), hash)
+    return err
+}
+
+// rewindDeposits forgets the deposits after block so they are scanned again.
+func rewindDeposits(ctx context.Context, block int64) error {
+    if block < 0 {
+        block = 0
+    }
+    log.Println("Chain reorganised below the deposit scanner, rescanning from block", block+1)
+    dbTx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer dbTx.Rollback()
+    if _, err := dbTx.ExecContext(ctx, "DELETE FROM deposits WHERE block_number > $1", block); err != nil {
+        return err
+    }
+    if _, err := dbTx.ExecContext(ctx, "UPDATE scanner_state SET block = $1, hash = NULL WHERE name = 'deposits'", block); err != nil {
+        return err
+    }
+    return dbTx.Commit()
+}
+
+func runDepositScanner() {
+    for {
+        if chainBreaker.retryAfter() == 0 {
+            if err := scanDeposits(context.Background()); err != nil {
+                log.Println("Deposit scan failed:", err)
+            }
+        }
+        time.Sleep(15 * time.Second)
+    }
+}
+
+// HandleDeposits lists recorded deposits to the caller's wallets, newest
+// first, optionally for one ?wallet= or only the ?flagged=true ones.
+func (ws *WalletService) HandleDeposits(w http.ResponseWriter, r *http.Request) {
+    limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+    if err != nil || limit < 1 || limit > 500 {
+        limit = 500
+    }
+    conds := []string{"($2 = '' OR lower(d.wallet) = lower($2))"}
+    args := []interface{}{limit, r.URL.Query().Get("wallet")}
+    if r.URL.Query().Get("flagged") == "true" {
+        conds = append(conds, "d.flagged")
+    }
+    conds, args = tenantFilter(r.Context(), "w.client_id", conds, args)
+    query := `SELECT d.id, d.tx_hash, d.wallet, d.sender, d.asset, d.amount::text, d.block_number, d.dust, COALESCE(d.resembles, ''),
+        d.flagged, d.created_at FROM deposits d LEFT JOIN wallets w ON lower(w.address) = lower(d.wallet)` + whereClause(conds)
+    rows, err := db.QueryContext(r.Context(), query+" ORDER BY d.id DESC LIMIT $1", args...)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer rows.Close()
+    deposits := []Deposit{}
+    for rows.Next() {
+        var d Deposit
+        if err := rows.Scan(&d.ID, &d.TxHash, &d.Wallet, &d.Sender, &d.Asset, &d.Amount, &d.Block, &d.Dust, &d.Resembles, &d.Flagged, &d.CreatedAt); err != nil {
+            writeError(w, err)
+            return
+        }
+        deposits = append(deposits, d)
+    }
+    writeJSON(w, deposits)
+}
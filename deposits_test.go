@@ -0,0 +1,197 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "math/big"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/common/hexutil"
+    "github.com/ethereum/go-ethereum/core/types"
+    "github.com/ethereum/go-ethereum/crypto"
+)
+
+// testChain serves blocks from a fake node. Blocks are empty except for the
+// transactions in txs; changing fork changes every block's hash, as a reorg
+// would.
+type testChain struct {
+    head    uint64
+    fork    byte
+    txs     map[uint64][]*types.Transaction
+    fetched []uint64
+}
+
+func (c *testChain) header(n uint64) *types.Header {
+    h := &types.Header{Number: new(big.Int).SetUint64(n), Difficulty: new(big.Int), Extra: []byte{c.fork},
+        UncleHash: types.EmptyUncleHash, TxHash: types.EmptyTxsHash}
+    if len(c.txs[n]) > 0 {
+        h.TxHash = common.Hash{1}
+    }
+    return h
+}
+
+func (c *testChain) serve(t *testing.T, node *fakeNode) {
+    node.handle("eth_blockNumber", func([]json.RawMessage) (interface{}, error) {
+        return hexutil.Uint64(c.head), nil
+    })
+    node.handle("eth_getBlockByNumber", func(params []json.RawMessage) (interface{}, error) {
+        var number hexutil.Big
+        var full bool
+        if err := json.Unmarshal(params[0], &number); err != nil {
+            return nil, err
+        }
+        json.Unmarshal(params[1], &full)
+        n := number.ToInt().Uint64()
+        header := c.header(n)
+        if !full {
+            return header, nil
+        }
+        c.fetched = append(c.fetched, n)
+        raw, err := json.Marshal(header)
+        if err != nil {
+            return nil, err
+        }
+        block := map[string]interface{}{}
+        json.Unmarshal(raw, &block)
+        block["uncles"] = []common.Hash{}
+        txs := c.txs[n]
+        if txs == nil {
+            txs = []*types.Transaction{}
+        }
+        block["transactions"] = txs
+        return block, nil
+    })
+    node.respond("eth_getLogs", []types.Log{})
+}
+
+func TestDepositScannerFollowsConfirmedBlocks(t *testing.T) {
+    testDB(t)
+    node := testNode(t)
+    t.Setenv("CONFIRMATIONS", "3")
+    key, err := crypto.GenerateKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    wallet := common.HexToAddress("0x2222222222222222222222222222222222222222")
+    mustExec(t, "INSERT INTO wallets (address, balance) VALUES ($1, 0)", wallet.Hex())
+    deposit, err := types.SignNewTx(key, types.LatestSignerForChainID(chainID), &types.DynamicFeeTx{ChainID: chainID, Gas: 21000,
+        GasFeeCap: big.NewInt(1), To: &wallet, Value: big.NewInt(1e18)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    chain := &testChain{head: 12, txs: map[uint64][]*types.Transaction{8: {deposit}}}
+    chain.serve(t, node)
+    mustExec(t, "INSERT INTO scanner_state (name, block) VALUES ('deposits', 5)")
+    ctx := context.Background()
+    deposits := func() int { return countRows(t, "SELECT COUNT(*) FROM deposits") }
+    
+    if err := scanDeposits(ctx); err != nil {
+        t.Fatal(err)
+    }
+    if n := countRows(t, "SELECT COUNT(*) FROM scanner_state WHERE block = 9"); n != 1 || deposits() != 1 {
+        t.Fatalf("scanned to block 9: %v, %d deposits; want blocks 6-9 and 1 deposit", chain.fetched, deposits())
+    }
+    for _, n := range chain.fetched {
+        if n > 9 {
+            t.Errorf("fetched block %d with fewer than 3 confirmations", n)
+        }
+    }
+    
+    // The deposit's block is replaced by an empty one, deeper than the
+    // confirmations.
+    chain.fork, chain.txs, chain.head = 1, nil, 13
+    if err := scanDeposits(ctx); err != nil {
+        t.Fatal(err)
+    }
+    if n := deposits(); n != 0 {
+        t.Errorf("%d deposits after the reorg, want the orphaned one dropped", n)
+    }
+    if n := countRows(t, "SELECT COUNT(*) FROM scanner_state WHERE block = 6"); n != 1 {
+        t.Error("scanner did not rewind to block 6")
+    }
+    if err := scanDeposits(ctx); err != nil {
+        t.Fatal(err)
+    }
+    if n := countRows(t, "SELECT COUNT(*) FROM scanner_state WHERE block = 10"); n != 1 || deposits() != 0 {
+        t.Errorf("rescan did not reach block 10 without deposits")
+    }
+}
+
+func TestDepositLogQueriesAreChunked(t *testing.T) {
+    testDB(t)
+    node := testNode(t)
+    t.Setenv("CONFIRMATIONS", "1")
+    mustExec(t, `INSERT INTO wallets (address, balance)
+        SELECT '0x' || lpad(to_hex(i), 40, '0'), 0 FROM generate_series(1, $1) i`, depositTopicChunk+1)
+    chain := &testChain{head: 2}
+    chain.serve(t, node)
+    mustExec(t, "INSERT INTO scanner_state (name, block) VALUES ('deposits', 0)")
+    if err := scanDeposits(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if n := node.count("eth_getLogs"); n != 2 {
+        t.Errorf("%d log queries for %d wallets, want 2", n, depositTopicChunk+1)
+    }
+}
+
+func TestDepositsAreTenantScoped(t *testing.T) {
+    testDB(t)
+    tenant := addClient(t, &APIClient{ID: "tenant"})
+    addClient(t, &APIClient{ID: "other"})
+    const mine, theirs = "0x1111111111111111111111111111111111111111", "0x2222222222222222222222222222222222222222"
+    mustExec(t, "INSERT INTO wallets (address, balance, client_id) VALUES ($1, 0, 'tenant'), ($2, 0, 'other')", mine, theirs)
+    mustExec(t, `INSERT INTO deposits (tx_hash, log_index, wallet, sender, asset, amount, block_number, dust, flagged)
+        VALUES ('0x01', -1, $1, '0x3', 'ETH', 1, 1, false, false), ('0x02', -1, $2, '0x3', 'ETH', 1, 1, false, false)`,
+        common.HexToAddress(mine).Hex(), common.HexToAddress(theirs).Hex())
+    
+    for _, tt := range []struct {
+        client *APIClient
+        query  string
+        want   int
+    }{
+        {tenant, "", 1},
+        {tenant, "?wallet=" + theirs, 0},
+        {&APIClient{ID: "admin", Admin: true}, "", 2},
+    } {
+        w := serve(new(WalletService).HandleDeposits, tt.client, "GET", "/deposits"+tt.query, "")
+        var deposits []Deposit
+        if err := json.Unmarshal(w.Body.Bytes(), &deposits); err != nil {
+            t.Fatalf("%s: %v: %s", tt.client.ID, err, w.Body)
+        }
+        if len(deposits) != tt.want {
+            t.Errorf("%s%s sees %d deposits, want %d", tt.client.ID, tt.query, len(deposits), tt.want)
+        }
+    }
+}
+
+func TestLookalikesOnlyResembleOwnWallets(t *testing.T) {
+    testDB(t)
+    const mine, theirs = "0x1111000000000000000000000000000000001111", "0x2222000000000000000000000000000000002222"
+    mustExec(t, "INSERT INTO api_clients (id, key_hash) VALUES ('a', 'a'), ('b', 'b')")
+    mustExec(t, "INSERT INTO wallets (address, balance, client_id) VALUES ($1, 0, 'a'), ($2, 0, 'b')", mine, theirs)
+    ctx := context.Background()
+    
+    // A lookalike of a's own wallet is caught; one of b's wallet says
+    // nothing about b to a.
+    if got, err := findLookalike(ctx, mine, "0x1111ffffffffffffffffffffffffffffffff1111", time.Now()); err != nil || got != mine {
+        t.Errorf("lookalike of own wallet: %q, %v", got, err)
+    }
+    if got, err := findLookalike(ctx, mine, "0x2222ffffffffffffffffffffffffffffffff2222", time.Now()); err != nil || got != "" {
+        t.Errorf("lookalike of another tenant's wallet: %q, %v", got, err)
+    }
+}
+
+func TestLookalikeMatchesStoredSpellings(t *testing.T) {
+    testDB(t)
+    from := common.HexToAddress("0xabcdef0000000000000000000000000000000001")
+    const known = "0x3333000000000000000000000000000000003333"
+    // The history is stored checksummed and looked up in lower case.
+    mustExec(t, "INSERT INTO transfers (from_address, to_address, amount, status) VALUES ($1, $2, 1, 'completed')", from.Hex(), known)
+    got, err := findLookalike(context.Background(), strings.ToLower(from.Hex()), "0x3333ffffffffffffffffffffffffffffffff3333", time.Now().Add(time.Minute))
+    if err != nil || got != known {
+        t.Errorf("got %q, %v, want %s", got, err, known)
+    }
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "log"
+    "math/big"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// Each asset has a dust threshold below which an amount is not worth moving
+// on its own. Thresholds are kept in base units per asset ("ETH" or a token
+// address); assets without one fall back to DUST_THRESHOLD_WEI for ETH and a
+// millionth of a unit for registered tokens.
+//
+// Sweeps leave dust wallets alone, and so wallets whose sweep would cost more
+// than CONSOLIDATION_MAX_FEE_PERCENT of what it moves at the current fees.
+// The consolidation job sweeps them instead, all at once and in the bulk
+// lane, whenever the base fee is at or below CONSOLIDATION_MAX_BASE_FEE_GWEI.
+// A wallet is only consolidated once its fee, priced from the current base
+// fee, is within that percentage.
+
+var (
+    consolidationMaxBaseFee    = envBig("CONSOLIDATION_MAX_BASE_FEE_GWEI", nil)
+    consolidationMaxFeePercent = float64(envInt("CONSOLIDATION_MAX_FEE_PERCENT", 20))
+)
+
+type DustThreshold struct {
+    Asset     string `json:"asset"`
+    Value     string `json:"value,omitempty"`
+    Unit      string `json:"unit,omitempty"`
+    Threshold Amount `json:"threshold"`
+}
+
+// worthSweeping reports whether moving balance ether is worth a fee of fee
+// ether.
+func worthSweeping(balance, fee float64) bool {
+    return balance > fee && fee <= (balance-fee)*consolidationMaxFeePercent/100
+}
+
+func assetKey(asset string) string {
+    if strings.EqualFold(asset, "ETH") {
+        return "ETH"
+    }
+    return strings.ToLower(asset)
+}
+
+func dustThreshold(ctx context.Context, asset string) (*big.Int, error) {
+    var threshold string
+    err := db.QueryRowContext(ctx, "SELECT threshold::text FROM dust_thresholds WHERE asset = $1", assetKey(asset)).Scan(&threshold)
+    if err == nil {
+        v, _ := new(big.Int).SetString(threshold, 10)
+        return v, nil
+    }
+    if err != sql.ErrNoRows {
+        return nil, err
+    }
+    if asset == "ETH" {
+        return dustWei, nil
+    }
+    token, err := lookupToken(ctx, asset)
+    if err != nil || token == nil || token.Decimals < 6 {
+        return new(big.Int), err
+    }
+    return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(token.Decimals-6)), nil), nil
+}
+
+// isDust reports whether amount of asset is below its dust threshold. Zero
+// token transfers always count as dust.
+func isDust(ctx context.Context, asset string, amount *big.Int) (bool, error) {
+    if asset != "ETH" && amount.Sign() == 0 {
+        return true, nil
+    }
+    threshold, err := dustThreshold(ctx, asset)
+    if err != nil {
+        return false, err
+    }
+    return amount.Cmp(threshold) < 0, nil
+}
+
+func consolidateAll(ctx context.Context) error {
+    rows, err := db.QueryContext(ctx, "SELECT name FROM wallet_groups WHERE sweep_to IS NOT NULL ORDER BY name")
+    if err != nil {
+        return err
+    }
+    var names []string
+    for rows.Next() {
+        var name string
+        if err := rows.Scan(&name); err != nil {
+            rows.Close()
+            return err
+        }
+        names = append(names, name)
+    }
+    rows.Close()
+    
+    for _, name := range names {
+        results, err := sweepGroup(ctx, name, true)
+        if err != nil {
+            return err
+        }
+        if len(results) > 0 {
+            log.Println("Consolidated", len(results), "dust wallets in group", name)
+        }
+    }
+    return nil
+}
+
+func runConsolidation() {
+    if consolidationMaxBaseFee == nil {
+        return
+    }
+    maxBaseFee := new(big.Int).Mul(consolidationMaxBaseFee, big.NewInt(1e9))
+    for {
+        time.Sleep(10 * time.Minute)
+        if chainBreaker.retryAfter() > 0 {
+            continue
+        }
+        conn, err := openChain(context.Background(), "", 0)
+        var fees feeQuote
+        if err == nil {
+            fees, err = currentFees(context.Background(), conn)
+        }
+        if err != nil {
+            log.Println("Consolidation skipped:", err)
+            continue
+        }
+        if fees.baseFee.Cmp(maxBaseFee) > 0 {
+            continue
+        }
+        if err := consolidateAll(context.Background()); err != nil {
+            log.Println("Consolidation failed:", err)
+        }
+    }
+}
+
+// HandleConsolidateGroup sweeps the group's dust wallets now, whatever the
+// base fee.
+func (ws *WalletService) HandleConsolidateGroup(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", 405)
+        return
+    }
+    if !requireAdmin(w, r) {
+        return
+    }
+    results, err := sweepGroup(r.Context(), r.URL.Query().Get("group"), true)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJSON(w, results)
+}
+
+// HandleDustThresholds lists thresholds, or sets one from a value in any unit
+// of the asset (native units for ETH, base or display for tokens).
+func (ws *WalletService) HandleDustThresholds(w http.ResponseWriter, r *http.Request) {
+    if r.Method == http.MethodPost {
+        if !requireAdmin(w, r) {
+            return
+        }
+        var t DustThreshold
+        if err := json.NewDecoder(r.Body).Decode(&t); err != nil || t.Asset == "" {
+            http.Error(w, "Invalid request", 400)
+            return
+        }
+        t.Asset = assetKey(t.Asset)
+        token := ""
+        if t.Asset != "ETH" {
+            token = t.Asset
+        }
+        decimals, err := unitDecimals(r.Context(), t.Unit, token)
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        threshold, err := parseUnits(t.Value, decimals)
+        if err != nil {
+            http.Error(w, "Invalid value", 400)
+            return
+        }
+        _, err = db.ExecContext(r.Context(), `INSERT INTO dust_thresholds (asset, threshold) VALUES ($1, $2)
+            ON CONFLICT (asset) DO UPDATE SET threshold = $2`, t.Asset, threshold.String())
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        w.Write([]byte("Threshold saved"))
+        return
+    }
+    
+    rows, err := db.QueryContext(r.Context(), "SELECT asset, threshold::text FROM dust_thresholds ORDER BY asset")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer rows.Close()
+    thresholds := []DustThreshold{}
+    for rows.Next() {
+        var t DustThreshold
+        var base string
+        if err := rows.Scan(&t.Asset, &base); err != nil {
+            writeError(w, err)
+            return
+        }
+        v, _ := new(big.Int).SetString(base, 10)
+        if t.Asset == "ETH" {
+            t.Threshold = newAmount(v, unitWei, 0)
+        } else {
+            t.Threshold = newAmount(v, unitBase, 0)
+        }
+        thresholds = append(thresholds, t)
+    }
+    writeJSON(w, thresholds)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+    "context"
+    "math/big"
+    "testing"
+)
+
+// With the default thresholds a wallet is left to consolidation when its
+// sweep costs too much of what it moves, and consolidated once the base fee
+// has dropped enough.
+func TestSweepAndConsolidateWithDefaultThresholds(t *testing.T) {
+    testDB(t)
+    node := testNode(t)
+    const whale, small, dust, sink = "0x1111111111111111111111111111111111111111", "0x2222222222222222222222222222222222222222",
+        "0x3333333333333333333333333333333333333333", "0x4444444444444444444444444444444444444444"
+    queue = &transferQueue{running: map[string]bool{whale: true, small: true, dust: true}, again: map[string]bool{}}
+    node.respond("eth_getBalance", hexBig(new(big.Int).Mul(big.NewInt(10), big.NewInt(1e18))))
+    mustExec(t, "INSERT INTO wallet_groups (name, sweep_to) VALUES ('g', $1)", sink)
+    mustExec(t, `INSERT INTO wallets (address, balance, group_name) VALUES ($1, 1, 'g'), ($2, 0.001, 'g'), ($3, 0.0000005, 'g'), ($4, 0, 'g')`,
+        whale, small, dust, sink)
+    ctx := context.Background()
+    statuses := func(results []SweepResult) map[string]string {
+        m := map[string]string{}
+        for _, r := range results {
+            m[r.From] = r.Status
+        }
+        return m
+    }
+    
+    // At 10 gwei a sweep may cost 0.000441 ether: too much for 0.001.
+    testFees(t, node, big.NewInt(10e9), big.NewInt(1e9))
+    results, err := sweepGroup(ctx, "g", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    got := statuses(results)
+    if got[whale] != "pending" || got[small] != "dust" || got[dust] != "dust" {
+        t.Fatalf("sweep at 10 gwei: %v", got)
+    }
+    if results, err = sweepGroup(ctx, "g", true); err != nil || len(results) != 0 {
+        t.Fatalf("consolidation at 10 gwei: %v, %v; want nothing worth it", results, err)
+    }
+    
+    // At 1 gwei it costs 0.000063 ether, which 0.001 is worth but 0.0000005
+    // never is.
+    testFees(t, node, big.NewInt(1e9), big.NewInt(1e9))
+    if results, err = sweepGroup(ctx, "g", true); err != nil {
+        t.Fatal(err)
+    }
+    got = statuses(results)
+    if len(got) != 1 || got[small] != "pending" {
+        t.Fatalf("consolidation at 1 gwei: %v, want only %s", got, small)
+    }
+    if n := countRows(t, "SELECT COUNT(*) FROM transfers WHERE from_address = $1 AND priority = 'bulk'", small); n != 1 {
+        t.Errorf("%d bulk transfers from %s, want 1", n, small)
+    }
+}
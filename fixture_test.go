@@ -0,0 +1,251 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/ethereum/go-ethereum/accounts/keystore"
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/common/hexutil"
+    "github.com/ethereum/go-ethereum/core/types"
+    "github.com/ethereum/go-ethereum/ethclient"
+    "github.com/ethereum/go-ethereum/rpc"
+)
+
+// testDB points db at a fresh, migrated schema in the Postgres database named
+// by TEST_DATABASE_URL. Tests that need the database are skipped without it.
+func testDB(t *testing.T) {
+    t.Helper()
+    dsn := os.Getenv("TEST_DATABASE_URL")
+    if dsn == "" {
+        t.Skip("TEST_DATABASE_URL not set")
+    }
+    admin, err := sql.Open("postgres", dsn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    name := fmt.Sprintf("test_%d", time.Now().UnixNano())
+    if _, err := admin.Exec("CREATE SCHEMA " + name); err != nil {
+        t.Fatal(err)
+    }
+    
+    u, err := url.Parse(dsn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    q := u.Query()
+    q.Set("search_path", name)
+    u.RawQuery = q.Encode()
+    db, err = sql.Open("postgres", u.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        db.Close()
+        admin.Exec("DROP SCHEMA " + name + " CASCADE")
+        admin.Close()
+    })
+    if err := migrate(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func mustExec(t *testing.T, query string, args ...interface{}) {
+    t.Helper()
+    if _, err := db.Exec(query, args...); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func countRows(t *testing.T, query string, args ...interface{}) int {
+    t.Helper()
+    var n int
+    if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+        t.Fatal(err)
+    }
+    return n
+}
+
+// fakeNode is a JSON-RPC endpoint answering the methods registered on it.
+// Unregistered methods fail, so a test notices calls it did not expect.
+type fakeNode struct {
+    mu       sync.Mutex
+    handlers map[string]func(params []json.RawMessage) (interface{}, error)
+    calls    map[string]int
+}
+
+func (n *fakeNode) handle(method string, fn func(params []json.RawMessage) (interface{}, error)) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    n.handlers[method] = fn
+}
+
+func (n *fakeNode) respond(method string, result interface{}) {
+    n.handle(method, func([]json.RawMessage) (interface{}, error) {
+        return result, nil
+    })
+}
+
+func (n *fakeNode) count(method string) int {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    return n.calls[method]
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        ID     json.RawMessage   `json:"id"`
+        Method string            `json:"method"`
+        Params []json.RawMessage `json:"params"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    n.mu.Lock()
+    n.calls[req.Method]++
+    fn := n.handlers[req.Method]
+    n.mu.Unlock()
+    
+    resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+    if fn == nil {
+        resp["error"] = map[string]interface{}{"code": -32601, "message": "method not found: " + req.Method}
+    } else if result, err := fn(req.Params); err == errNodeDown {
+        http.Error(w, err.Error(), http.StatusBadGateway)
+        return
+    } else if err != nil {
+        resp["error"] = map[string]interface{}{"code": -32000, "message": err.Error()}
+    } else {
+        resp["result"] = result
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(resp)
+}
+
+// errNodeDown makes a fakeNode handler fail at the transport instead of
+// answering with a JSON-RPC error, as an unreachable node would.
+var errNodeDown = errors.New("node down")
+
+// testNode points ethClient at a fake node on chain 1337.
+func testNode(t *testing.T) *fakeNode {
+    t.Helper()
+    node, url := startNode(t, 1337)
+    client, err := rpc.DialHTTP(url)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ethClient = ethclient.NewClient(client)
+    chainID = big.NewInt(1337)
+    t.Cleanup(client.Close)
+    return node
+}
+
+// startNode serves a fake node on chain id and returns it with its URL.
+func startNode(t *testing.T, id int64) (*fakeNode, string) {
+    t.Helper()
+    node := &fakeNode{
+        handlers: map[string]func([]json.RawMessage) (interface{}, error){},
+        calls:    map[string]int{},
+    }
+    node.respond("eth_chainId", hexutil.EncodeUint64(uint64(id)))
+    srv := httptest.NewServer(node)
+    t.Cleanup(srv.Close)
+    return node, srv.URL
+}
+
+// connectedChain opens the connected chain as client defines it.
+func connectedChain(t *testing.T, client string) *chainConn {
+    t.Helper()
+    conn, err := openChain(context.Background(), client, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return conn
+}
+
+// testFees makes the head monitor report baseFee and the node suggest tip,
+// so lanes price transactions from them.
+func testFees(t *testing.T, node *fakeNode, baseFee, tip *big.Int) feeQuote {
+    t.Helper()
+    heads.mu.Lock()
+    heads.baseFee = baseFee
+    heads.mu.Unlock()
+    t.Cleanup(func() {
+        heads.mu.Lock()
+        heads.baseFee = nil
+        heads.mu.Unlock()
+    })
+    node.respond("eth_maxPriorityFeePerGas", hexBig(tip))
+    return feeQuote{baseFee: baseFee, tip: tip}
+}
+
+// testKeyStore replaces keyStore with an empty, cheap one in a temp dir.
+func testKeyStore(t *testing.T) {
+    t.Helper()
+    keyStore = keystore.NewKeyStore(t.TempDir(), keystore.LightScryptN, keystore.LightScryptP)
+}
+
+// testMined makes the node return the given receipts by transaction hash,
+// and for any block a header with baseFee, mined now.
+// Other transactions are not found.
+func testMined(node *fakeNode, baseFee *big.Int, receipts ...*types.Receipt) {
+    byHash := map[common.Hash]*types.Receipt{}
+    for _, r := range receipts {
+        if r.Logs == nil {
+            r.Logs = []*types.Log{}
+        }
+        byHash[r.TxHash] = r
+    }
+    node.handle("eth_getTransactionReceipt", func(params []json.RawMessage) (interface{}, error) {
+        var hash common.Hash
+        if err := json.Unmarshal(params[0], &hash); err != nil {
+            return nil, err
+        }
+        if r, ok := byHash[hash]; ok {
+            return r, nil
+        }
+        return nil, nil
+    })
+    node.handle("eth_getBlockByNumber", func(params []json.RawMessage) (interface{}, error) {
+        var number hexutil.Big
+        if err := json.Unmarshal(params[0], &number); err != nil {
+            return nil, err
+        }
+        return &types.Header{Number: number.ToInt(), Difficulty: new(big.Int), BaseFee: baseFee, Time: uint64(time.Now().Unix())}, nil
+    })
+}
+
+func hexBig(v *big.Int) string {
+    return fmt.Sprintf("0x%x", v)
+}
+
+// addClient registers an API client for handlers that join on api_clients.
+func addClient(t *testing.T, c *APIClient) *APIClient {
+    t.Helper()
+    mustExec(t, "INSERT INTO api_clients (id, key_hash, admin, approver_for) VALUES ($1, $1, $2, NULLIF($3, ''))",
+        c.ID, c.Admin, c.ApproverFor)
+    return c
+}
+
+// serve calls handler as client and returns the recorded response.
+func serve(handler http.HandlerFunc, client *APIClient, method, target string, body string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(method, target, strings.NewReader(body))
+    if client != nil {
+        r = r.WithContext(context.WithValue(r.Context(), clientContextKey, client))
+    }
+    w := httptest.NewRecorder()
+    handler(w, r)
+    return w
+}
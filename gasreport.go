@@ -0,0 +1,412 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "log"
+    "math"
+    "math/big"
+    "net/http"
+    "os"
+    "sort"
+    "strconv"
+    "time"
+
+    "github.com/ethereum/go-ethereum"
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/core/types"
+)
+
+// The gas report looks at the receipts of transactions this service signed.
+// A background collector fetches each receipt once and keeps it in
+// gas_receipts together with the chain, what was offered (fee cap and tip),
+// what was paid (effective gas price) and how long the transaction waited
+// between its broadcast and inclusion. Transactions still without a receipt
+// after gasReceiptMaxAge were replaced or dropped and are not looked up again.
+// Storing a receipt is also when the gas it paid for, gas used times the
+// effective price, is billed to the client that submitted the transfer.
+//
+// Overpayment is the fee cap over the effective price: it is not spent, but
+// preflight checks reserve it, so a cap far above what is ever paid ties up
+// balance for nothing. Suggestions are given per chain as the lane's tip and
+// fee cap percentages.
+
+// laneWaitTarget is how long a transaction in each lane should take to be
+// included before the report suggests a higher tip.
+var laneWaitTarget = map[string]float64{
+    priorityUrgent: 30,
+    priorityNormal: 120,
+    priorityBulk:   900,
+}
+
+var gasReceiptMaxAge = time.Duration(envInt("GAS_RECEIPT_MAX_AGE", 86400)) * time.Second
+
+// gasReceiptBatch is how many transactions the collector reads at a time.
+const gasReceiptBatch = 100
+
+type Distribution struct {
+    P50 float64 `json:"p50"`
+    P90 float64 `json:"p90"`
+    P99 float64 `json:"p99"`
+    Max float64 `json:"max"`
+}
+
+type GasLaneReport struct {
+    Lane                   string         `json:"lane"`
+    Transactions           int            `json:"transactions"`
+    GasUsed                uint64         `json:"gas_used"`
+    FeesPaid               Amount         `json:"fees_paid"`
+    OverpaymentPercent     float64        `json:"overpayment_percent"`
+    EffectivePriceGwei     Distribution   `json:"effective_price_gwei"`
+    TipPaidGwei            Distribution   `json:"tip_paid_gwei"`
+    WaitSeconds            Distribution   `json:"wait_seconds"`
+    WaitBuckets            map[string]int `json:"wait_buckets"`
+    TipPercent             int64          `json:"tip_percent"`
+    FeeCapPercent          int64          `json:"fee_cap_percent"`
+    SuggestedTipPercent    int64          `json:"suggested_tip_percent"`
+    SuggestedFeeCapPercent int64          `json:"suggested_fee_cap_percent"`
+    Recommendations        []string       `json:"recommendations"`
+}
+
+type GasChainReport struct {
+    ChainID string          `json:"chain_id"`
+    Lanes   []GasLaneReport `json:"lanes"`
+}
+
+type GasReport struct {
+    Since    time.Time        `json:"since"`
+    Awaiting int              `json:"awaiting_receipt"`
+    Chains   []GasChainReport `json:"chains"`
+}
+
+type gasSample struct {
+    chain     int64
+    lane      string
+    feeCap    float64
+    effective float64
+    baseFee   float64
+    gasUsed   uint64
+    wait      float64
+}
+
+// collectReceipts stores the receipt of every transaction broadcast within
+// gasReceiptMaxAge that has been mined but has no stored receipt yet, and
+// returns how many it stored.
+func collectReceipts(ctx context.Context) (int, error) {
+    stored := 0
+    var after time.Time
+    var afterHash string
+    for {
+        n, last, lastHash, err := collectReceiptBatch(ctx, after, afterHash)
+        stored += n
+        if err != nil || last.IsZero() {
+            return stored, err
+        }
+        after, afterHash = last, lastHash
+    }
+}
+
+// collectReceiptBatch handles the next gasReceiptBatch transactions after
+// the given one, returning how many receipts it stored and the last
+// transaction it looked at, which is zero when there were none left.
+func collectReceiptBatch(ctx context.Context, after time.Time, afterHash string) (int, time.Time, string, error) {
+    rows, err := db.QueryContext(ctx, `SELECT n.address, n.tx_hash, n.raw_tx, n.sent_at, COALESCE(t.priority, $2), COALESCE(t.client_id, ''), n.chain_id
+        FROM nonces n LEFT JOIN transfers t ON t.id = n.transfer_id
+        WHERE n.raw_tx IS NOT NULL AND n.sent_at >= now() - $1::int * interval '1 second' AND (n.sent_at, n.tx_hash) > ($4, $5)
+        AND NOT EXISTS (SELECT 1 FROM gas_receipts g WHERE g.tx_hash = n.tx_hash)
+        ORDER BY n.sent_at, n.tx_hash LIMIT $3`, int(gasReceiptMaxAge/time.Second), priorityUrgent, gasReceiptBatch, after, afterHash)
+    if err != nil {
+        return 0, time.Time{}, "", err
+    }
+    type signed struct {
+        address, hash, raw, lane, client string
+        chain                            int64
+        sentAt                           time.Time
+    }
+    var todo []signed
+    for rows.Next() {
+        var s signed
+        if err := rows.Scan(&s.address, &s.hash, &s.raw, &s.sentAt, &s.lane, &s.client, &s.chain); err != nil {
+            rows.Close()
+            return 0, time.Time{}, "", err
+        }
+        todo = append(todo, s)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil || len(todo) == 0 {
+        return 0, time.Time{}, "", err
+    }
+    last := todo[len(todo)-1]
+    
+    stored := 0
+    conns := map[string]*chainConn{}
+    headers := map[string]*types.Header{}
+    for _, s := range todo {
+        key := s.client + ":" + strconv.FormatInt(s.chain, 10)
+        conn, ok := conns[key]
+        if !ok {
+            if conn, err = openChain(ctx, s.client, s.chain); err != nil {
+                log.Println("Chain", storedChainID(s.chain), "unavailable for receipts:", err)
+            }
+            conns[key] = conn
+        }
+        if conn == nil {
+            continue
+        }
+        receipt, err := conn.eth.TransactionReceipt(ctx, common.HexToHash(s.hash))
+        if err == ethereum.NotFound {
+            continue
+        }
+        if err != nil {
+            return stored, last.sentAt, last.hash, err
+        }
+        tx := new(types.Transaction)
+        if err := tx.UnmarshalBinary(common.FromHex(s.raw)); err != nil {
+            return stored, last.sentAt, last.hash, err
+        }
+        block := strconv.FormatInt(s.chain, 10) + ":" + receipt.BlockNumber.String()
+        header, ok := headers[block]
+        if !ok {
+            header, err = conn.eth.HeaderByNumber(ctx, receipt.BlockNumber)
+            if err != nil {
+                return stored, last.sentAt, last.hash, err
+            }
+            headers[block] = header
+        }
+        baseFee := header.BaseFee
+        if baseFee == nil {
+            baseFee = new(big.Int)
+        }
+        price := effectiveGasPrice(receipt, tx, header.BaseFee)
+        res, err := db.ExecContext(ctx, `INSERT INTO gas_receipts (tx_hash, address, lane, block_number, fee_cap, tip_cap,
+            effective_price, base_fee, gas_limit, gas_used, sent_at, mined_at, chain_id)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) ON CONFLICT (tx_hash) DO NOTHING`,
+            s.hash, s.address, s.lane, receipt.BlockNumber.Int64(), tx.GasFeeCap().String(), tx.GasTipCap().String(),
+            price.String(), baseFee.String(), int64(tx.Gas()), int64(receipt.GasUsed),
+            s.sentAt, time.Unix(int64(header.Time), 0), tx.ChainId().Int64())
+        if err != nil {
+            return stored, last.sentAt, last.hash, err
+        }
+        if n, _ := res.RowsAffected(); n > 0 {
+            recordUsage(ctx, s.client, 0, 0, new(big.Int).Mul(price, new(big.Int).SetUint64(receipt.GasUsed)))
+        }
+        stored++
+    }
+    if len(todo) < gasReceiptBatch {
+        return stored, time.Time{}, "", nil
+    }
+    return stored, last.sentAt, last.hash, nil
+}
+
+func runReceiptCollector() {
+    for {
+        time.Sleep(time.Minute)
+        if _, err := collectReceipts(context.Background()); err != nil {
+            log.Println("Collecting gas receipts failed:", err)
+        }
+    }
+}
+
+func percentile(sorted []float64, q float64) float64 {
+    if len(sorted) == 0 {
+        return 0
+    }
+    return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func distribution(values []float64) Distribution {
+    sorted := append([]float64(nil), values...)
+    sort.Float64s(sorted)
+    if len(sorted) == 0 {
+        return Distribution{}
+    }
+    return Distribution{
+        P50: percentile(sorted, 0.5),
+        P90: percentile(sorted, 0.9),
+        P99: percentile(sorted, 0.99),
+        Max: sorted[len(sorted)-1],
+    }
+}
+
+func waitBucket(seconds float64) string {
+    switch {
+    case seconds < 15:
+        return "<15s"
+    case seconds < 60:
+        return "<1m"
+    case seconds < 300:
+        return "<5m"
+    case seconds < 1800:
+        return "<30m"
+    }
+    return ">=30m"
+}
+
+func gasReport(ctx context.Context, since time.Time, address string) (*GasReport, error) {
+    report := &GasReport{Since: since, Chains: []GasChainReport{}}
+    err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM nonces n
+        WHERE n.raw_tx IS NOT NULL AND n.sent_at >= $1 AND n.sent_at >= now() - $3::int * interval '1 second'
+        AND ($2 = '' OR n.address = lower($2)) AND NOT EXISTS (SELECT 1 FROM gas_receipts g WHERE g.tx_hash = n.tx_hash)`,
+        since, address, int(gasReceiptMaxAge/time.Second)).Scan(&report.Awaiting)
+    if err != nil {
+        return nil, err
+    }
+    rows, err := db.QueryContext(ctx, `SELECT COALESCE(chain_id, $3), lane, fee_cap::float8 / 1e9, effective_price::float8 / 1e9,
+        base_fee::float8 / 1e9, gas_used, GREATEST(EXTRACT(EPOCH FROM mined_at - sent_at), 0)::float8
+        FROM gas_receipts WHERE sent_at >= $1 AND ($2 = '' OR address = lower($2))`, since, address, chainID.Int64())
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    byChain := map[int64]map[string][]gasSample{}
+    for rows.Next() {
+        var s gasSample
+        if err := rows.Scan(&s.chain, &s.lane, &s.feeCap, &s.effective, &s.baseFee, &s.gasUsed, &s.wait); err != nil {
+            return nil, err
+        }
+        if byChain[s.chain] == nil {
+            byChain[s.chain] = map[string][]gasSample{}
+        }
+        byChain[s.chain][s.lane] = append(byChain[s.chain][s.lane], s)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    
+    chains := make([]int64, 0, len(byChain))
+    for id := range byChain {
+        chains = append(chains, id)
+    }
+    sort.Slice(chains, func(i, j int) bool { return chains[i] < chains[j] })
+    for _, id := range chains {
+        chain := GasChainReport{ChainID: strconv.FormatInt(id, 10), Lanes: []GasLaneReport{}}
+        for _, name := range []string{priorityUrgent, priorityNormal, priorityBulk} {
+            if samples := byChain[id][name]; len(samples) > 0 {
+                chain.Lanes = append(chain.Lanes, laneGasReport(lanes[name], samples))
+            }
+        }
+        report.Chains = append(report.Chains, chain)
+    }
+    return report, nil
+}
+
+func laneGasReport(l *lane, samples []gasSample) GasLaneReport {
+    r := GasLaneReport{
+        Lane:            l.name,
+        Transactions:    len(samples),
+        WaitBuckets:     map[string]int{},
+        TipPercent:      l.tipPercent,
+        FeeCapPercent:   l.feeCapPercent,
+        Recommendations: []string{},
+    }
+    var effective, tips, waits, capUse []float64
+    var paid, offered float64
+    fees := new(big.Float)
+    for _, s := range samples {
+        r.GasUsed += s.gasUsed
+        effective = append(effective, s.effective)
+        tips = append(tips, math.Max(s.effective-s.baseFee, 0))
+        waits = append(waits, s.wait)
+        r.WaitBuckets[waitBucket(s.wait)]++
+        if s.feeCap > 0 {
+            capUse = append(capUse, s.effective/s.feeCap)
+        }
+        paid += s.effective * float64(s.gasUsed)
+        offered += s.feeCap * float64(s.gasUsed)
+        fees.Add(fees, new(big.Float).Mul(big.NewFloat(s.effective*1e9), new(big.Float).SetUint64(s.gasUsed)))
+    }
+    feesWei, _ := fees.Int(nil)
+    r.FeesPaid = newAmount(feesWei, unitEther, 18)
+    if paid > 0 {
+        r.OverpaymentPercent = math.Round((offered-paid)/paid*1000) / 10
+    }
+    r.EffectivePriceGwei = distribution(effective)
+    r.TipPaidGwei = distribution(tips)
+    r.WaitSeconds = distribution(waits)
+    
+    r.SuggestedTipPercent = l.tipPercent
+    target := laneWaitTarget[l.name]
+    switch {
+    case r.WaitSeconds.P90 > target:
+        r.SuggestedTipPercent = l.tipPercent * 3 / 2
+        r.Recommendations = append(r.Recommendations, fmt.Sprintf(
+            "90%% of %s transactions were included within %.0fs, above the %.0fs target; raise the tip", l.name, r.WaitSeconds.P90, target))
+    case r.WaitSeconds.P90 < target/4 && l.tipPercent > 50:
+        r.SuggestedTipPercent = l.tipPercent * 3 / 4
+        r.Recommendations = append(r.Recommendations, fmt.Sprintf(
+            "%s transactions are included well within the %.0fs target; the tip can be lowered", l.name, target))
+    }
+    
+    // Size the cap to cover the largest share of it any transaction used, with
+    // 25% headroom.
+    r.SuggestedFeeCapPercent = l.feeCapPercent
+    sort.Float64s(capUse)
+    needed := l.feeCapPercent
+    if len(capUse) > 0 {
+        needed = int64(math.Ceil(float64(l.feeCapPercent) * capUse[len(capUse)-1] * 1.25))
+    }
+    switch {
+    case len(capUse) > 0 && capUse[len(capUse)-1] >= 0.99:
+        r.SuggestedFeeCapPercent = l.feeCapPercent * 3 / 2
+        r.Recommendations = append(r.Recommendations, fmt.Sprintf(
+            "some %s transactions paid their full fee cap and may have waited for the base fee to drop; raise the fee cap", l.name))
+    case percentile(capUse, 0.99) < 0.5 && needed < l.feeCapPercent:
+        r.SuggestedFeeCapPercent = needed
+        r.Recommendations = append(r.Recommendations, fmt.Sprintf(
+            "%s transactions paid under half their fee cap; lowering it frees %.1f%% of the reserved fees", l.name, r.OverpaymentPercent))
+    }
+    return r
+}
+
+func sinceParam(value string) (time.Time, error) {
+    if value == "" {
+        return time.Now().AddDate(0, 0, -30), nil
+    }
+    return time.Parse("2006-01-02", value)
+}
+
+// HandleGasReport serves the gas report for the last 30 days, or since the
+// date in ?since=, optionally for one ?address=.
+func (ws *WalletService) HandleGasReport(w http.ResponseWriter, r *http.Request) {
+    if !requireAdmin(w, r) {
+        return
+    }
+    since, err := sinceParam(r.URL.Query().Get("since"))
+    if err != nil {
+        http.Error(w, "Invalid since", 400)
+        return
+    }
+    report, err := gasReport(r.Context(), since, r.URL.Query().Get("address"))
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJSON(w, report)
+}
+
+func runGasReport(args []string) error {
+    fs := flag.NewFlagSet("gas", flag.ContinueOnError)
+    since := fs.String("since", "", "only include transactions signed on or after this date (YYYY-MM-DD, default 30 days ago)")
+    address := fs.String("address", "", "only include transactions from this address")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    from, err := sinceParam(*since)
+    if err != nil {
+        return fmt.Errorf("-since: %v", err)
+    }
+    // Without a running service nothing collects receipts, so pick up
+    // what has been mined since.
+    if _, err := collectReceipts(context.Background()); err != nil {
+        return err
+    }
+    report, err := gasReport(context.Background(), from, *address)
+    if err != nil {
+        return err
+    }
+    enc := json.NewEncoder(os.Stdout)
+    enc.SetIndent("", "  ")
+    return enc.Encode(report)
+}
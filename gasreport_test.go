@@ -0,0 +1,126 @@
+package main
+
+import (
+    "context"
+    "math/big"
+    "testing"
+    "time"
+
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/common/hexutil"
+    "github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestCollectReceipts(t *testing.T) {
+    testDB(t)
+    node := testNode(t)
+    from := common.HexToAddress("0x1111111111111111111111111111111111111111")
+    to := common.HexToAddress("0x2222222222222222222222222222222222222222")
+    signed := func(nonce uint64, sentAt interface{}) *types.Transaction {
+        tx := types.NewTx(&types.DynamicFeeTx{ChainID: big.NewInt(1337), Nonce: nonce, GasTipCap: big.NewInt(1e9),
+            GasFeeCap: big.NewInt(30e9), Gas: 21000, To: &to})
+        raw, err := tx.MarshalBinary()
+        if err != nil {
+            t.Fatal(err)
+        }
+        // Allocated an hour ago; sentAt is when the node accepted it.
+        mustExec(t, `INSERT INTO nonces (address, nonce, tx_hash, raw_tx, created_at, sent_at)
+            VALUES ($1, $2, $3, $4, now() - interval '1 hour', $5)`, nonceKey(from), nonce, tx.Hash().Hex(), hexutil.Encode(raw), sentAt)
+        return tx
+    }
+    mined := signed(0, time.Now().Add(-10*time.Minute))
+    signed(1, time.Now().Add(-time.Minute)) // not mined yet
+    expired := signed(2, time.Now().Add(-2*gasReceiptMaxAge))
+    unsent := signed(3, nil)
+    receipt := func(tx *types.Transaction) *types.Receipt {
+        return &types.Receipt{Status: types.ReceiptStatusSuccessful, TxHash: tx.Hash(), BlockNumber: big.NewInt(7),
+            GasUsed: 21000, EffectiveGasPrice: big.NewInt(11e9)}
+    }
+    testMined(node, big.NewInt(10e9), receipt(mined), receipt(expired), receipt(unsent))
+    
+    n, err := collectReceipts(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if n != 1 {
+        t.Fatalf("stored %d receipts, want 1", n)
+    }
+    if calls := node.count("eth_getTransactionReceipt"); calls != 2 {
+        t.Errorf("looked up %d receipts, want only the 2 recent broadcasts", calls)
+    }
+    if n := countRows(t, "SELECT COUNT(*) FROM gas_receipts WHERE tx_hash = $1 AND chain_id = 1337", mined.Hash().Hex()); n != 1 {
+        t.Errorf("receipt of %s not stored for chain 1337", mined.Hash().Hex())
+    }
+    
+    report, err := gasReport(context.Background(), time.Now().AddDate(0, 0, -30), "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.Awaiting != 1 {
+        t.Errorf("%d awaiting a receipt, want 1", report.Awaiting)
+    }
+    if len(report.Chains) != 1 || report.Chains[0].ChainID != "1337" || len(report.Chains[0].Lanes) != 1 {
+        t.Fatalf("report %+v, want one lane on chain 1337", report.Chains)
+    }
+    // The wait runs from the broadcast ten minutes ago, not the allocation.
+    if wait := report.Chains[0].Lanes[0].WaitSeconds.Max; wait < 590 || wait > 700 {
+        t.Errorf("waited %.0fs, want about 600", wait)
+    }
+}
+
+func TestGasReportPerChain(t *testing.T) {
+    testDB(t)
+    defer func(id *big.Int) { chainID = id }(chainID)
+    chainID = big.NewInt(1337)
+    for i, chain := range []interface{}{int64(1), int64(10), nil, int64(10)} {
+        mustExec(t, `INSERT INTO gas_receipts (tx_hash, address, lane, block_number, fee_cap, tip_cap, effective_price, base_fee,
+            gas_limit, gas_used, sent_at, mined_at, chain_id)
+            VALUES ($1, '0xa', 'normal', 1, 30e9, 1e9, 11e9, 10e9, 21000, 21000, now() - interval '1 minute', now(), $2)`,
+            common.BigToHash(big.NewInt(int64(i))).Hex(), chain)
+    }
+    report, err := gasReport(context.Background(), time.Now().AddDate(0, 0, -30), "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := map[string]int{"1": 1, "10": 2, "1337": 1}
+    if len(report.Chains) != len(want) {
+        t.Fatalf("%d chains, want %d", len(report.Chains), len(want))
+    }
+    for _, chain := range report.Chains {
+        if len(chain.Lanes) != 1 || chain.Lanes[0].Transactions != want[chain.ChainID] {
+            t.Errorf("chain %s: %+v, want %d transactions", chain.ChainID, chain.Lanes, want[chain.ChainID])
+        }
+    }
+}
+
+func TestReceiptBillsGasUsed(t *testing.T) {
+    testDB(t)
+    node := testNode(t)
+    addClient(t, &APIClient{ID: "tenant"})
+    to := common.HexToAddress("0x2222222222222222222222222222222222222222")
+    tx := types.NewTx(&types.DynamicFeeTx{ChainID: big.NewInt(1337), GasTipCap: big.NewInt(1e9), GasFeeCap: big.NewInt(30e9), Gas: 50000, To: &to})
+    raw, err := tx.MarshalBinary()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var id int64
+    db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status, client_id)
+        VALUES ('0x1111111111111111111111111111111111111111', $1, 1, 'completed', 'tenant') RETURNING id`, to.Hex()).Scan(&id)
+    mustExec(t, `INSERT INTO nonces (address, nonce, tx_hash, raw_tx, transfer_id, sent_at) VALUES ('0x1111111111111111111111111111111111111111', 0, $1, $2, $3, now())`,
+        tx.Hash().Hex(), hexutil.Encode(raw), id)
+    testMined(node, big.NewInt(10e9), &types.Receipt{Status: types.ReceiptStatusSuccessful, TxHash: tx.Hash(), BlockNumber: big.NewInt(7), GasUsed: 21000})
+    
+    // Collecting again finds the receipt stored and bills nothing more.
+    for i := 0; i < 2; i++ {
+        if _, err := collectReceipts(context.Background()); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // 21000 gas used at the base fee plus the tip, not the 50000 gas limit at
+    // the fee cap.
+    for _, table := range []string{"usage_monthly", "usage_daily"} {
+        if n := countRows(t, "SELECT COUNT(*) FROM "+table+" WHERE client_id = 'tenant' AND gas_wei = 231000e9"); n != 1 {
+            t.Errorf("%s: gas not billed as used", table)
+        }
+    }
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "log"
+    "net/http"
+)
+
+// GroupPolicy applies to every wallet in the group. A nil MaxAmount means the
+// group has no per-transfer limit and an empty SweepTo disables sweeping.
+type GroupPolicy struct {
+    Name            string   `json:"name"`
+    MaxAmount       *float64 `json:"max_amount"`
+    RequireApproval bool     `json:"require_approval"`
+    SweepTo         string   `json:"sweep_to"`
+}
+
+type SweepResult struct {
+    From   string  `json:"from"`
+    Amount float64 `json:"amount"`
+    ID     int64   `json:"id,omitempty"`
+    Status string  `json:"status,omitempty"`
+    Error  string  `json:"error,omitempty"`
+}
+
+func groupPolicyFor(ctx context.Context, address string) (*GroupPolicy, error) {
+    var p GroupPolicy
+    var maxAmount sql.NullFloat64
+    var sweepTo sql.NullString
+    err := db.QueryRowContext(ctx, `SELECT g.name, g.max_amount, g.require_approval, g.sweep_to
+        FROM wallets w JOIN wallet_groups g ON g.name = w.group_name WHERE w.address = $1`, address).
+        Scan(&p.Name, &maxAmount, &p.RequireApproval, &sweepTo)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if maxAmount.Valid {
+        p.MaxAmount = &maxAmount.Float64
+    }
+    p.SweepTo = sweepTo.String
+    return &p, nil
+}
+
+func (ws *WalletService) HandleGroups(w http.ResponseWriter, r *http.Request) {
+    if r.Method == http.MethodPost {
+        if !requireAdmin(w, r) {
+            return
+        }
+        var p GroupPolicy
+        if err := json.NewDecoder(r.Body).Decode(&p); err != nil || p.Name == "" {
+            http.Error(w, "Invalid request", 400)
+            return
+        }
+        _, err := db.ExecContext(r.Context(), `INSERT INTO wallet_groups (name, max_amount, require_approval, sweep_to)
+            VALUES ($1, $2, $3, NULLIF($4, ''))
+            ON CONFLICT (name) DO UPDATE SET max_amount = $2, require_approval = $3, sweep_to = NULLIF($4, '')`,
+            p.Name, p.MaxAmount, p.RequireApproval, p.SweepTo)
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        w.Write([]byte("Group saved"))
+        return
+    }
+    
+    rows, err := db.QueryContext(r.Context(), "SELECT name, max_amount, require_approval, COALESCE(sweep_to, '') FROM wallet_groups ORDER BY name")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer rows.Close()
+    
+    groups := []GroupPolicy{}
+    for rows.Next() {
+        var p GroupPolicy
+        var maxAmount sql.NullFloat64
+        if err := rows.Scan(&p.Name, &maxAmount, &p.RequireApproval, &p.SweepTo); err != nil {
+            writeError(w, err)
+            return
+        }
+        if maxAmount.Valid {
+            p.MaxAmount = &maxAmount.Float64
+        }
+        groups = append(groups, p)
+    }
+    writeJSON(w, groups)
+}
+
+// HandleSweepGroup moves the ledger balance of every wallet in the group to
+// the group's sweep address, keeping back enough to pay the transfer fee.
+// Each sweep goes through submitTransfer so group limits and approvals apply.
+func (ws *WalletService) HandleSweepGroup(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", 405)
+        return
+    }
+    if !requireAdmin(w, r) {
+        return
+    }
+    swept, err := sweepGroup(r.Context(), r.URL.Query().Get("group"), false)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJSON(w, swept)
+}
+
+// sweepGroup sweeps the wallets of a group whose balance is above the dust
+// threshold and worth the normal lane's current fee, reporting the others as
+// dust. With consolidate it sweeps only those instead, in the bulk lane,
+// where that is worth the fee by then.
+func sweepGroup(ctx context.Context, name string, consolidate bool) ([]SweepResult, error) {
+    var sweepTo sql.NullString
+    err := db.QueryRowContext(ctx, "SELECT sweep_to FROM wallet_groups WHERE name = $1", name).Scan(&sweepTo)
+    if err == sql.ErrNoRows {
+        return nil, &requestError{404, "Group not found"}
+    }
+    if err != nil {
+        return nil, err
+    }
+    if !sweepTo.Valid {
+        return nil, &requestError{400, "Group has no sweep address"}
+    }
+    
+    rows, err := db.QueryContext(ctx, "SELECT address, balance FROM wallets WHERE group_name = $1 AND address <> $2 ORDER BY address",
+        name, sweepTo.String)
+    if err != nil {
+        return nil, err
+    }
+    var results []SweepResult
+    for rows.Next() {
+        var res SweepResult
+        if err := rows.Scan(&res.From, &res.Amount); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        results = append(results, res)
+    }
+    rows.Close()
+    
+    priority := priorityNormal
+    if consolidate {
+        priority = priorityBulk
+    }
+    // Sweeps are sent on the connected chain.
+    conn, err := openChain(ctx, "", 0)
+    if err != nil {
+        return nil, err
+    }
+    fees, err := currentFees(ctx, conn)
+    if err != nil {
+        return nil, err
+    }
+    fee := toEther(lanes[priority].maxFee(fees, gasLimit))
+    normalFee := toEther(lanes[priorityNormal].maxFee(fees, gasLimit))
+    swept := []SweepResult{}
+    for _, res := range results {
+        if res.Amount <= 0 {
+            continue
+        }
+        dust, err := isDust(ctx, "ETH", toWei(res.Amount))
+        if err != nil {
+            return nil, err
+        }
+        dust = dust || !worthSweeping(res.Amount, normalFee)
+        if dust != consolidate {
+            if dust {
+                res.Status = "dust"
+                swept = append(swept, res)
+            }
+            continue
+        }
+        if consolidate && !worthSweeping(res.Amount, fee) || res.Amount <= fee {
+            continue
+        }
+        res.Amount -= fee
+        req := TransactionRequest{From: res.From, To: sweepTo.String, Amount: res.Amount, Priority: priority}
+        res.ID, res.Status, _, err = submitTransfer(ctx, req)
+        if err != nil {
+            log.Println("Sweep failed for", res.From, err)
+            res.Error = err.Error()
+        }
+        swept = append(swept, res)
+    }
+    return swept, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+    "context"
+    "log"
+    "math/big"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/ethereum/go-ethereum/core/types"
+)
+
+// Transfers may carry a maximum acceptable base fee and a deadline. The queue
+// leaves such a transfer waiting while the chain's base fee is above its
+// maximum and the deadline has not passed, so it is broadcast on the first
+// cheap enough block or at the deadline, whichever comes first. The base fee
+// is followed through new head notifications, or by polling when the node
+// connection cannot deliver them. Deferred transfers stay in the queue and
+// can be moved, held or dropped like any other.
+
+type headMonitor struct {
+    mu      sync.Mutex
+    number  uint64
+    baseFee *big.Int
+}
+
+var heads = &headMonitor{}
+
+// currentBaseFee is the base fee of the latest head seen, or nil before the
+// first one.
+func (h *headMonitor) currentBaseFee() *big.Int {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.baseFee
+}
+
+// baseFeeParam is the current base fee as a query argument; NULL while it is
+// unknown, so that only deadlines release deferred transfers.
+func (h *headMonitor) baseFeeParam() interface{} {
+    if fee := h.currentBaseFee(); fee != nil {
+        return fee.String()
+    }
+    return nil
+}
+
+func (h *headMonitor) update(header *types.Header) {
+    if header == nil || header.Number == nil {
+        return
+    }
+    h.mu.Lock()
+    if header.Number.Uint64() <= h.number {
+        h.mu.Unlock()
+        return
+    }
+    h.number = header.Number.Uint64()
+    h.baseFee = header.BaseFee
+    h.mu.Unlock()
+    
+    if err := wakeDeferred(); err != nil {
+        log.Println("Failed to wake deferred transfers:", err)
+    }
+}
+
+func (h *headMonitor) run() {
+    ch := make(chan *types.Header, 16)
+    sub, err := ethClient.SubscribeNewHead(context.Background(), ch)
+    if err == nil {
+        defer sub.Unsubscribe()
+        for {
+            select {
+            case header := <-ch:
+                h.update(header)
+            case err := <-sub.Err():
+                log.Println("New head subscription ended, polling instead:", err)
+                h.poll()
+                return
+            }
+        }
+    }
+    h.poll()
+}
+
+func (h *headMonitor) poll() {
+    for {
+        if chainBreaker.retryAfter() == 0 {
+            header, err := ethClient.HeaderByNumber(context.Background(), nil)
+            if err != nil {
+                log.Println("Failed to read latest head:", err)
+            } else {
+                h.update(header)
+            }
+        }
+        time.Sleep(12 * time.Second)
+    }
+}
+
+// deferralReleased is the queue condition for a transfer to be claimable as
+// far as its base fee limit goes, given the current base fee as parameter n.
+func deferralReleased(n int) string {
+    return "(max_base_fee IS NULL OR deadline <= now() OR max_base_fee >= $" + strconv.Itoa(n) + "::numeric)"
+}
+
+// wakeDeferred wakes the queues that have a deferred transfer the latest
+// head has made claimable.
+func wakeDeferred() error {
+    rows, err := db.Query(`SELECT DISTINCT from_address FROM transfers
+        WHERE status = 'pending' AND NOT on_hold AND max_base_fee IS NOT NULL AND `+deferralReleased(1), heads.baseFeeParam())
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var from string
+        if err := rows.Scan(&from); err != nil {
+            return err
+        }
+        queue.wake(from)
+    }
+    return rows.Err()
+}
+
+// validateDeferral checks the base fee limit and deadline of a request and
+// returns the limit in wei, or nil when the transfer is not deferred. Only
+// the connected chain's base fee is followed, so only its transfers defer.
+func validateDeferral(req TransactionRequest) (*big.Int, error) {
+    if req.MaxBaseFee == "" {
+        if req.Deadline != nil {
+            return nil, &requestError{400, "deadline requires max_base_fee_gwei"}
+        }
+        return nil, nil
+    }
+    if req.ChainID != 0 {
+        return nil, &requestError{400, "max_base_fee_gwei is only supported on the connected chain"}
+    }
+    maxBaseFee, err := parseUnits(req.MaxBaseFee, nativeUnits[unitGwei])
+    if err != nil {
+        return nil, &requestError{400, "Invalid max_base_fee_gwei"}
+    }
+    if req.Deadline != nil && !req.Deadline.After(time.Now()) {
+        return nil, &requestError{400, "deadline is in the past"}
+    }
+    return maxBaseFee, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "math/big"
+    "testing"
+    "time"
+
+    "github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestValidateDeferral(t *testing.T) {
+    future, past := time.Now().Add(time.Hour), time.Now().Add(-time.Hour)
+    tests := []struct {
+        name       string
+        maxBaseFee string
+        deadline   *time.Time
+        want       string
+        ok         bool
+    }{
+        {"not deferred", "", nil, "", true},
+        {"limit only", "12.5", nil, "12500000000", true},
+        {"limit and deadline", "3", &future, "3000000000", true},
+        {"deadline without limit", "", &future, "", false},
+        {"past deadline", "3", &past, "", false},
+        {"too precise", "0.0000000001", nil, "", false},
+        {"negative", "-1", nil, "", false},
+    }
+    for _, tt := range tests {
+        got, err := validateDeferral(TransactionRequest{MaxBaseFee: tt.maxBaseFee, Deadline: tt.deadline})
+        if (err == nil) != tt.ok {
+            t.Errorf("%s: error %v, want ok %v", tt.name, err, tt.ok)
+            continue
+        }
+        limit := ""
+        if got != nil {
+            limit = got.String()
+        }
+        if limit != tt.want {
+            t.Errorf("%s: limit %q, want %q", tt.name, limit, tt.want)
+        }
+    }
+}
+
+func TestDeferredTransfersWaitForBaseFee(t *testing.T) {
+    testDB(t)
+    defer func(h *headMonitor) { heads = h }(heads)
+    heads = &headMonitor{}
+    queue = &transferQueue{running: map[string]bool{"0xa": true}, again: map[string]bool{}}
+    mustExec(t, `INSERT INTO transfers (from_address, to_address, amount, status, max_base_fee, deadline, created_at) VALUES
+        ('0xa', '0xb', 1, 'pending', 5e9, now() + interval '1 hour', now()),
+        ('0xa', '0xc', 1, 'pending', 5e9, now() - interval '1 minute', now() + interval '1 second')`)
+    head := func(number, gwei int64) {
+        heads.update(&types.Header{Number: big.NewInt(number), BaseFee: big.NewInt(gwei * 1e9)})
+    }
+    claim := func() string {
+        _, req, err := claimNextTransfer("0xa", priorityNormal)
+        if err != nil {
+            return ""
+        }
+        return req.To
+    }
+    
+    // Above the limit only the transfer past its deadline goes, and nothing
+    // wakes the queue for the other one.
+    head(10, 10)
+    if !queue.again["0xa"] {
+        t.Error("the transfer past its deadline did not wake the queue")
+    }
+    if to := claim(); to != "0xc" {
+        t.Fatalf("claimed %q at 10 gwei, want the transfer past its deadline", to)
+    }
+    queue.again["0xa"] = false
+    head(11, 10)
+    if queue.again["0xa"] || claim() != "" {
+        t.Fatal("the deferred transfer was released above its limit")
+    }
+    
+    // An older head does not move the base fee back.
+    head(9, 1)
+    if fee := heads.currentBaseFee(); fee.Cmp(big.NewInt(10e9)) != 0 {
+        t.Fatalf("base fee %s after an older head, want 10 gwei", fee)
+    }
+    
+    head(12, 4)
+    if !queue.again["0xa"] {
+        t.Error("a cheap enough head did not wake the queue")
+    }
+    if to := claim(); to != "0xb" {
+        t.Fatalf("claimed %q at 4 gwei, want the deferred transfer", to)
+    }
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+    "context"
+    "log"
+    "math/big"
+    "os"
+    "strconv"
+)
+
+// Transfers are executed in one of three priority lanes. Each lane has its
+// own number of worker slots, so bulk payouts can never occupy the slots
+// urgent transfers need and urgent traffic cannot starve bulk entirely.
+// Slots are handed out in the order addresses ask for them and released after
+// every transfer, so within a lane addresses take turns. Within one address's
+// queue a transfer moves up a lane for every LANE_AGING_SECONDS it waits, so a
+// steady stream of urgent or normal transfers only delays bulk ones.
+//
+// Fees follow the chain: the fee cap is twice the current base fee, scaled by
+// the lane's percentage, plus the lane's tip, so a transaction stays
+// includable through a run of full blocks.
+
+const (
+    priorityUrgent = "urgent"
+    priorityNormal = "normal"
+    priorityBulk   = "bulk"
+)
+
+type lane struct {
+    name  string
+    rank  int
+    slots chan struct{}
+    // Tip relative to the suggested tip and fee cap relative to twice the
+    // base fee, in percent.
+    tipPercent    int64
+    feeCapPercent int64
+}
+
+var lanes = map[string]*lane{
+    priorityUrgent: newLane(priorityUrgent, 0, "LANE_URGENT_WORKERS", 8, 200, 200),
+    priorityNormal: newLane(priorityNormal, 1, "LANE_NORMAL_WORKERS", 4, 100, 100),
+    priorityBulk:   newLane(priorityBulk, 2, "LANE_BULK_WORKERS", 2, 100, 100),
+}
+
+var laneAgingSeconds = envInt("LANE_AGING_SECONDS", 300)
+
+// laneRank orders a queue by lane, urgent first, counting transfers that
+// have waited long enough as a lane higher.
+var laneRank = "GREATEST(CASE priority WHEN 'urgent' THEN 0 WHEN 'normal' THEN 1 ELSE 2 END - FLOOR(EXTRACT(EPOCH FROM now() - created_at) / " +
+    strconv.Itoa(laneAgingSeconds) + "), 0)"
+
+func newLane(name string, rank int, env string, workers int, tipPercent, feeCapPercent int64) *lane {
+    if v := os.Getenv(env); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            log.Println("Ignoring invalid", env, v)
+        } else {
+            workers = n
+        }
+    }
+    return &lane{name: name, rank: rank, slots: make(chan struct{}, workers), tipPercent: tipPercent, feeCapPercent: feeCapPercent}
+}
+
+func laneFor(priority string) *lane {
+    if l, ok := lanes[priority]; ok {
+        return l
+    }
+    return lanes[priorityNormal]
+}
+
+func (l *lane) acquire() {
+    l.slots <- struct{}{}
+}
+
+func (l *lane) release() {
+    <-l.slots
+}
+
+// feeQuote is the chain's current base fee and suggested tip, from which
+// every lane prices its transactions.
+type feeQuote struct {
+    baseFee *big.Int
+    tip     *big.Int
+}
+
+// currentFees quotes the base fee of conn's chain: for the connected chain
+// that of the latest head seen by the head monitor, otherwise, or when it
+// has none yet, that of the latest block. Chains without a base fee are
+// quoted their gas price.
+func currentFees(ctx context.Context, conn *chainConn) (feeQuote, error) {
+    tip, err := conn.eth.SuggestGasTipCap(ctx)
+    if err != nil {
+        return feeQuote{}, err
+    }
+    var baseFee *big.Int
+    if conn.key == 0 {
+        baseFee = heads.currentBaseFee()
+    }
+    if baseFee == nil {
+        header, err := conn.eth.HeaderByNumber(ctx, nil)
+        if err != nil {
+            return feeQuote{}, err
+        }
+        baseFee = header.BaseFee
+    }
+    if baseFee == nil {
+        if baseFee, err = conn.eth.SuggestGasPrice(ctx); err != nil {
+            return feeQuote{}, err
+        }
+    }
+    return feeQuote{baseFee: baseFee, tip: tip}, nil
+}
+
+func (l *lane) tip(q feeQuote) *big.Int {
+    return new(big.Int).Div(new(big.Int).Mul(q.tip, big.NewInt(l.tipPercent)), big.NewInt(100))
+}
+
+func (l *lane) feeCap(q feeQuote) *big.Int {
+    feeCap := new(big.Int).Mul(q.baseFee, big.NewInt(2*l.feeCapPercent))
+    feeCap.Div(feeCap, big.NewInt(100))
+    return feeCap.Add(feeCap, l.tip(q))
+}
+
+// maxFee is the most a transaction with the given gas limit can cost in fees.
+func (l *lane) maxFee(q feeQuote, gas uint64) *big.Int {
+    return new(big.Int).Mul(l.feeCap(q), new(big.Int).SetUint64(gas))
+}
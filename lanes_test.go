@@ -0,0 +1,60 @@
+package main
+
+import (
+    "math/big"
+    "testing"
+)
+
+func TestLaneFees(t *testing.T) {
+    gwei := func(n int64) *big.Int { return new(big.Int).Mul(big.NewInt(n), big.NewInt(1e9)) }
+    fees := feeQuote{baseFee: gwei(30), tip: gwei(2)}
+    tests := []struct {
+        lane   string
+        tip    *big.Int
+        feeCap *big.Int
+    }{
+        {priorityUrgent, gwei(4), gwei(124)},
+        {priorityNormal, gwei(2), gwei(62)},
+        {priorityBulk, gwei(2), gwei(62)},
+    }
+    for _, tt := range tests {
+        l := lanes[tt.lane]
+        if tip, feeCap := l.tip(fees), l.feeCap(fees); tip.Cmp(tt.tip) != 0 || feeCap.Cmp(tt.feeCap) != 0 {
+            t.Errorf("%s: tip %v, fee cap %v, want %v and %v", tt.lane, tip, feeCap, tt.tip, tt.feeCap)
+        }
+    }
+    
+    // The cap follows the base fee rather than a fixed price.
+    fees.baseFee = gwei(300)
+    if feeCap := lanes[priorityNormal].feeCap(fees); feeCap.Cmp(gwei(602)) != 0 {
+        t.Errorf("fee cap at a 300 gwei base fee is %v, want 602 gwei", feeCap)
+    }
+}
+
+func TestQueueAging(t *testing.T) {
+    testDB(t)
+    from := "0x1111111111111111111111111111111111111111"
+    tests := []struct {
+        name   string
+        waited int
+        want   string
+    }{
+        {"fresh bulk waits", 0, priorityNormal},
+        {"aged bulk goes first", 2 * laneAgingSeconds, priorityBulk},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            mustExec(t, "DELETE FROM transfers")
+            mustExec(t, `INSERT INTO transfers (from_address, to_address, amount, status, priority, created_at) VALUES
+                ($1, $1, 1, 'pending', 'bulk', now() - $2::int * interval '1 second'),
+                ($1, $1, 1, 'pending', 'normal', now())`, from, tt.waited)
+            priority, err := nextPriority(from)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if priority != tt.want {
+                t.Fatalf("next lane %s, want %s", priority, tt.want)
+            }
+        })
+    }
+}
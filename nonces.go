@@ -0,0 +1,387 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "log"
+    "math/big"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/common/hexutil"
+    "github.com/ethereum/go-ethereum/core/types"
+)
+
+// Every nonce the service signs with is recorded in the nonces table, keyed
+// by lower-case address and chain as stored with transfers. A gap is a nonce at or above the node's pending
+// nonce that the node does not have: every later transaction from the
+// address is stuck behind it.
+
+type NonceEntry struct {
+    Nonce      uint64 `json:"nonce"`
+    TransferID int64  `json:"transfer_id,omitempty"`
+    TxHash     string `json:"tx_hash,omitempty"`
+    Resendable bool   `json:"resendable,omitempty"`
+    rawTx      string
+    client     string
+    signing    bool
+}
+
+type NonceReport struct {
+    Address   string       `json:"address"`
+    ChainID   int64        `json:"chain_id"`
+    Mined     uint64       `json:"mined"`
+    Pending   uint64       `json:"pending"`
+    LocalNext uint64       `json:"local_next"`
+    Gaps      []NonceEntry `json:"gaps"`
+    Queued    []NonceEntry `json:"queued"`
+    // Signing holds nonces reserved by transfers a worker is still signing.
+    Signing []NonceEntry `json:"signing"`
+}
+
+type NonceRepair struct {
+    Nonce  uint64 `json:"nonce"`
+    Action string `json:"action"`
+    TxHash string `json:"tx_hash,omitempty"`
+    Error  string `json:"error,omitempty"`
+}
+
+func nonceKey(address common.Address) string {
+    return strings.ToLower(address.Hex())
+}
+
+// allocateNonce reserves the lowest nonce for from on conn's chain that is
+// at or above the node's pending nonce and not recorded locally. Released nonces are handed
+// out again this way instead of being left as gaps behind later ones.
+func allocateNonce(ctx context.Context, conn *chainConn, from common.Address, transferID int64) (uint64, error) {
+    pending, err := conn.eth.PendingNonceAt(ctx, from)
+    if err != nil {
+        return 0, err
+    }
+    
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+    
+    if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", nonceKey(from)+":"+strconv.FormatInt(conn.key, 10)); err != nil {
+        return 0, err
+    }
+    var next uint64
+    err = tx.QueryRow(`SELECT n FROM generate_series($2::bigint, (SELECT GREATEST(MAX(nonce) + 1, $2) FROM nonces WHERE address = $1 AND chain_id = $3)) n
+        WHERE NOT EXISTS (SELECT 1 FROM nonces WHERE address = $1 AND chain_id = $3 AND nonce = n) ORDER BY n LIMIT 1`, nonceKey(from), pending, conn.key).Scan(&next)
+    if err != nil {
+        return 0, err
+    }
+    _, err = tx.Exec("INSERT INTO nonces (address, chain_id, nonce, transfer_id) VALUES ($1, $2, $3, NULLIF($4, 0))", nonceKey(from), conn.key, next, transferID)
+    if err != nil {
+        return 0, err
+    }
+    return next, tx.Commit()
+}
+
+// releaseNonce frees a reservation whose transaction was never accepted by
+// the node so the nonce can be handed out again.
+func releaseNonce(conn *chainConn, from common.Address, nonce uint64) {
+    if _, err := db.Exec("DELETE FROM nonces WHERE address = $1 AND chain_id = $2 AND nonce = $3", nonceKey(from), conn.key, nonce); err != nil {
+        log.Println("Failed to release nonce", nonce, "for", from.Hex(), err)
+    }
+}
+
+// recordSignedNonce stores the signed transaction with its nonce and, for a
+// transfer, records the saga's signed step with it.
+func recordSignedNonce(ctx context.Context, conn *chainConn, from common.Address, tx *types.Transaction) error {
+    raw, err := tx.MarshalBinary()
+    if err != nil {
+        return err
+    }
+    dbTx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer dbTx.Rollback()
+    
+    var transferID sql.NullInt64
+    err = dbTx.QueryRowContext(ctx, `UPDATE nonces SET tx_hash = $4, raw_tx = $5 WHERE address = $1 AND chain_id = $2 AND nonce = $3
+        RETURNING transfer_id`, nonceKey(from), conn.key, tx.Nonce(), tx.Hash().Hex(), hexutil.Encode(raw)).Scan(&transferID)
+    if err != nil {
+        return err
+    }
+    if transferID.Valid {
+        if _, err := recordStep(ctx, dbTx, transferID.Int64, stepSigned, tx.Hash().Hex()); err != nil {
+            return err
+        }
+        if _, err := dbTx.ExecContext(ctx, "UPDATE transfers SET tx_hash = $2 WHERE id = $1", transferID.Int64, tx.Hash().Hex()); err != nil {
+            return err
+        }
+    }
+    return dbTx.Commit()
+}
+
+// markNonceSent records when the node first accepted the transaction
+// holding the nonce. Gas reports measure waits from there.
+func markNonceSent(ctx context.Context, conn *chainConn, address common.Address, nonce uint64) {
+    _, err := db.ExecContext(ctx, "UPDATE nonces SET sent_at = COALESCE(sent_at, now()) WHERE address = $1 AND chain_id = $2 AND nonce = $3",
+        nonceKey(address), conn.key, nonce)
+    if err != nil {
+        log.Println("Recording broadcast of nonce", nonce, "failed:", err)
+    }
+}
+
+func detectNonceGaps(ctx context.Context, conn *chainConn, address common.Address) (*NonceReport, error) {
+    mined, err := conn.eth.NonceAt(ctx, address, nil)
+    if err != nil {
+        return nil, err
+    }
+    pending, err := conn.eth.PendingNonceAt(ctx, address)
+    if err != nil {
+        return nil, err
+    }
+    report := &NonceReport{Address: address.Hex(), ChainID: conn.ChainID, Mined: mined, Pending: pending, LocalNext: mined,
+        Gaps: []NonceEntry{}, Queued: []NonceEntry{}, Signing: []NonceEntry{}}
+    
+    // A nonce reserved by a transfer that is still within its claim lease and
+    // not yet signed belongs to a worker that may be signing it right now.
+    rows, err := db.QueryContext(ctx, `SELECT n.nonce, COALESCE(n.transfer_id, 0), COALESCE(n.tx_hash, ''), COALESCE(n.raw_tx, ''),
+        COALESCE(t.client_id, ''), COALESCE(t.status = 'processing' AND n.raw_tx IS NULL
+            AND t.claimed_at >= now() - $3::int * interval '1 second'
+            AND NOT EXISTS (SELECT 1 FROM transfer_steps s WHERE s.transfer_id = t.id AND s.step = $4), false)
+        FROM nonces n LEFT JOIN transfers t ON t.id = n.transfer_id
+        WHERE n.address = $1 AND n.chain_id = $5 AND n.nonce >= $2 ORDER BY n.nonce`,
+        nonceKey(address), mined, int(sagaClaimLease/time.Second), stepSigned, conn.key)
+    if err != nil {
+        return nil, err
+    }
+    local := map[uint64]NonceEntry{}
+    for rows.Next() {
+        var e NonceEntry
+        if err := rows.Scan(&e.Nonce, &e.TransferID, &e.TxHash, &e.rawTx, &e.client, &e.signing); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        local[e.Nonce] = e
+        if e.Nonce+1 > report.LocalNext {
+            report.LocalNext = e.Nonce + 1
+        }
+    }
+    rows.Close()
+    
+    for n := pending; n < report.LocalNext; n++ {
+        e, ok := local[n]
+        if !ok {
+            report.Gaps = append(report.Gaps, NonceEntry{Nonce: n})
+            continue
+        }
+        if e.signing {
+            report.Signing = append(report.Signing, e)
+            continue
+        }
+        if e.TxHash != "" && n != pending {
+            if _, _, err := conn.eth.TransactionByHash(ctx, common.HexToHash(e.TxHash)); err == nil {
+                report.Queued = append(report.Queued, e)
+                continue
+            }
+        }
+        e.Resendable = e.rawTx != ""
+        report.Gaps = append(report.Gaps, e)
+    }
+    return report, nil
+}
+
+// repairNonceGaps re-sends the recorded transaction for each gap where there
+// is one, and otherwise fills the nonce with a zero-value self-transfer. A
+// gap is only filled once the node has definitively refused or never had
+// its transaction; when the node cannot be reached the gap is skipped for a
+// later run. Nonces still being signed are not gaps and are left alone. A transfer whose nonce is filled never happened on chain, so
+// once the filler is accepted it is marked failed and its ledger debit is
+// reversed.
+func repairNonceGaps(ctx context.Context, conn *chainConn, address common.Address) ([]NonceRepair, error) {
+    if !keyStore.HasAddress(address) {
+        return nil, errUnmanagedAddress
+    }
+    report, err := detectNonceGaps(ctx, conn, address)
+    if err != nil {
+        return nil, err
+    }
+    // A filler takes the fee model of the chain as configured for the
+    // transfer's client, or the global one for a nonce without a transfer.
+    conns := map[string]*chainConn{}
+    for _, gap := range report.Gaps {
+        if _, ok := conns[gap.client]; !ok {
+            c, err := lookupChain(ctx, gap.client, conn.ChainID)
+            if err != nil {
+                return nil, err
+            }
+            if c == nil {
+                c = conn.Chain
+            }
+            conns[gap.client] = &chainConn{Chain: c, eth: conn.eth, key: conn.key}
+        }
+    }
+    
+    repairs := []NonceRepair{}
+    for _, gap := range report.Gaps {
+        repair := NonceRepair{Nonce: gap.Nonce}
+        if gap.Resendable {
+            tx := new(types.Transaction)
+            if err := tx.UnmarshalBinary(common.FromHex(gap.rawTx)); err != nil {
+                return repairs, err
+            }
+            err := conn.eth.SendTransaction(ctx, tx)
+            msg := ""
+            if err != nil {
+                msg = strings.ToLower(err.Error())
+            }
+            switch {
+            case err == nil || broadcastAccepted(err):
+                repair.Action, repair.TxHash = "resent", tx.Hash().Hex()
+                markNonceSent(ctx, conn, address, gap.Nonce)
+            case strings.Contains(msg, "nonce too low"):
+                // Mined meanwhile, possibly by this very transaction; the
+                // saga watcher settles or fails the transfer.
+                repair.Action, repair.Error = "used", err.Error()
+            case strings.Contains(msg, "underpriced"):
+                repair.Action, repair.Error = "occupied", err.Error()
+            case !rejectedByNode(err):
+                repair.Action, repair.Error = "skipped", err.Error()
+            }
+            if repair.Action != "" {
+                repairs = append(repairs, repair)
+                continue
+            }
+            log.Println("Node refused nonce", gap.Nonce, "filling instead:", err)
+        }
+        
+        _, err := db.ExecContext(ctx, `INSERT INTO nonces (address, chain_id, nonce) VALUES ($1, $2, $3)
+            ON CONFLICT (address, chain_id, nonce) DO UPDATE SET transfer_id = NULL, tx_hash = NULL, raw_tx = NULL`, nonceKey(address), conn.key, gap.Nonce)
+        if err != nil {
+            return repairs, err
+        }
+        tx, err := signAndSend(ctx, conns[gap.client], address, gap.Nonce, address, new(big.Int), nil, gasLimit, lanes[priorityUrgent])
+        repair.Action = "filled"
+        if err != nil && !broadcastAccepted(err) {
+            // Put the gap back as it was. Should the filler reach the node
+            // after all, the saga watcher sees the transfer's nonce mined
+            // by another transaction and fails it.
+            repair.Error = err.Error()
+            _, rerr := db.ExecContext(ctx, `UPDATE nonces SET transfer_id = NULLIF($4, 0), tx_hash = NULLIF($5, ''), raw_tx = NULLIF($6, '')
+                WHERE address = $1 AND chain_id = $2 AND nonce = $3`, nonceKey(address), conn.key, gap.Nonce, gap.TransferID, gap.TxHash, gap.rawTx)
+            repairs = append(repairs, repair)
+            if rerr != nil {
+                return repairs, rerr
+            }
+            continue
+        }
+        repair.TxHash = tx.Hash().Hex()
+        repairs = append(repairs, repair)
+        if gap.TransferID != 0 {
+            if err := failTransfer(ctx, gap.TransferID, "nonce gap filled"); err != nil {
+                return repairs, err
+            }
+        }
+    }
+    return repairs, nil
+}
+
+// nonceChain opens the chain named by a nonce request's chain_id, the
+// connected chain when there is none.
+func nonceChain(ctx context.Context, raw string) (*chainConn, error) {
+    var id int64
+    if raw != "" {
+        var err error
+        if id, err = strconv.ParseInt(raw, 10, 64); err != nil || id < 0 {
+            return nil, &requestError{400, "Invalid chain_id"}
+        }
+    }
+    return openChain(ctx, "", id)
+}
+
+func (ws *WalletService) HandleNonceReport(w http.ResponseWriter, r *http.Request) {
+    if !requireAdmin(w, r) {
+        return
+    }
+    address := r.URL.Query().Get("address")
+    if !common.IsHexAddress(address) {
+        http.Error(w, "Invalid address", 400)
+        return
+    }
+    conn, err := nonceChain(r.Context(), r.URL.Query().Get("chain_id"))
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    report, err := detectNonceGaps(r.Context(), conn, common.HexToAddress(address))
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJSON(w, report)
+}
+
+func (ws *WalletService) HandleNonceRepair(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", 405)
+        return
+    }
+    if !requireAdmin(w, r) {
+        return
+    }
+    address := r.URL.Query().Get("address")
+    if !common.IsHexAddress(address) {
+        http.Error(w, "Invalid address", 400)
+        return
+    }
+    conn, err := nonceChain(r.Context(), r.URL.Query().Get("chain_id"))
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    repairs, err := repairNonceGaps(r.Context(), conn, common.HexToAddress(address))
+    if err == errUnmanagedAddress {
+        http.Error(w, err.Error(), 400)
+        return
+    }
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJSON(w, repairs)
+}
+
+func runNonces(args []string) error {
+    fs := flag.NewFlagSet("nonces", flag.ContinueOnError)
+    address := fs.String("address", "", "wallet address to check")
+    chain := fs.Int64("chain", 0, "registered chain ID, the connected chain by default")
+    repair := fs.Bool("repair", false, "fill or re-send every gap found")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if !common.IsHexAddress(*address) {
+        return fmt.Errorf("-address must be a hex address")
+    }
+    conn, err := openChain(context.Background(), "", *chain)
+    if err != nil {
+        return err
+    }
+    
+    var result interface{}
+    if *repair {
+        result, err = repairNonceGaps(context.Background(), conn, common.HexToAddress(*address))
+    } else {
+        result, err = detectNonceGaps(context.Background(), conn, common.HexToAddress(*address))
+    }
+    if err != nil {
+        return err
+    }
+    enc := json.NewEncoder(os.Stdout)
+    enc.SetIndent("", "  ")
+    return enc.Encode(result)
+}
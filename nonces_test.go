@@ -0,0 +1,189 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "math/big"
+    "testing"
+
+    "github.com/ethereum/go-ethereum/accounts"
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/common/hexutil"
+    "github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestAllocateNonceReusesReleasedNonces(t *testing.T) {
+    testDB(t)
+    node := testNode(t)
+    node.respond("eth_getTransactionCount", "0x5")
+    from := common.HexToAddress("0x1111111111111111111111111111111111111111")
+    ctx := context.Background()
+    
+    var got []uint64
+    for i := 0; i < 3; i++ {
+        n, err := allocateNonce(ctx, connectedChain(t, ""), from, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+        got = append(got, n)
+    }
+    releaseNonce(connectedChain(t, ""), from, 6)
+    for i := 0; i < 2; i++ {
+        n, err := allocateNonce(ctx, connectedChain(t, ""), from, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+        got = append(got, n)
+    }
+    want := []uint64{5, 6, 7, 6, 8}
+    for i := range want {
+        if got[i] != want[i] {
+            t.Fatalf("allocated %v, want %v", got, want)
+        }
+    }
+}
+
+func TestRepairNonceGaps(t *testing.T) {
+    tests := []struct {
+        name   string
+        resend error
+        fill   error
+        action string
+        status string
+        linked bool
+    }{
+        {"resent", nil, nil, "resent", "processing", true},
+        {"already known", errors.New("already known"), nil, "resent", "processing", true},
+        {"mined meanwhile", errors.New("nonce too low"), nil, "used", "processing", true},
+        {"node unreachable", errNodeDown, nil, "skipped", "processing", true},
+        {"refused and filled", errors.New("insufficient funds for gas * price + value"), nil, "filled", "failed", false},
+        {"refused, fill unreachable", errors.New("insufficient funds for gas * price + value"), errNodeDown, "filled", "processing", true},
+        {"refused, fill refused", errors.New("insufficient funds for gas * price + value"), errors.New("exceeds block gas limit"), "filled", "processing", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            testDB(t)
+            testKeyStore(t)
+            node := testNode(t)
+            account, err := keyStore.NewAccount("")
+            if err != nil {
+                t.Fatal(err)
+            }
+            keyStore.Unlock(account, "")
+            from := account.Address
+            
+            var id int64
+            db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status)
+                VALUES ($1, '0x2222222222222222222222222222222222222222', 1, 'processing') RETURNING id`, from.Hex()).Scan(&id)
+            to := common.HexToAddress("0x2222222222222222222222222222222222222222")
+            signed, err := keyStore.SignTx(accounts.Account{Address: from}, types.NewTx(&types.DynamicFeeTx{
+                ChainID: chainID, Nonce: 0, GasTipCap: big.NewInt(1), GasFeeCap: big.NewInt(2), Gas: 21000, To: &to, Value: big.NewInt(1),
+            }), chainID)
+            if err != nil {
+                t.Fatal(err)
+            }
+            raw, _ := signed.MarshalBinary()
+            mustExec(t, "INSERT INTO nonces (address, nonce, transfer_id, tx_hash, raw_tx) VALUES ($1, 0, $2, $3, $4)",
+                nonceKey(from), id, signed.Hash().Hex(), hexutil.Encode(raw))
+            
+            node.respond("eth_getTransactionCount", "0x0")
+            testFees(t, node, big.NewInt(1), big.NewInt(1))
+            node.handle("eth_sendRawTransaction", func(params []json.RawMessage) (interface{}, error) {
+                var sent string
+                json.Unmarshal(params[0], &sent)
+                if sent == hexutil.Encode(raw) {
+                    return signed.Hash().Hex(), tt.resend
+                }
+                return common.Hash{}.Hex(), tt.fill
+            })
+            
+            repairs, err := repairNonceGaps(context.Background(), connectedChain(t, ""), from)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(repairs) != 1 || repairs[0].Action != tt.action {
+                t.Fatalf("got repairs %+v, want one %s", repairs, tt.action)
+            }
+            var status string
+            db.QueryRow("SELECT status FROM transfers WHERE id = $1", id).Scan(&status)
+            if status != tt.status {
+                t.Errorf("transfer is %s, want %s", status, tt.status)
+            }
+            // Unless the filler went out, the gap still belongs to the
+            // transfer with its own signed transaction.
+            linked := countRows(t, "SELECT COUNT(*) FROM nonces WHERE transfer_id IS NOT NULL AND raw_tx = '"+hexutil.Encode(raw)+"'") == 1
+            if linked != tt.linked {
+                t.Errorf("nonce linked to the transfer: %v, want %v", linked, tt.linked)
+            }
+        })
+    }
+}
+
+func TestRepairNonceGapsSkipsTransfersBeingSigned(t *testing.T) {
+    tests := []struct {
+        name    string
+        claimed string
+        action  string
+        status  string
+    }{
+        {"claimed just now", "now()", "", "processing"},
+        {"claim abandoned", "now() - interval '1 day'", "filled", "failed"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            testDB(t)
+            testKeyStore(t)
+            node := testNode(t)
+            account, err := keyStore.NewAccount("")
+            if err != nil {
+                t.Fatal(err)
+            }
+            keyStore.Unlock(account, "")
+            from := account.Address
+            addClient(t, &APIClient{ID: "legacy"})
+            mustExec(t, `INSERT INTO chains (client_id, chain_id, name, rpc_urls, currency_symbol, fee_model)
+                VALUES ('legacy', 1337, 'test', '[]', 'ETH', 'legacy')`)
+            
+            // The worker reserved nonce 0 but has not signed yet.
+            var id int64
+            db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status, client_id, claimed_at)
+                VALUES ($1, '0x2222222222222222222222222222222222222222', 1, 'processing', 'legacy', `+tt.claimed+`) RETURNING id`,
+                from.Hex()).Scan(&id)
+            mustExec(t, "INSERT INTO nonces (address, nonce, transfer_id) VALUES ($1, 0, $2)", nonceKey(from), id)
+            
+            node.respond("eth_getTransactionCount", "0x0")
+            testFees(t, node, big.NewInt(1), big.NewInt(1))
+            var filler types.Transaction
+            node.handle("eth_sendRawTransaction", func(params []json.RawMessage) (interface{}, error) {
+                var sent hexutil.Bytes
+                json.Unmarshal(params[0], &sent)
+                if err := filler.UnmarshalBinary(sent); err != nil {
+                    return nil, err
+                }
+                return filler.Hash().Hex(), nil
+            })
+            
+            repairs, err := repairNonceGaps(context.Background(), connectedChain(t, ""), from)
+            if err != nil {
+                t.Fatal(err)
+            }
+            action := ""
+            if len(repairs) > 0 {
+                action = repairs[0].Action
+            }
+            if len(repairs) > 1 || action != tt.action {
+                t.Fatalf("got repairs %+v, want %q", repairs, tt.action)
+            }
+            var status string
+            db.QueryRow("SELECT status FROM transfers WHERE id = $1", id).Scan(&status)
+            if status != tt.status {
+                t.Errorf("transfer is %s, want %s", status, tt.status)
+            }
+            // The filler follows the fee model of the transfer's chain.
+            if action == "filled" && filler.Type() != types.LegacyTxType {
+                t.Errorf("filler is of type %d, want a legacy transaction", filler.Type())
+            }
+        })
+    }
+}
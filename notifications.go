@@ -0,0 +1,423 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "net/smtp"
+    "os"
+    "strconv"
+    "strings"
+    "text/template"
+    "time"
+)
+
+// Notifications tell people what happened to a transfer. Each tenant lists
+// where its notifications go (notification_targets: an email address, a
+// webhook URL or the in-app inbox, each with a locale) and may override the
+// wording per event, channel and locale. Templates are text/template with a
+// notificationData as the dot. Lookup prefers the target's locale, then the
+// tenant's own template over the global one (client ''), then a template for
+// the exact channel over one for all channels (channel ''), and finally falls
+// back to the built-in English text.
+
+const (
+    eventSent           = "sent"
+    eventReceived       = "received"
+    eventFailed         = "failed"
+    eventApprovalNeeded = "approval_needed"
+    
+    channelEmail   = "email"
+    channelWebhook = "webhook"
+    channelInApp   = "in_app"
+)
+
+var notificationEvents = map[string]bool{eventSent: true, eventReceived: true, eventFailed: true, eventApprovalNeeded: true}
+var notificationChannels = map[string]bool{channelEmail: true, channelWebhook: true, channelInApp: true}
+
+type NotificationTemplate struct {
+    Client  string `json:"client"`
+    Event   string `json:"event"`
+    Channel string `json:"channel"`
+    Locale  string `json:"locale"`
+    Subject string `json:"subject"`
+    Body    string `json:"body"`
+}
+
+type NotificationTarget struct {
+    Channel string `json:"channel"`
+    Target  string `json:"target"`
+    Locale  string `json:"locale"`
+}
+
+type Notification struct {
+    ID         int64      `json:"id"`
+    Event      string     `json:"event"`
+    TransferID int64      `json:"transfer_id"`
+    Subject    string     `json:"subject"`
+    Body       string     `json:"body"`
+    CreatedAt  time.Time  `json:"created_at"`
+    ReadAt     *time.Time `json:"read_at,omitempty"`
+}
+
+type notificationData struct {
+    Event      string
+    TransferID int64
+    From       string
+    To         string
+    Amount     string
+    Symbol     string
+    Status     string
+    TxHash     string
+}
+
+var builtinTemplates = map[string]map[string][2]string{
+    "en": {
+        eventSent:           {"Transfer {{.TransferID}} sent", "{{.Amount}} {{.Symbol}} was sent from {{.From}} to {{.To}}.{{if .TxHash}} Transaction {{.TxHash}}.{{end}}"},
+        eventReceived:       {"{{.Amount}} {{.Symbol}} received", "{{.To}} received {{.Amount}} {{.Symbol}} from {{.From}}."},
+        eventFailed:         {"Transfer {{.TransferID}} failed", "Sending {{.Amount}} {{.Symbol}} from {{.From}} to {{.To}} failed."},
+        eventApprovalNeeded: {"Transfer {{.TransferID}} needs approval", "{{.Amount}} {{.Symbol}} from {{.From}} to {{.To}} is waiting for approval."},
+    },
+    "es": {
+        eventSent:           {"Transferencia {{.TransferID}} enviada", "Se enviaron {{.Amount}} {{.Symbol}} de {{.From}} a {{.To}}.{{if .TxHash}} Transacción {{.TxHash}}.{{end}}"},
+        eventReceived:       {"{{.Amount}} {{.Symbol}} recibidos", "{{.To}} recibió {{.Amount}} {{.Symbol}} de {{.From}}."},
+        eventFailed:         {"La transferencia {{.TransferID}} falló", "El envío de {{.Amount}} {{.Symbol}} de {{.From}} a {{.To}} falló."},
+        eventApprovalNeeded: {"La transferencia {{.TransferID}} requiere aprobación", "{{.Amount}} {{.Symbol}} de {{.From}} a {{.To}} esperan aprobación."},
+    },
+}
+
+func renderTemplate(text string, data notificationData) (string, error) {
+    t, err := template.New("").Parse(text)
+    if err != nil {
+        return "", err
+    }
+    var buf bytes.Buffer
+    if err := t.Execute(&buf, data); err != nil {
+        return "", err
+    }
+    return buf.String(), nil
+}
+
+func lookupTemplate(ctx context.Context, client, event, channel, locale string) (string, string, error) {
+    var subject, body string
+    err := db.QueryRowContext(ctx, `SELECT subject, body FROM notification_templates
+        WHERE client_id IN ($1, '') AND event = $2 AND channel IN ($3, '') AND locale = $4
+        ORDER BY client_id = $1 DESC, channel = $3 DESC LIMIT 1`, client, event, channel, locale).Scan(&subject, &body)
+    if err == nil {
+        return subject, body, nil
+    }
+    if err != sql.ErrNoRows {
+        return "", "", err
+    }
+    if builtin, ok := builtinTemplates[locale][event]; ok {
+        return builtin[0], builtin[1], nil
+    }
+    if locale != "en" {
+        return lookupTemplate(ctx, client, event, channel, "en")
+    }
+    return "", "", fmt.Errorf("no template for %s", event)
+}
+
+// notifyTransfer renders the event for every target of the tenant that
+// created the transfer, or for received of the tenant owning the recipient
+// wallet. approval_needed also goes to the clients approving for the tenant,
+// who have to act on it. It is meant to run in its own goroutine.
+func notifyTransfer(id int64, event string) {
+    ctx := context.Background()
+    var client string
+    data := notificationData{Event: event, TransferID: id, Symbol: "ETH"}
+    var amount string
+    err := db.QueryRowContext(ctx, `SELECT COALESCE(client_id, ''), from_address, to_address, `+amountWeiSQL+`, status, COALESCE(tx_hash, '')
+        FROM transfers WHERE id = $1`, id).Scan(&client, &data.From, &data.To, &amount, &data.Status, &data.TxHash)
+    if err != nil {
+        log.Println("Notification for transfer", id, "failed:", err)
+        return
+    }
+    if event == eventReceived {
+        if client, err = walletOwner(ctx, data.To); err != nil {
+            log.Println("Notification for transfer", id, "failed:", err)
+            return
+        }
+    }
+    if client == "" {
+        return
+    }
+    data.Amount = formatUnits(parseWei(amount), 18)
+    
+    clients := []string{client}
+    if event == eventApprovalNeeded {
+        approvers, err := approversFor(ctx, client)
+        if err != nil {
+            log.Println("Notification for transfer", id, "failed:", err)
+            return
+        }
+        clients = append(clients, approvers...)
+    }
+    for _, client := range clients {
+        targets, err := notificationTargets(ctx, client)
+        if err != nil {
+            log.Println("Notification for transfer", id, "failed:", err)
+            return
+        }
+        for _, target := range targets {
+            if err := deliverNotification(ctx, client, target, data); err != nil {
+                log.Println("Notifying", target.Channel, target.Target, "about transfer", id, "failed:", err)
+            }
+        }
+    }
+}
+
+// approversFor lists the clients approving held transfers for client.
+func approversFor(ctx context.Context, client string) ([]string, error) {
+    rows, err := db.QueryContext(ctx, "SELECT id FROM api_clients WHERE approver_for = $1 ORDER BY id", client)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var approvers []string
+    for rows.Next() {
+        var id string
+        if err := rows.Scan(&id); err != nil {
+            return nil, err
+        }
+        approvers = append(approvers, id)
+    }
+    return approvers, rows.Err()
+}
+
+func deliverNotification(ctx context.Context, client string, target NotificationTarget, data notificationData) error {
+    subjectText, bodyText, err := lookupTemplate(ctx, client, data.Event, target.Channel, target.Locale)
+    if err != nil {
+        return err
+    }
+    subject, err := renderTemplate(subjectText, data)
+    if err != nil {
+        return err
+    }
+    body, err := renderTemplate(bodyText, data)
+    if err != nil {
+        return err
+    }
+    
+    switch target.Channel {
+    case channelInApp:
+        _, err = db.ExecContext(ctx, `INSERT INTO notifications (client_id, event, transfer_id, locale, subject, body)
+            VALUES ($1, $2, $3, $4, $5, $6)`, client, data.Event, data.TransferID, target.Locale, subject, body)
+        return err
+    case channelEmail:
+        return sendEmail(target.Target, subject, body)
+    case channelWebhook:
+        // Webhooks ride on the callback outbox for signing and retries.
+        payload, _ := json.Marshal(map[string]interface{}{
+            "event": data.Event, "transfer_id": data.TransferID, "locale": target.Locale, "subject": subject, "body": body,
+        })
+        _, err = db.ExecContext(ctx, "INSERT INTO callbacks (transfer_id, url, payload) VALUES ($1, $2, $3)", data.TransferID, target.Target, string(payload))
+        if err == nil {
+            wakeCallbacks()
+        }
+        return err
+    }
+    return fmt.Errorf("unknown channel %s", target.Channel)
+}
+
+// sendEmail sends through SMTP_ADDR (host:port) as SMTP_FROM, authenticating
+// when SMTP_USER is set.
+func sendEmail(to, subject, body string) error {
+    addr := os.Getenv("SMTP_ADDR")
+    if addr == "" {
+        return fmt.Errorf("SMTP_ADDR is not set")
+    }
+    var auth smtp.Auth
+    if user := os.Getenv("SMTP_USER"); user != "" {
+        host, _, _ := net.SplitHostPort(addr)
+        auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+    }
+    from := os.Getenv("SMTP_FROM")
+    msg := "From: " + from + "\r\nTo: " + headerValue(to) + "\r\nSubject: " + headerValue(subject) +
+        "\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n" + body + "\r\n"
+    return smtp.SendMail(addr, auth, from, []string{to}, []byte(msg))
+}
+
+// headerValue keeps a rendered value on one header line, so a template or a
+// transfer field cannot inject headers of its own.
+func headerValue(s string) string {
+    return strings.Join(strings.FieldsFunc(s, func(r rune) bool { return r == '\r' || r == '\n' }), " ")
+}
+
+func notificationTargets(ctx context.Context, client string) ([]NotificationTarget, error) {
+    rows, err := db.QueryContext(ctx, "SELECT channel, target, locale FROM notification_targets WHERE client_id = $1 ORDER BY channel, target", client)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    targets := []NotificationTarget{}
+    for rows.Next() {
+        var t NotificationTarget
+        if err := rows.Scan(&t.Channel, &t.Target, &t.Locale); err != nil {
+            return nil, err
+        }
+        targets = append(targets, t)
+    }
+    return targets, rows.Err()
+}
+
+// HandleNotificationTemplates lists or saves templates. Clients save their
+// own; admins may name any client, or '' for the global defaults.
+func (ws *WalletService) HandleNotificationTemplates(w http.ResponseWriter, r *http.Request) {
+    client := clientFromContext(r.Context())
+    if r.Method == http.MethodPost {
+        var t NotificationTemplate
+        if err := json.NewDecoder(r.Body).Decode(&t); err != nil || !notificationEvents[t.Event] || t.Locale == "" ||
+            (t.Channel != "" && !notificationChannels[t.Channel]) {
+            http.Error(w, "Invalid request", 400)
+            return
+        }
+        if client == nil || !client.Admin {
+            t.Client = clientID(r.Context())
+        }
+        sample := notificationData{Event: t.Event, TransferID: 1, Symbol: "ETH"}
+        for _, text := range []string{t.Subject, t.Body} {
+            if _, err := renderTemplate(text, sample); err != nil {
+                http.Error(w, "Invalid template: "+err.Error(), 400)
+                return
+            }
+        }
+        _, err := db.ExecContext(r.Context(), `INSERT INTO notification_templates (client_id, event, channel, locale, subject, body)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            ON CONFLICT (client_id, event, channel, locale) DO UPDATE SET subject = $5, body = $6`,
+            t.Client, t.Event, t.Channel, strings.ToLower(t.Locale), t.Subject, t.Body)
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        w.Write([]byte("Template saved"))
+        return
+    }
+    
+    rows, err := db.QueryContext(r.Context(), `SELECT client_id, event, channel, locale, subject, body FROM notification_templates
+        WHERE client_id IN ($1, '') ORDER BY client_id, event, channel, locale`, clientID(r.Context()))
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer rows.Close()
+    templates := []NotificationTemplate{}
+    for rows.Next() {
+        var t NotificationTemplate
+        if err := rows.Scan(&t.Client, &t.Event, &t.Channel, &t.Locale, &t.Subject, &t.Body); err != nil {
+            writeError(w, err)
+            return
+        }
+        templates = append(templates, t)
+    }
+    writeJSON(w, templates)
+}
+
+// HandleNotificationTargets lists, adds or (with DELETE) removes the calling
+// client's notification targets. In-app targets have an empty target.
+func (ws *WalletService) HandleNotificationTargets(w http.ResponseWriter, r *http.Request) {
+    client := clientID(r.Context())
+    switch r.Method {
+    case http.MethodPost:
+        var t NotificationTarget
+        if err := json.NewDecoder(r.Body).Decode(&t); err != nil || !notificationChannels[t.Channel] {
+            http.Error(w, "Invalid request", 400)
+            return
+        }
+        if t.Channel == channelInApp {
+            t.Target = ""
+        } else if t.Target == "" {
+            http.Error(w, "Missing target", 400)
+            return
+        }
+        if t.Channel == channelWebhook {
+            if err := validateCallbackURL(r.Context(), t.Target); err != nil {
+                writeError(w, err)
+                return
+            }
+        }
+        if t.Locale == "" {
+            t.Locale = "en"
+        }
+        _, err := db.ExecContext(r.Context(), `INSERT INTO notification_targets (client_id, channel, target, locale) VALUES ($1, $2, $3, $4)
+            ON CONFLICT (client_id, channel, target) DO UPDATE SET locale = $4`, client, t.Channel, t.Target, strings.ToLower(t.Locale))
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        w.Write([]byte("Target saved"))
+    case http.MethodDelete:
+        q := r.URL.Query()
+        res, err := db.ExecContext(r.Context(), "DELETE FROM notification_targets WHERE client_id = $1 AND channel = $2 AND target = $3",
+            client, q.Get("channel"), q.Get("target"))
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+            http.Error(w, "Target not found", 404)
+            return
+        }
+        w.Write([]byte("Target removed"))
+    default:
+        targets, err := notificationTargets(r.Context(), client)
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        writeJSON(w, targets)
+    }
+}
+
+// HandleNotifications lists the calling client's in-app notifications,
+// newest first; ?unread=true leaves out the ones already read.
+func (ws *WalletService) HandleNotifications(w http.ResponseWriter, r *http.Request) {
+    query := "SELECT id, event, transfer_id, subject, body, created_at, read_at FROM notifications WHERE client_id = $1"
+    if r.URL.Query().Get("unread") == "true" {
+        query += " AND read_at IS NULL"
+    }
+    rows, err := db.QueryContext(r.Context(), query+" ORDER BY id DESC LIMIT 200", clientID(r.Context()))
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer rows.Close()
+    notifications := []Notification{}
+    for rows.Next() {
+        var n Notification
+        if err := rows.Scan(&n.ID, &n.Event, &n.TransferID, &n.Subject, &n.Body, &n.CreatedAt, &n.ReadAt); err != nil {
+            writeError(w, err)
+            return
+        }
+        notifications = append(notifications, n)
+    }
+    writeJSON(w, notifications)
+}
+
+func (ws *WalletService) HandleReadNotification(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", 405)
+        return
+    }
+    id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+    if err != nil {
+        http.Error(w, "Invalid id", 400)
+        return
+    }
+    res, err := db.ExecContext(r.Context(), "UPDATE notifications SET read_at = COALESCE(read_at, now()) WHERE id = $1 AND client_id = $2",
+        id, clientID(r.Context()))
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        http.Error(w, "Notification not found", 404)
+        return
+    }
+    w.Write([]byte("Notification read"))
+}
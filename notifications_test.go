@@ -0,0 +1,69 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestEmailHeadersStayOnOneLine(t *testing.T) {
+    tests := map[string]string{
+        "Transfer 1 sent":                         "Transfer 1 sent",
+        "Transfer 1 sent\r\nBcc: victim@example.com": "Transfer 1 sent Bcc: victim@example.com",
+        "a\nb\rc":                                 "a b c",
+    }
+    for in, want := range tests {
+        if got := headerValue(in); got != want {
+            t.Errorf("headerValue(%q) = %q, want %q", in, got, want)
+        }
+    }
+}
+
+func TestNotificationsGoToTheRightTenant(t *testing.T) {
+    testDB(t)
+    sender := addClient(t, &APIClient{ID: "sender"})
+    recipient := addClient(t, &APIClient{ID: "recipient"})
+    const from, to = "0x1111111111111111111111111111111111111111", "0x2222222222222222222222222222222222222222"
+    mustExec(t, "INSERT INTO wallets (address, balance, client_id) VALUES ($1, 0, $2)", to, recipient.ID)
+    mustExec(t, `INSERT INTO notification_targets (client_id, channel, target, locale)
+        VALUES ($1, 'in_app', '', 'en'), ($2, 'in_app', '', 'en')`, sender.ID, recipient.ID)
+    var id int64
+    err := db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status, client_id)
+        VALUES ($1, $2, 1, 'completed', $3) RETURNING id`, from, to, sender.ID).Scan(&id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    notifyTransfer(id, eventSent)
+    notifyTransfer(id, eventReceived)
+    for _, tt := range []struct{ client, event string }{{sender.ID, eventSent}, {recipient.ID, eventReceived}} {
+        if n := countRows(t, "SELECT COUNT(*) FROM notifications WHERE client_id = $1", tt.client); n != 1 {
+            t.Errorf("%s has %d notifications, want 1", tt.client, n)
+        }
+        if n := countRows(t, "SELECT COUNT(*) FROM notifications WHERE client_id = $1 AND event = $2", tt.client, tt.event); n != 1 {
+            t.Errorf("%s did not get %s", tt.client, tt.event)
+        }
+    }
+}
+
+func TestApprovalNeededReachesApprovers(t *testing.T) {
+    testDB(t)
+    tenant := addClient(t, &APIClient{ID: "tenant"})
+    approver := addClient(t, &APIClient{ID: "approver", ApproverFor: "tenant"})
+    bystander := addClient(t, &APIClient{ID: "bystander"})
+    for _, c := range []*APIClient{tenant, approver, bystander} {
+        mustExec(t, "INSERT INTO notification_targets (client_id, channel, target, locale) VALUES ($1, 'in_app', '', 'en')", c.ID)
+    }
+    var id int64
+    err := db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status, client_id)
+        VALUES ('0x1111111111111111111111111111111111111111', '0x2222222222222222222222222222222222222222', 1, 'held', $1)
+        RETURNING id`, tenant.ID).Scan(&id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    notifyTransfer(id, eventApprovalNeeded)
+    for client, want := range map[string]int{tenant.ID: 1, approver.ID: 1, bystander.ID: 0} {
+        if n := countRows(t, "SELECT COUNT(*) FROM notifications WHERE client_id = $1 AND event = $2", client, eventApprovalNeeded); n != want {
+            t.Errorf("%s got %d approval_needed notifications, want %d", client, n, want)
+        }
+    }
+}
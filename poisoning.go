@@ -0,0 +1,91 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/ethereum/go-ethereum/common"
+)
+
+// Address poisoning relies on people copying a recipient from their history
+// without checking the middle of it: an attacker sends the victim a worthless
+// transfer from an address that shares the first and last characters of one
+// the victim really uses. A recipient is a lookalike when it matches a known
+// address (one the wallet has sent to before, or a managed wallet) in its
+// first LOOKALIKE_PREFIX and last LOOKALIKE_SUFFIX hex digits but is not
+// itself known.
+//
+// LOOKALIKE_ACTION decides what happens to such a transfer: "warn" (the
+// default) lets it through with an X-Recipient-Warning header, "hold" waits
+// for approval and "block" refuses it. Policies can also use the lookalike
+// variable directly.
+
+var (
+    lookalikePrefix = envInt("LOOKALIKE_PREFIX", 4)
+    lookalikeSuffix = envInt("LOOKALIKE_SUFFIX", 4)
+    lookalikeAction = os.Getenv("LOOKALIKE_ACTION")
+)
+
+func init() {
+    switch lookalikeAction {
+    case "":
+        lookalikeAction = "warn"
+    case "warn", "hold", "block":
+    default:
+        log.Println("Ignoring invalid LOOKALIKE_ACTION", lookalikeAction)
+        lookalikeAction = "warn"
+    }
+}
+
+// findLookalike returns the known address that candidate imitates, as seen
+// from wallet's history before at, or "" when there is none. The managed
+// wallets counted as known are those of wallet's own client, so one tenant's
+// addresses neither vouch for nor reveal another's. Addresses are stored as
+// submitted, so wallet is matched in each spelling rather than through
+// lower() on the column, which would bypass the indexes.
+func findLookalike(ctx context.Context, wallet, candidate string, at time.Time) (string, error) {
+    var resembled string
+    err := db.QueryRowContext(ctx, `WITH owner AS (
+            SELECT client_id FROM wallets WHERE address IN ($1, $6, $7) LIMIT 1
+        ), known AS (
+            SELECT lower(to_address) AS address FROM transfers
+            WHERE from_address IN ($1, $6, $7) AND created_at < $2 AND status <> 'rejected'
+            UNION SELECT lower(address) FROM wallets
+            WHERE client_id = (SELECT client_id FROM owner)
+            OR client_id IS NULL AND (SELECT client_id FROM owner) IS NULL
+        )
+        SELECT address FROM known
+        WHERE NOT EXISTS (SELECT 1 FROM known WHERE address = lower($3))
+        AND left(address, $4) = left(lower($3), $4) AND right(address, $5) = right(lower($3), $5)
+        LIMIT 1`, wallet, at, candidate, 2+lookalikePrefix, lookalikeSuffix,
+        common.HexToAddress(wallet).Hex(), strings.ToLower(wallet)).Scan(&resembled)
+    if err == sql.ErrNoRows {
+        return "", nil
+    }
+    return resembled, err
+}
+
+// HandleCheckRecipient lets a client warn before submitting:
+// ?from=<wallet>&to=<recipient>.
+func (ws *WalletService) HandleCheckRecipient(w http.ResponseWriter, r *http.Request) {
+    from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+    if err := checkWalletAccess(r.Context(), from); err != nil {
+        writeError(w, err)
+        return
+    }
+    resembled, err := findLookalike(r.Context(), from, to, time.Now())
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJSON(w, map[string]interface{}{
+        "lookalike": resembled != "",
+        "resembles": resembled,
+        "action":    lookalikeAction,
+    })
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+type contextKey string
+
+// A policy with an empty Client applies to every client without an active
+// policy of its own.
+type PolicyVersion struct {
+    Version   int64     `json:"version"`
+    Client    string    `json:"client"`
+    Source    string    `json:"source"`
+    Active    bool      `json:"active"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+type SimulateRequest struct {
+    Transfer TransactionRequest `json:"transfer"`
+    Source   string             `json:"source"`
+    Version  int64              `json:"version"`
+    At       *time.Time         `json:"at"`
+}
+
+type SimulateResponse struct {
+    Decision Decision               `json:"decision"`
+    Context  map[string]interface{} `json:"context"`
+}
+
+var (
+    policyCacheMu sync.Mutex
+    policyCache   = map[int64]*Policy{}
+)
+
+// policyContext collects the variables rules can refer to. Everything is
+// computed as of at, so historical transfers can be evaluated as they would
+// have been when they were submitted.
+func policyContext(ctx context.Context, req TransactionRequest, at time.Time) (map[string]interface{}, error) {
+    vars := map[string]interface{}{
+        "amount":   req.Amount,
+        "from":     req.From,
+        "to":       req.To,
+        "priority": req.Priority,
+        "user":     clientID(ctx),
+        "hour":     float64(at.UTC().Hour()),
+        "weekday":  strings.ToLower(at.UTC().Weekday().String()),
+    }
+    
+    var group, tags string
+    var balance float64
+    err := db.QueryRowContext(ctx, `SELECT COALESCE(group_name, ''), balance,
+        COALESCE((SELECT string_agg(tag, ',') FROM wallet_tags t WHERE t.address = w.address), '')
+        FROM wallets w WHERE address = $1`, req.From).Scan(&group, &balance, &tags)
+    if err != nil && err != sql.ErrNoRows {
+        return nil, err
+    }
+    vars["group"] = group
+    vars["balance"] = balance
+    vars["tags"] = []string{}
+    if tags != "" {
+        vars["tags"] = strings.Split(tags, ",")
+    }
+    
+    var sent float64
+    var seen bool
+    err = db.QueryRowContext(ctx, `SELECT
+        COALESCE(SUM(amount) FILTER (WHERE created_at > $2::timestamptz - interval '24 hours'), 0),
+        COALESCE(bool_or(to_address = $3), false)
+        FROM transfers WHERE from_address = $1 AND created_at < $2 AND status <> 'rejected'`,
+        req.From, at, req.To).Scan(&sent, &seen)
+    if err != nil {
+        return nil, err
+    }
+    vars["sent_24h"] = sent
+    vars["recipient_seen"] = seen
+    
+    resembled, err := findLookalike(ctx, req.From, req.To, at)
+    if err != nil {
+        return nil, err
+    }
+    vars["lookalike"] = resembled != ""
+    vars["resembles"] = resembled
+    return vars, nil
+}
+
+// Decisions not taken by a policy rule are logged under these rule names,
+// which cannot clash with policy rules because those cannot contain a colon.
+const (
+    ruleGroupPrefix = "group:"
+    ruleLookalike   = "recipient:lookalike"
+)
+
+// decideTransfer combines the policy decision for req with its wallet group
+// and the lookalike recipient check. A group limit denies before the policy
+// is consulted and a blocked lookalike recipient denies unless the policy
+// already did; otherwise a hold from the policy, the group or the lookalike
+// check holds the transfer.
+func decideTransfer(ctx context.Context, policy *Policy, lookalike string, req TransactionRequest, at time.Time) (Decision, map[string]interface{}, error) {
+    vars, err := policyContext(ctx, req, at)
+    if err != nil {
+        return Decision{}, nil, err
+    }
+    group, err := groupPolicyFor(ctx, req.From)
+    if err != nil {
+        return Decision{}, nil, err
+    }
+    d := policy.Evaluate(vars, false)
+    override := func(action, rule, reason string) (Decision, map[string]interface{}, error) {
+        return Decision{Action: action, Rule: rule, Version: d.Version, Reason: reason}, vars, nil
+    }
+    
+    if group != nil && group.MaxAmount != nil && req.Amount > *group.MaxAmount {
+        return override(actionDeny, ruleGroupPrefix+group.Name, "amount exceeds the group limit")
+    }
+    if d.Action == actionDeny {
+        return d, vars, nil
+    }
+    lookalikeHit := vars["lookalike"] == true
+    if lookalikeHit && lookalike == "block" {
+        return override(actionDeny, ruleLookalike, "recipient resembles a previously used address")
+    }
+    if d.Action == actionHold {
+        return d, vars, nil
+    }
+    if group != nil && group.RequireApproval {
+        return override(actionHold, ruleGroupPrefix+group.Name, "group requires approval")
+    }
+    if lookalikeHit && lookalike == "hold" {
+        return override(actionHold, ruleLookalike, "recipient resembles a previously used address")
+    }
+    return d, vars, nil
+}
+
+func denialMessage(d Decision) string {
+    switch {
+    case strings.HasPrefix(d.Rule, ruleGroupPrefix):
+        return "Amount exceeds group limit"
+    case d.Rule == ruleLookalike:
+        return "Recipient resembles a previously used address"
+    }
+    return "Denied by policy rule " + d.Rule
+}
+
+func loadPolicy(ctx context.Context, version int64) (*Policy, error) {
+    policyCacheMu.Lock()
+    p, ok := policyCache[version]
+    policyCacheMu.Unlock()
+    if ok {
+        return p, nil
+    }
+    
+    var source string
+    if err := db.QueryRowContext(ctx, "SELECT source FROM policies WHERE version = $1", version).Scan(&source); err != nil {
+        return nil, err
+    }
+    p, err := compilePolicy(version, source)
+    if err != nil {
+        return nil, err
+    }
+    policyCacheMu.Lock()
+    policyCache[version] = p
+    policyCacheMu.Unlock()
+    return p, nil
+}
+
+// activePolicy returns the calling client's active policy, falling back to
+// the global one, or an empty policy that allows everything when neither has
+// been activated yet.
+func activePolicy(ctx context.Context) (*Policy, error) {
+    var version int64
+    err := db.QueryRowContext(ctx, "SELECT version FROM policies WHERE active AND client_id IN ('', $1) ORDER BY client_id DESC LIMIT 1",
+        clientID(ctx)).Scan(&version)
+    if err == sql.ErrNoRows {
+        return &Policy{}, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return loadPolicy(ctx, version)
+}
+
+const (
+    decisionTransfer  = "transfer"
+    decisionSignature = "signature"
+)
+
+// logDecision records the final decision on a transfer or signature request.
+// Denied transfers are logged without a transfer id.
+func logDecision(ctx context.Context, kind string, transferID int64, vars map[string]interface{}, d Decision) {
+    id := sql.NullInt64{Int64: transferID, Valid: transferID != 0}
+    contextJSON, _ := json.Marshal(vars)
+    _, err := db.ExecContext(ctx, `INSERT INTO policy_decisions (kind, transfer_id, client_id, version, rule, action, reason, context)
+        VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7, $8)`, kind, id, clientID(ctx), d.Version, d.Rule, d.Action, d.Reason, string(contextJSON))
+    if err != nil {
+        log.Println("Failed to log policy decision:", err)
+    }
+}
+
+func (ws *WalletService) HandlePolicies(w http.ResponseWriter, r *http.Request) {
+    if r.Method == http.MethodPost {
+        if !requireAdmin(w, r) {
+            return
+        }
+        var body struct {
+            Source   string `json:"source"`
+            Client   string `json:"client"`
+            Activate bool   `json:"activate"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+            http.Error(w, "Invalid request", 400)
+            return
+        }
+        if _, err := compilePolicy(0, body.Source); err != nil {
+            http.Error(w, "Invalid policy: "+err.Error(), 400)
+            return
+        }
+        var version int64
+        err := db.QueryRowContext(r.Context(), "INSERT INTO policies (source, client_id) VALUES ($1, $2) RETURNING version",
+            body.Source, body.Client).Scan(&version)
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        if body.Activate {
+            if err := activatePolicy(r.Context(), version); err != nil {
+                writeError(w, err)
+                return
+            }
+        }
+        writeJSON(w, map[string]int64{"version": version})
+        return
+    }
+    
+    // Clients see the global policies and their own.
+    conds, args := tenantFilter(r.Context(), "client_id", nil, nil)
+    if len(conds) > 0 {
+        conds[0] = "(client_id = '' OR " + conds[0] + ")"
+    }
+    rows, err := db.QueryContext(r.Context(), "SELECT version, client_id, source, active, created_at FROM policies"+
+        whereClause(conds)+" ORDER BY version DESC", args...)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer rows.Close()
+    
+    versions := []PolicyVersion{}
+    for rows.Next() {
+        var v PolicyVersion
+        if err := rows.Scan(&v.Version, &v.Client, &v.Source, &v.Active, &v.CreatedAt); err != nil {
+            writeError(w, err)
+            return
+        }
+        versions = append(versions, v)
+    }
+    writeJSON(w, versions)
+}
+
+// activatePolicy makes version the active policy of the client it was
+// written for, replacing that client's previously active policy.
+func activatePolicy(ctx context.Context, version int64) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    
+    var client string
+    err = tx.QueryRow("SELECT client_id FROM policies WHERE version = $1 FOR UPDATE", version).Scan(&client)
+    if err == sql.ErrNoRows {
+        return &requestError{404, "Policy version not found"}
+    }
+    if err != nil {
+        return err
+    }
+    if _, err := tx.Exec("UPDATE policies SET active = false WHERE active AND client_id = $1", client); err != nil {
+        return err
+    }
+    if _, err := tx.Exec("UPDATE policies SET active = true WHERE version = $1", version); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func (ws *WalletService) HandleActivatePolicy(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", 405)
+        return
+    }
+    if !requireAdmin(w, r) {
+        return
+    }
+    version, err := strconv.ParseInt(r.URL.Query().Get("version"), 10, 64)
+    if err != nil {
+        http.Error(w, "Invalid version", 400)
+        return
+    }
+    if err := activatePolicy(r.Context(), version); err != nil {
+        writeError(w, err)
+        return
+    }
+    w.Write([]byte("Policy activated"))
+}
+
+// checkPolicyAccess refuses a client reading a policy version other than a
+// global one or its own.
+func checkPolicyAccess(ctx context.Context, version int64) error {
+    client := clientFromContext(ctx)
+    if client == nil || client.Admin {
+        return nil
+    }
+    var owner string
+    err := db.QueryRowContext(ctx, "SELECT client_id FROM policies WHERE version = $1", version).Scan(&owner)
+    if err == sql.ErrNoRows || err == nil && owner != "" && owner != client.ID {
+        return &requestError{404, "Policy not found"}
+    }
+    return err
+}
+
+// HandleSimulatePolicy evaluates a transfer against the given policy source,
+// a stored version, or the active policy, in that order of preference. Nothing
+// is recorded.
+func (ws *WalletService) HandleSimulatePolicy(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", 405)
+        return
+    }
+    var body SimulateRequest
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        http.Error(w, "Invalid request", 400)
+        return
+    }
+    if err := checkWalletAccess(r.Context(), body.Transfer.From); err != nil {
+        writeError(w, err)
+        return
+    }
+    
+    var p *Policy
+    var err error
+    switch {
+    case body.Source != "":
+        p, err = compilePolicy(0, body.Source)
+        if err != nil {
+            http.Error(w, "Invalid policy: "+err.Error(), 400)
+            return
+        }
+    case body.Version != 0:
+        if err = checkPolicyAccess(r.Context(), body.Version); err == nil {
+            p, err = loadPolicy(r.Context(), body.Version)
+        }
+    default:
+        p, err = activePolicy(r.Context())
+    }
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    
+    at := time.Now()
+    if body.At != nil {
+        at = *body.At
+    }
+    vars, err := policyContext(r.Context(), body.Transfer, at)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJSON(w, SimulateResponse{Decision: p.Evaluate(vars, true), Context: vars})
+}
+
+func (ws *WalletService) HandlePolicyDecisions(w http.ResponseWriter, r *http.Request) {
+    var conds []string
+    var args []interface{}
+    if id := r.URL.Query().Get("transfer_id"); id != "" {
+        args = append(args, id)
+        conds = append(conds, "transfer_id = $1")
+    }
+    conds, args = tenantFilter(r.Context(), "client_id", conds, args)
+    query := "SELECT COALESCE(transfer_id, 0), version, rule, action, reason, created_at FROM policy_decisions" +
+        whereClause(conds) + " ORDER BY id DESC LIMIT 500"
+    
+    rows, err := db.QueryContext(r.Context(), query, args...)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer rows.Close()
+    
+    type loggedDecision struct {
+        TransferID int64 `json:"transfer_id,omitempty"`
+        Decision
+        CreatedAt time.Time `json:"created_at"`
+    }
+    decisions := []loggedDecision{}
+    for rows.Next() {
+        var d loggedDecision
+        if err := rows.Scan(&d.TransferID, &d.Version, &d.Rule, &d.Action, &d.Reason, &d.CreatedAt); err != nil {
+            writeError(w, err)
+            return
+        }
+        decisions = append(decisions, d)
+    }
+    writeJSON(w, decisions)
+}
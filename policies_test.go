@@ -0,0 +1,110 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "testing"
+)
+
+func TestPolicyEvaluate(t *testing.T) {
+    p, err := compilePolicy(1, `
+        # night limit
+        deny night_limit: amount > 10 and (hour < 6 or hour >= 22)
+        hold ops: user == "ops" and not recipient_seen
+        allow treasury: "treasury" in tags
+    `)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        name string
+        vars map[string]interface{}
+        want string
+        rule string
+    }{
+        {"night", map[string]interface{}{"amount": 11.0, "hour": 23.0}, actionDeny, "night_limit"},
+        {"day", map[string]interface{}{"amount": 11.0, "hour": 12.0, "user": "", "recipient_seen": true, "tags": []string{}}, actionAllow, "default"},
+        {"client hold", map[string]interface{}{"amount": 1.0, "hour": 12.0, "user": "ops", "recipient_seen": false}, actionHold, "ops"},
+        {"tag", map[string]interface{}{"amount": 1.0, "hour": 12.0, "user": "", "recipient_seen": true, "tags": []string{"treasury"}}, actionAllow, "treasury"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            d := p.Evaluate(tt.vars, false)
+            if d.Action != tt.want || d.Rule != tt.rule {
+                t.Fatalf("got %s/%s, want %s/%s", d.Action, d.Rule, tt.want, tt.rule)
+            }
+        })
+    }
+}
+
+func TestCompilePolicyRejectsUnknownVariables(t *testing.T) {
+    if _, err := compilePolicy(0, "deny x: nonsense > 1"); err == nil {
+        t.Fatal("expected an error for an unknown variable")
+    }
+}
+
+func TestPolicyAdminEndpoints(t *testing.T) {
+    tenant := &APIClient{ID: "tenant"}
+    ws := new(WalletService)
+    if w := serve(ws.HandlePolicies, tenant, "POST", "/policies", `{"source":"allow all: true"}`); w.Code != 403 {
+        t.Errorf("policy save: status %d, want 403", w.Code)
+    }
+    if w := serve(ws.HandleActivatePolicy, tenant, "POST", "/policies/activate?version=1", ""); w.Code != 403 {
+        t.Errorf("policy activate: status %d, want 403", w.Code)
+    }
+}
+
+func TestActivePolicyPerTenant(t *testing.T) {
+    testDB(t)
+    addClient(t, &APIClient{ID: "tenant"})
+    addClient(t, &APIClient{ID: "other"})
+    var global, own int64
+    db.QueryRow("INSERT INTO policies (source) VALUES ('deny all: true') RETURNING version").Scan(&global)
+    db.QueryRow("INSERT INTO policies (source, client_id) VALUES ('hold all: true', 'tenant') RETURNING version").Scan(&own)
+    for _, v := range []int64{global, own} {
+        if err := activatePolicy(context.Background(), v); err != nil {
+            t.Fatal(err)
+        }
+    }
+    
+    for client, want := range map[string]int64{"tenant": own, "other": global} {
+        ctx := context.WithValue(context.Background(), clientContextKey, &APIClient{ID: client})
+        p, err := activePolicy(ctx)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if p.Version != want {
+            t.Errorf("%s: active version %d, want %d", client, p.Version, want)
+        }
+    }
+    if n := countRows(t, "SELECT COUNT(*) FROM policies WHERE active"); n != 2 {
+        t.Errorf("%d active policies, want the global and the tenant one", n)
+    }
+}
+
+func TestSimulatePolicyIsTenantScoped(t *testing.T) {
+    testDB(t)
+    tenant := addClient(t, &APIClient{ID: "tenant"})
+    addClient(t, &APIClient{ID: "other"})
+    mustExec(t, "INSERT INTO wallets (address, balance, client_id) VALUES ('0x1111111111111111111111111111111111111111', 5, 'other')")
+    mustExec(t, "INSERT INTO wallets (address, balance, client_id) VALUES ('0x3333333333333333333333333333333333333333', 5, 'tenant')")
+    var global, other int64
+    db.QueryRow("INSERT INTO policies (source) VALUES ('allow all: true') RETURNING version").Scan(&global)
+    db.QueryRow("INSERT INTO policies (source, client_id) VALUES ('deny all: true', 'other') RETURNING version").Scan(&other)
+    
+    ws := new(WalletService)
+    tests := []struct {
+        name string
+        body string
+        want int
+    }{
+        {"other wallet", `{"transfer":{"from":"0x1111111111111111111111111111111111111111","to":"0x2222222222222222222222222222222222222222","amount":1}}`, 403},
+        {"other policy", fmt.Sprintf(`{"version":%d,"transfer":{"from":"0x3333333333333333333333333333333333333333","to":"0x2222222222222222222222222222222222222222","amount":1}}`, other), 404},
+        {"global policy", fmt.Sprintf(`{"version":%d,"transfer":{"from":"0x3333333333333333333333333333333333333333","to":"0x2222222222222222222222222222222222222222","amount":1}}`, global), 200},
+    }
+    for _, tt := range tests {
+        if w := serve(ws.HandleSimulatePolicy, tenant, "POST", "/policies/simulate", tt.body); w.Code != tt.want {
+            t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+        }
+    }
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "unicode"
+)
+
+// A policy is a list of rules, one per line, evaluated top to bottom:
+//
+//     # comments and blank lines are ignored
+//     deny night_limit: amount > 10 and (hour < 6 or hour >= 22)
+//     hold new_recipient: not recipient_seen and amount > 1
+//     allow treasury: "treasury" in tags
+//
+// The first rule whose expression is true decides the transfer. When no rule
+// matches the transfer is allowed.
+
+const (
+    actionAllow = "allow"
+    actionDeny  = "deny"
+    actionHold  = "hold"
+)
+
+var policyVariables = map[string]bool{
+    "amount":         true,
+    "from":           true,
+    "to":             true,
+    "group":          true,
+    "tags":           true,
+    "balance":        true,
+    "user":           true,
+    "hour":           true,
+    "weekday":        true,
+    "sent_24h":       true,
+    "recipient_seen": true,
+    "priority":       true,
+    "lookalike":      true,
+    "resembles":      true,
+}
+
+var comparisonOps = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+type Rule struct {
+    Action string
+    Name   string
+    Source string
+    expr   node
+}
+
+type Policy struct {
+    Version int64
+    Rules   []Rule
+}
+
+type RuleTrace struct {
+    Rule    string `json:"rule"`
+    Matched bool   `json:"matched"`
+    Error   string `json:"error,omitempty"`
+}
+
+type Decision struct {
+    Action  string      `json:"action"`
+    Rule    string      `json:"rule"`
+    Version int64       `json:"version"`
+    Reason  string      `json:"reason"`
+    Trace   []RuleTrace `json:"trace,omitempty"`
+}
+
+func compilePolicy(version int64, source string) (*Policy, error) {
+    p := &Policy{Version: version}
+    for i, line := range strings.Split(source, "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        rule, err := parseRule(line)
+        if err != nil {
+            return nil, fmt.Errorf("line %d: %v", i+1, err)
+        }
+        p.Rules = append(p.Rules, rule)
+    }
+    return p, nil
+}
+
+func parseRule(line string) (Rule, error) {
+    colon := strings.Index(line, ":")
+    if colon < 0 {
+        return Rule{}, fmt.Errorf("expected \"<action> <name>: <expression>\"")
+    }
+    head := strings.Fields(line[:colon])
+    if len(head) != 2 {
+        return Rule{}, fmt.Errorf("expected \"<action> <name>: <expression>\"")
+    }
+    rule := Rule{Action: head[0], Name: head[1], Source: strings.TrimSpace(line[colon+1:])}
+    switch rule.Action {
+    case actionAllow, actionDeny, actionHold:
+    default:
+        return Rule{}, fmt.Errorf("unknown action %q", rule.Action)
+    }
+    
+    p := &parser{tokens: tokenize(rule.Source)}
+    expr, err := p.parseOr()
+    if err != nil {
+        return Rule{}, err
+    }
+    if t := p.peek(); t.kind == tokError {
+        return Rule{}, fmt.Errorf("%s", t.text)
+    } else if t.kind != tokEOF {
+        return Rule{}, fmt.Errorf("unexpected %q", t.text)
+    }
+    rule.expr = expr
+    return rule, nil
+}
+
+// Evaluate returns the decision of the first matching rule. A rule that fails
+// to evaluate denies the transfer rather than being skipped. With trace set,
+// every rule that was considered is reported.
+func (p *Policy) Evaluate(vars map[string]interface{}, trace bool) Decision {
+    d := Decision{Action: actionAllow, Rule: "default", Version: p.Version, Reason: "no rule matched"}
+    for _, rule := range p.Rules {
+        v, err := rule.expr.eval(vars)
+        matched, ok := v.(bool)
+        if err == nil && !ok {
+            err = fmt.Errorf("expression is not a condition")
+        }
+        if trace {
+            t := RuleTrace{Rule: rule.Name, Matched: matched}
+            if err != nil {
+                t.Error = err.Error()
+            }
+            d.Trace = append(d.Trace, t)
+        }
+        if err != nil {
+            d.Action, d.Rule = actionDeny, rule.Name
+            d.Reason = fmt.Sprintf("rule %s failed to evaluate: %v", rule.Name, err)
+            return d
+        }
+        if matched {
+            d.Action, d.Rule = rule.Action, rule.Name
+            d.Reason = fmt.Sprintf("rule %s matched: %s", rule.Name, rule.Source)
+            return d
+        }
+    }
+    return d
+}
+
+type tokenKind int
+
+const (
+    tokEOF tokenKind = iota
+    tokNumber
+    tokString
+    tokIdent
+    tokOp
+    tokError
+)
+
+type token struct {
+    kind tokenKind
+    text string
+}
+
+func tokenize(s string) []token {
+    var tokens []token
+    for i := 0; i < len(s); {
+        c := rune(s[i])
+        switch {
+        case unicode.IsSpace(c):
+            i++
+        case unicode.IsDigit(c):
+            j := i
+            for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.') {
+                j++
+            }
+            tokens = append(tokens, token{tokNumber, s[i:j]})
+            i = j
+        case unicode.IsLetter(c) || c == '_':
+            j := i
+            for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_') {
+                j++
+            }
+            tokens = append(tokens, token{tokIdent, s[i:j]})
+            i = j
+        case c == '"':
+            j := strings.IndexByte(s[i+1:], '"')
+            if j < 0 {
+                return append(tokens, token{tokError, "unterminated string"})
+            }
+            tokens = append(tokens, token{tokString, s[i+1 : i+1+j]})
+            i += j + 2
+        default:
+            op := string(c)
+            if i+1 < len(s) && strings.Contains("=!<>", op) && s[i+1] == '=' {
+                op += "="
+            }
+            if !strings.Contains("== != < <= > >= ( ) [ ] ,", op) || op == "=" || op == "!" {
+                return append(tokens, token{tokError, "unexpected character " + strconv.Quote(op)})
+            }
+            tokens = append(tokens, token{tokOp, op})
+            i += len(op)
+        }
+    }
+    return append(tokens, token{tokEOF, ""})
+}
+
+type node interface {
+    eval(vars map[string]interface{}) (interface{}, error)
+}
+
+type literalExpr struct{ value interface{} }
+type variableExpr struct{ name string }
+type listExpr struct{ items []node }
+type notExpr struct{ x node }
+type binaryExpr struct {
+    op   string
+    l, r node
+}
+
+type parser struct {
+    tokens []token
+    pos    int
+}
+
+func (p *parser) peek() token {
+    return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+    t := p.tokens[p.pos]
+    if t.kind != tokEOF {
+        p.pos++
+    }
+    return t
+}
+
+func (p *parser) isKeyword(word string) bool {
+    t := p.peek()
+    return t.kind == tokIdent && t.text == word
+}
+
+func (p *parser) expect(op string) error {
+    if t := p.next(); t.kind != tokOp || t.text != op {
+        return fmt.Errorf("expected %q", op)
+    }
+    return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+    l, err := p.parseAnd()
+    for err == nil && p.isKeyword("or") {
+        p.next()
+        var r node
+        r, err = p.parseAnd()
+        l = &binaryExpr{"or", l, r}
+    }
+    return l, err
+}
+
+func (p *parser) parseAnd() (node, error) {
+    l, err := p.parseUnary()
+    for err == nil && p.isKeyword("and") {
+        p.next()
+        var r node
+        r, err = p.parseUnary()
+        l = &binaryExpr{"and", l, r}
+    }
+    return l, err
+}
+
+func (p *parser) parseUnary() (node, error) {
+    if p.isKeyword("not") {
+        p.next()
+        x, err := p.parseUnary()
+        return &notExpr{x}, err
+    }
+    return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+    l, err := p.parsePrimary()
+    if err != nil {
+        return nil, err
+    }
+    t := p.peek()
+    if (t.kind == tokOp && comparisonOps[t.text]) || p.isKeyword("in") {
+        p.next()
+        r, err := p.parsePrimary()
+        return &binaryExpr{t.text, l, r}, err
+    }
+    return l, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+    t := p.next()
+    switch t.kind {
+    case tokNumber:
+        f, err := strconv.ParseFloat(t.text, 64)
+        if err != nil {
+            return nil, fmt.Errorf("invalid number %q", t.text)
+        }
+        return &literalExpr{f}, nil
+    case tokString:
+        return &literalExpr{t.text}, nil
+    case tokIdent:
+        switch t.text {
+        case "true":
+            return &literalExpr{true}, nil
+        case "false":
+            return &literalExpr{false}, nil
+        }
+        if !policyVariables[t.text] {
+            return nil, fmt.Errorf("unknown variable %q", t.text)
+        }
+        return &variableExpr{t.text}, nil
+    case tokOp:
+        switch t.text {
+        case "(":
+            x, err := p.parseOr()
+            if err != nil {
+                return nil, err
+            }
+            return x, p.expect(")")
+        case "[":
+            l := &listExpr{}
+            for !(p.peek().kind == tokOp && p.peek().text == "]") {
+                if len(l.items) > 0 {
+                    if err := p.expect(","); err != nil {
+                        return nil, err
+                    }
+                }
+                item, err := p.parsePrimary()
+                if err != nil {
+                    return nil, err
+                }
+                l.items = append(l.items, item)
+            }
+            p.next()
+            return l, nil
+        }
+    case tokError:
+        return nil, fmt.Errorf("%s", t.text)
+    case tokEOF:
+        return nil, fmt.Errorf("unexpected end of expression")
+    }
+    return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+func (n *literalExpr) eval(vars map[string]interface{}) (interface{}, error) {
+    return n.value, nil
+}
+
+func (n *variableExpr) eval(vars map[string]interface{}) (interface{}, error) {
+    v, ok := vars[n.name]
+    if !ok {
+        return nil, fmt.Errorf("%s is not available", n.name)
+    }
+    return v, nil
+}
+
+func (n *listExpr) eval(vars map[string]interface{}) (interface{}, error) {
+    var items []string
+    for _, item := range n.items {
+        v, err := item.eval(vars)
+        if err != nil {
+            return nil, err
+        }
+        s, ok := v.(string)
+        if !ok {
+            return nil, fmt.Errorf("lists may only contain strings")
+        }
+        items = append(items, s)
+    }
+    return items, nil
+}
+
+func (n *notExpr) eval(vars map[string]interface{}) (interface{}, error) {
+    v, err := n.x.eval(vars)
+    if err != nil {
+        return nil, err
+    }
+    b, ok := v.(bool)
+    if !ok {
+        return nil, fmt.Errorf("not requires a condition")
+    }
+    return !b, nil
+}
+
+func (n *binaryExpr) eval(vars map[string]interface{}) (interface{}, error) {
+    l, err := n.l.eval(vars)
+    if err != nil {
+        return nil, err
+    }
+    
+    if n.op == "and" || n.op == "or" {
+        lb, ok := l.(bool)
+        if !ok {
+            return nil, fmt.Errorf("%s requires conditions", n.op)
+        }
+        if (n.op == "and" && !lb) || (n.op == "or" && lb) {
+            return lb, nil
+        }
+        r, err := n.r.eval(vars)
+        if err != nil {
+            return nil, err
+        }
+        rb, ok := r.(bool)
+        if !ok {
+            return nil, fmt.Errorf("%s requires conditions", n.op)
+        }
+        return rb, nil
+    }
+    
+    r, err := n.r.eval(vars)
+    if err != nil {
+        return nil, err
+    }
+    
+    _, llist := l.([]string)
+    _, rlist := r.([]string)
+    switch n.op {
+    case "==", "!=":
+        if llist || rlist {
+            return nil, fmt.Errorf("%s cannot compare lists", n.op)
+        }
+        return (l == r) == (n.op == "=="), nil
+    case "in":
+        s, ok := l.(string)
+        items, ok2 := r.([]string)
+        if !ok || !ok2 {
+            return nil, fmt.Errorf("in requires a string and a list")
+        }
+        for _, item := range items {
+            if item == s {
+                return true, nil
+            }
+        }
+        return false, nil
+    }
+    
+    lf, ok := l.(float64)
+    rf, ok2 := r.(float64)
+    if !ok || !ok2 {
+        return nil, fmt.Errorf("%s requires numbers", n.op)
+    }
+    switch n.op {
+    case "<":
+        return lf < rf, nil
+    case "<=":
+        return lf <= rf, nil
+    case ">":
+        return lf > rf, nil
+    default:
+        return lf >= rf, nil
+    }
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "math/big"
+
+    "github.com/ethereum/go-ethereum/common"
+)
+
+var errChainInsufficientFunds = errors.New("On-chain balance does not cover amount plus fees")
+
+// preflightCheck verifies that the transfer's chain agrees with the ledger
+// before a transfer is accepted. The lower of the latest and pending on-chain
+// balance must cover the amount and its maximum fee on top of every transfer
+// from the same address on the same chain that is queued or held. Transfers already being processed are
+// left out: once broadcast they are reflected in the pending balance.
+func preflightCheck(ctx context.Context, conn *chainConn, req TransactionRequest) error {
+    from := common.HexToAddress(req.From)
+    
+    confirmed, err := conn.eth.BalanceAt(ctx, from, nil)
+    if err != nil {
+        return err
+    }
+    pending, err := conn.eth.PendingBalanceAt(ctx, from)
+    if err != nil {
+        return err
+    }
+    available := confirmed
+    if pending.Cmp(available) < 0 {
+        available = pending
+    }
+    
+    fees, err := currentFees(ctx, conn)
+    if err != nil {
+        return err
+    }
+    required := new(big.Int).Add(req.weiAmount(), laneFor(req.Priority).maxFee(fees, req.gas()))
+    queued, err := queuedOutgoing(ctx, conn, req.From, fees)
+    if err != nil {
+        return err
+    }
+    required.Add(required, queued)
+    
+    if available.Cmp(required) < 0 {
+        return errChainInsufficientFunds
+    }
+    return nil
+}
+
+// queuedOutgoing sums the amounts and maximum fees of the transfers from
+// address on conn's chain that have not been sent yet, each priced in its own lane and with
+// its own gas limit at the quoted fees. Deferred transfers are pending, so
+// they are included.
+func queuedOutgoing(ctx context.Context, conn *chainConn, address string, fees feeQuote) (*big.Int, error) {
+    rows, err := db.QueryContext(ctx, `SELECT `+amountWeiSQL+`, priority, COALESCE(gas, 0) FROM transfers
+        WHERE from_address = $1 AND chain_id = $2 AND status IN ('pending', 'held')`, address, conn.key)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    
+    total := new(big.Int)
+    for rows.Next() {
+        var queued TransactionRequest
+        var wei string
+        if err := rows.Scan(&wei, &queued.Priority, &queued.Gas); err != nil {
+            return nil, err
+        }
+        total.Add(total, parseWei(wei))
+        total.Add(total, laneFor(queued.Priority).maxFee(fees, queued.gas()))
+    }
+    return total, rows.Err()
+}
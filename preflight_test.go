@@ -0,0 +1,59 @@
+package main
+
+import (
+    "context"
+    "math/big"
+    "testing"
+)
+
+func TestPreflightCheck(t *testing.T) {
+    testDB(t)
+    node := testNode(t)
+    fees := testFees(t, node, big.NewInt(30e9), big.NewInt(1e9))
+    from := "0x1111111111111111111111111111111111111111"
+    
+    type queued struct {
+        status   string
+        priority string
+        gas      int64
+    }
+    tests := []struct {
+        name   string
+        queued []queued
+    }{
+        {"nothing queued", nil},
+        {"pending and held count", []queued{{"pending", "normal", 0}, {"held", "urgent", 0}}},
+        {"own lane and gas", []queued{{"pending", "urgent", 90000}, {"pending", "bulk", 0}}},
+        {"processing is not counted", []queued{{"processing", "urgent", 90000}}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            mustExec(t, "DELETE FROM transfers")
+            required := new(big.Int).Add(toWei(1), laneFor(priorityNormal).maxFee(fees, gasLimit))
+            for _, q := range tt.queued {
+                mustExec(t, `INSERT INTO transfers (from_address, to_address, amount, status, priority, gas)
+                    VALUES ($1, $1, 0.5, $2, $3, NULLIF($4, 0))`, from, q.status, q.priority, q.gas)
+                if q.status == "processing" {
+                    continue
+                }
+                gas := uint64(gasLimit)
+                if q.gas > 0 {
+                    gas = uint64(q.gas)
+                }
+                required.Add(required, toWei(0.5))
+                required.Add(required, laneFor(q.priority).maxFee(fees, gas))
+            }
+            req := TransactionRequest{From: from, To: from, Amount: 1, Priority: priorityNormal}
+    
+            for _, balance := range []*big.Int{required, new(big.Int).Sub(required, big.NewInt(1))} {
+                node.respond("eth_getBalance", hexBig(balance))
+                err := preflightCheck(context.Background(), connectedChain(t, ""), req)
+                if enough := balance == required; enough && err != nil {
+                    t.Fatalf("balance %v: unexpected error %v", balance, err)
+                } else if !enough && err != errChainInsufficientFunds {
+                    t.Fatalf("balance %v: got %v, want %v", balance, err, errChainInsufficientFunds)
+                }
+            }
+        })
+    }
+}
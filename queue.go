@@ -0,0 +1,312 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "log"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Accepted transfers wait in a queue per From address and are executed one
+// at a time, urgent lanes first and then in queue order: by queue_position
+// when an operator has moved them, otherwise by id. Moves therefore reorder
+// transfers within the same lane. Transfers that have waited long enough
+// count as a lane higher (see lanes.go). Nonces are only allocated when a transfer is claimed
+// for broadcast, so moving, holding or dropping queued transfers never
+// leaves a nonce to reassign. Transfers deferred for a lower base fee are
+// skipped until the fee or their deadline releases them (see heads.go).
+
+type transferQueue struct {
+    mu      sync.Mutex
+    running map[string]bool
+    again   map[string]bool
+}
+
+var queue = &transferQueue{running: map[string]bool{}, again: map[string]bool{}}
+
+// drainRetryDelay is how long a worker waits before reading its queue again
+// after the database failed.
+var drainRetryDelay = 5 * time.Second
+
+type QueuedTransfer struct {
+    Position  int       `json:"position"`
+    ID        int64     `json:"id"`
+    To        string    `json:"to"`
+    Amount    float64   `json:"amount"`
+    Priority  string    `json:"priority"`
+    Status    string    `json:"status"`
+    OnHold    bool      `json:"on_hold"`
+    Deferred  bool      `json:"deferred"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+var queueOrder = laneRank + ", COALESCE(queue_position, id), id"
+
+// wake makes sure a worker is draining the queue of from.
+func (q *transferQueue) wake(from string) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if q.running[from] {
+        q.again[from] = true
+        return
+    }
+    q.running[from] = true
+    go q.drain(from)
+}
+
+func (q *transferQueue) drain(from string) {
+    for {
+        // Wait out an open breaker rather than claiming transfers that
+        // would only be put back.
+        if wait := chainBreaker.retryAfter(); wait > 0 {
+            time.Sleep(wait)
+            continue
+        }
+        priority, err := nextPriority(from)
+        if err != nil && err != sql.ErrNoRows {
+            // Nothing else would wake this queue again, so keep at it.
+            log.Println("Failed to read queue for", from, err)
+            time.Sleep(drainRetryDelay)
+            continue
+        }
+        if err != nil {
+            q.mu.Lock()
+            if q.again[from] {
+                delete(q.again, from)
+                q.mu.Unlock()
+                continue
+            }
+            delete(q.running, from)
+            q.mu.Unlock()
+            return
+        }
+        
+        l := laneFor(priority)
+        l.acquire()
+        id, req, err := claimNextTransfer(from, l.name)
+        if err == nil {
+            processTransaction(id, req)
+        } else if err != sql.ErrNoRows {
+            log.Println("Failed to claim transfer for", from, err)
+        }
+        l.release()
+    }
+}
+
+// resume wakes a worker for every address with queued transfers.
+func (q *transferQueue) resume() error {
+    rows, err := db.Query("SELECT DISTINCT from_address FROM transfers WHERE status = 'pending'")
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var from string
+        if err := rows.Scan(&from); err != nil {
+            return err
+        }
+        q.wake(from)
+    }
+    return rows.Err()
+}
+
+func nextPriority(from string) (string, error) {
+    var priority string
+    err := db.QueryRow("SELECT priority FROM transfers WHERE from_address = $1 AND status = 'pending' AND NOT on_hold AND "+deferralReleased(2)+
+        " ORDER BY "+queueOrder+" LIMIT 1", from, heads.baseFeeParam()).Scan(&priority)
+    return priority, err
+}
+
+// claimNextTransfer marks the first transfer of the given lane in the queue
+// of from as processing and returns it.
+func claimNextTransfer(from, priority string) (int64, TransactionRequest, error) {
+    var id int64
+    var gas sql.NullInt64
+    var wei string
+    req := TransactionRequest{From: from, Priority: priority}
+    err := db.QueryRow(`UPDATE transfers SET status = 'processing', version = version + 1, claimed_at = now()
+        WHERE id = (SELECT id FROM transfers WHERE from_address = $1 AND status = 'pending' AND NOT on_hold AND priority = $2
+            AND `+deferralReleased(3)+` ORDER BY `+queueOrder+` LIMIT 1 FOR UPDATE SKIP LOCKED)
+        RETURNING id, to_address, amount, `+amountWeiSQL+`, COALESCE(data, ''), gas, COALESCE(client_id, ''), chain_id`, from, priority, heads.baseFeeParam()).
+        Scan(&id, &req.To, &req.Amount, &wei, &req.Data, &gas, &req.ClientID, &req.ChainID)
+    req.Gas, req.wei = uint64(gas.Int64), parseWei(wei)
+    return id, req, err
+}
+
+func (ws *WalletService) HandleQueue(w http.ResponseWriter, r *http.Request) {
+    if !requireAdmin(w, r) {
+        return
+    }
+    rows, err := db.QueryContext(r.Context(), `SELECT id, to_address, amount, priority, status, on_hold, NOT `+deferralReleased(2)+`, created_at
+        FROM transfers WHERE from_address = $1 AND status IN ('processing', 'pending')
+        ORDER BY status = 'pending', `+queueOrder, r.URL.Query().Get("from"), heads.baseFeeParam())
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer rows.Close()
+    
+    queued := []QueuedTransfer{}
+    for rows.Next() {
+        t := QueuedTransfer{Position: len(queued)}
+        if err := rows.Scan(&t.ID, &t.To, &t.Amount, &t.Priority, &t.Status, &t.OnHold, &t.Deferred, &t.CreatedAt); err != nil {
+            writeError(w, err)
+            return
+        }
+        queued = append(queued, t)
+    }
+    writeJSON(w, queued)
+}
+
+// queuedFrom returns the From address of a transfer that is still waiting in
+// the queue.
+func queuedFrom(ctx context.Context, id int64) (string, error) {
+    var from string
+    err := db.QueryRowContext(ctx, "SELECT from_address FROM transfers WHERE id = $1 AND status = 'pending'", id).Scan(&from)
+    if err == sql.ErrNoRows {
+        return "", &requestError{404, "No queued transfer with that id"}
+    }
+    return from, err
+}
+
+func queueTransferID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", 405)
+        return 0, false
+    }
+    if !requireAdmin(w, r) {
+        return 0, false
+    }
+    id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+    if err != nil {
+        http.Error(w, "Invalid id", 400)
+        return 0, false
+    }
+    return id, true
+}
+
+// HandleQueueMove moves a queued transfer directly ahead of the one given by
+// before, or to the front of its queue when before is omitted.
+func (ws *WalletService) HandleQueueMove(w http.ResponseWriter, r *http.Request) {
+    id, ok := queueTransferID(w, r)
+    if !ok {
+        return
+    }
+    from, err := queuedFrom(r.Context(), id)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    
+    var position float64
+    if before := r.URL.Query().Get("before"); before != "" {
+        err = db.QueryRowContext(r.Context(), `SELECT (COALESCE(b.queue_position, b.id) + COALESCE((
+                SELECT MAX(COALESCE(p.queue_position, p.id)) FROM transfers p
+                WHERE p.from_address = b.from_address AND p.status = 'pending' AND p.id <> $2
+                AND COALESCE(p.queue_position, p.id) < COALESCE(b.queue_position, b.id)
+            ), COALESCE(b.queue_position, b.id) - 2)) / 2
+            FROM transfers b WHERE b.id = $1 AND b.from_address = $3 AND b.status = 'pending'`, before, id, from).Scan(&position)
+        if err == sql.ErrNoRows {
+            http.Error(w, "No queued transfer from the same address with that id", 404)
+            return
+        }
+    } else {
+        err = db.QueryRowContext(r.Context(), "SELECT MIN(COALESCE(queue_position, id)) - 1 FROM transfers WHERE from_address = $1 AND status = 'pending'",
+            from).Scan(&position)
+    }
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    
+    res, err := db.ExecContext(r.Context(), "UPDATE transfers SET queue_position = $2 WHERE id = $1 AND status = 'pending'", id, position)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        http.Error(w, "Transfer is no longer queued", 409)
+        return
+    }
+    w.Write([]byte("Transfer moved"))
+}
+
+func (ws *WalletService) HandleQueueHold(w http.ResponseWriter, r *http.Request) {
+    setQueueHold(w, r, true)
+}
+
+func (ws *WalletService) HandleQueueRelease(w http.ResponseWriter, r *http.Request) {
+    setQueueHold(w, r, false)
+}
+
+func setQueueHold(w http.ResponseWriter, r *http.Request, hold bool) {
+    id, ok := queueTransferID(w, r)
+    if !ok {
+        return
+    }
+    var from string
+    err := db.QueryRowContext(r.Context(), "UPDATE transfers SET on_hold = $2 WHERE id = $1 AND status = 'pending' RETURNING from_address", id, hold).Scan(&from)
+    if err == sql.ErrNoRows {
+        http.Error(w, "No queued transfer with that id", 404)
+        return
+    }
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if hold {
+        w.Write([]byte("Transfer held"))
+        return
+    }
+    queue.wake(from)
+    w.Write([]byte("Transfer released"))
+}
+
+// HandleQueueDrop removes a transfer that has not been claimed for broadcast.
+// Dropped transfers no longer count as pending outgoing funds.
+func (ws *WalletService) HandleQueueDrop(w http.ResponseWriter, r *http.Request) {
+    id, ok := queueTransferID(w, r)
+    if !ok {
+        return
+    }
+    err := finishQueuedTransfer(r.Context(), id, "UPDATE transfers SET status = 'dropped', version = version + 1 WHERE id = $1 AND status = 'pending'")
+    if err == sql.ErrNoRows {
+        http.Error(w, "No queued transfer with that id", 404)
+        return
+    }
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    w.Write([]byte("Transfer dropped"))
+}
+
+// finishQueuedTransfer gives transfer id, which was never sent, its final
+// status with update ($1 being the id and args the rest) and queues its
+// callback in the same transaction. It returns sql.ErrNoRows when update
+// changed nothing.
+func finishQueuedTransfer(ctx context.Context, id int64, update string, args ...interface{}) error {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    res, err := tx.ExecContext(ctx, update, append([]interface{}{id}, args...)...)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return sql.ErrNoRows
+    }
+    if err := queueCallback(ctx, tx, id); err != nil {
+        return err
+    }
+    if err := tx.Commit(); err != nil {
+        return err
+    }
+    wakeCallbacks()
+    return nil
+}
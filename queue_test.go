@@ -0,0 +1,80 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "net/http"
+    "testing"
+)
+
+func TestQueueOrder(t *testing.T) {
+    testDB(t)
+    from := "0x1111111111111111111111111111111111111111"
+    // A running worker keeps the handlers from draining the queue.
+    queue.mu.Lock()
+    queue.running[from] = true
+    queue.mu.Unlock()
+    defer func() {
+        queue.mu.Lock()
+        delete(queue.running, from)
+        delete(queue.again, from)
+        queue.mu.Unlock()
+    }()
+    
+    ids := map[string]int64{}
+    for _, name := range []string{"held", "second", "urgent", "moved", "dropped"} {
+        priority := priorityNormal
+        if name == "urgent" {
+            priority = priorityUrgent
+        }
+        var id int64
+        db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status, priority)
+            VALUES ($1, '0x2222222222222222222222222222222222222222', 1, 'pending', $2) RETURNING id`, from, priority).Scan(&id)
+        ids[name] = id
+    }
+    
+    admin := &APIClient{ID: "admin", Admin: true}
+    ws := new(WalletService)
+    for _, call := range []struct {
+        handler http.HandlerFunc
+        target  string
+    }{
+        {ws.HandleQueueMove, fmt.Sprintf("/queue/move?id=%d&before=%d", ids["moved"], ids["second"])},
+        {ws.HandleQueueHold, fmt.Sprintf("/queue/hold?id=%d", ids["held"])},
+        {ws.HandleQueueDrop, fmt.Sprintf("/queue/drop?id=%d", ids["dropped"])},
+    } {
+        if w := serve(call.handler, &APIClient{ID: "tenant"}, "POST", call.target, ""); w.Code != 403 {
+            t.Errorf("%s as a tenant: status %d, want 403", call.target, w.Code)
+        }
+        if w := serve(call.handler, admin, "POST", call.target, ""); w.Code != 200 {
+            t.Fatalf("%s: status %d, want 200 (%s)", call.target, w.Code, w.Body)
+        }
+    }
+    
+    // Urgent transfers go first, then the normal lane in queue order with
+    // the moved transfer ahead of the one it was moved before. Held and
+    // dropped transfers are never claimed.
+    for _, want := range []string{"urgent", "moved", "second"} {
+        priority, err := nextPriority(from)
+        if err != nil {
+            t.Fatal(err)
+        }
+        id, _, err := claimNextTransfer(from, priority)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if id != ids[want] {
+            t.Fatalf("claimed transfer %d, want %s (%d)", id, want, ids[want])
+        }
+    }
+    if _, err := nextPriority(from); err != sql.ErrNoRows {
+        t.Fatalf("got %v, want the queue to be empty", err)
+    }
+    
+    if code := serve(ws.HandleQueueRelease, admin, "POST", fmt.Sprintf("/queue/release?id=%d", ids["held"]), "").Code; code != 200 {
+        t.Fatalf("release: status %d, want 200", code)
+    }
+    if id, _, err := claimNextTransfer(from, priorityNormal); err != nil || id != ids["held"] {
+        t.Fatalf("claimed %d (%v), want the released transfer", id, err)
+    }
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "html/template"
+    "math/big"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/ethereum/go-ethereum"
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/core/types"
+)
+
+// Receipts document a single transfer for customers and support: what was
+// sent, between whom, what it cost and where to see it on the chain's
+// explorer. They are served as JSON or as a self-contained HTML page meant
+// to be printed or saved as PDF from the browser.
+
+type TransferReceipt struct {
+    TransferID    int64      `json:"transfer_id"`
+    Status        string     `json:"status"`
+    Chain         string     `json:"chain"`
+    ChainID       int64      `json:"chain_id"`
+    From          string     `json:"from"`
+    To            string     `json:"to"`
+    Amount        Amount     `json:"amount"`
+    Fee           *Amount    `json:"fee,omitempty"`
+    TxHash        string     `json:"tx_hash,omitempty"`
+    Block         int64      `json:"block,omitempty"`
+    SubmittedAt   time.Time  `json:"submitted_at"`
+    BroadcastAt   *time.Time `json:"broadcast_at,omitempty"`
+    MinedAt       *time.Time `json:"mined_at,omitempty"`
+    WaitSeconds   float64    `json:"confirmation_seconds,omitempty"`
+    Confirmations uint64     `json:"confirmations,omitempty"`
+    TxURL         string     `json:"tx_url,omitempty"`
+    FromURL       string     `json:"from_url,omitempty"`
+    ToURL         string     `json:"to_url,omitempty"`
+}
+
+var receiptPage = template.Must(template.New("receipt").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Transfer {{.TransferID}}</title>
+<style>body{font-family:sans-serif;max-width:42em;margin:2em auto}th{text-align:left;padding-right:2em}td{font-family:monospace;word-break:break-all}</style>
+</head><body>
+<h1>Transfer receipt #{{.TransferID}}</h1>
+<table>
+<tr><th>Status</th><td>{{.Status}}</td></tr>
+<tr><th>Network</th><td>{{.Chain}} ({{.ChainID}})</td></tr>
+<tr><th>From</th><td>{{if .FromURL}}<a href="{{.FromURL}}">{{.From}}</a>{{else}}{{.From}}{{end}}</td></tr>
+<tr><th>To</th><td>{{if .ToURL}}<a href="{{.ToURL}}">{{.To}}</a>{{else}}{{.To}}{{end}}</td></tr>
+<tr><th>Amount</th><td>{{.Amount.Value}} {{.Amount.Unit}}</td></tr>
+{{if .Fee}}<tr><th>Network fee</th><td>{{.Fee.Value}} {{.Fee.Unit}}</td></tr>{{end}}
+<tr><th>Submitted</th><td>{{.SubmittedAt.UTC.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+{{if .BroadcastAt}}<tr><th>Broadcast</th><td>{{.BroadcastAt.UTC.Format "2006-01-02 15:04:05 MST"}}</td></tr>{{end}}
+{{if .MinedAt}}<tr><th>Confirmed</th><td>{{.MinedAt.UTC.Format "2006-01-02 15:04:05 MST"}}{{if .BroadcastAt}} (after {{printf "%.0f" .WaitSeconds}}s){{end}}</td></tr>{{end}}
+{{if .Block}}<tr><th>Block</th><td>{{.Block}}{{if .Confirmations}} ({{.Confirmations}} confirmations){{end}}</td></tr>{{end}}
+{{if .TxHash}}<tr><th>Transaction</th><td>{{if .TxURL}}<a href="{{.TxURL}}">{{.TxHash}}</a>{{else}}{{.TxHash}}{{end}}</td></tr>{{end}}
+</table>
+</body></html>
+`))
+
+// effectiveGasPrice is what the transaction paid per gas. Nodes from before
+// London leave it out of receipts; it is then the gas price, or for a
+// dynamic fee transaction what the block's base fee made of its caps.
+func effectiveGasPrice(receipt *types.Receipt, tx *types.Transaction, baseFee *big.Int) *big.Int {
+    if receipt.EffectiveGasPrice != nil {
+        return receipt.EffectiveGasPrice
+    }
+    if baseFee == nil || tx.Type() == types.LegacyTxType {
+        return tx.GasPrice()
+    }
+    price := new(big.Int).Add(baseFee, tx.GasTipCap())
+    if price.Cmp(tx.GasFeeCap()) > 0 {
+        return tx.GasFeeCap()
+    }
+    return price
+}
+
+// transferReceipt describes transfer id as the chain has it. A reverted
+// transaction is reported as failed even before the saga watcher has failed
+// the transfer, and the time to confirmation runs from the broadcast.
+func transferReceipt(ctx context.Context, id int64, client string) (*TransferReceipt, error) {
+    r := &TransferReceipt{TransferID: id}
+    var amount, owner string
+    var key int64
+    err := db.QueryRowContext(ctx, `SELECT status, from_address, to_address, `+amountWeiSQL+`, COALESCE(tx_hash, ''), created_at, COALESCE(client_id, ''),
+        chain_id FROM transfers WHERE id = $1`, id).Scan(&r.Status, &r.From, &r.To, &amount, &r.TxHash, &r.SubmittedAt, &owner, &key)
+    if err == sql.ErrNoRows {
+        return nil, &requestError{404, "Transfer not found"}
+    }
+    if err != nil {
+        return nil, err
+    }
+    if client != "" && owner != client {
+        return nil, &requestError{404, "Transfer not found"}
+    }
+    
+    chain, err := openChain(ctx, owner, key)
+    if err != nil {
+        return nil, err
+    }
+    r.Chain, r.ChainID = chain.Name, chain.ChainID
+    r.Amount = newAmount(parseWei(amount), chain.Currency.Symbol, chain.Currency.Decimals)
+    r.FromURL, r.ToURL, r.TxURL = chain.addressURL(r.From), chain.addressURL(r.To), chain.txURL(r.TxHash)
+    if r.TxHash == "" {
+        return r, nil
+    }
+    
+    var broadcast time.Time
+    err = db.QueryRowContext(ctx, "SELECT created_at FROM transfer_steps WHERE transfer_id = $1 AND step = $2", id, stepBroadcast).Scan(&broadcast)
+    if err == nil {
+        r.BroadcastAt = &broadcast
+    } else if err != sql.ErrNoRows {
+        return nil, err
+    }
+    
+    hash := common.HexToHash(r.TxHash)
+    receipt, err := chain.eth.TransactionReceipt(ctx, hash)
+    if err == ethereum.NotFound {
+        return r, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if receipt.Status != types.ReceiptStatusSuccessful {
+        r.Status = "failed"
+    }
+    r.Block = receipt.BlockNumber.Int64()
+    var baseFee *big.Int
+    if header, err := chain.eth.HeaderByNumber(ctx, receipt.BlockNumber); err == nil {
+        mined := time.Unix(int64(header.Time), 0)
+        r.MinedAt, baseFee = &mined, header.BaseFee
+        if r.BroadcastAt != nil {
+            r.WaitSeconds = mined.Sub(*r.BroadcastAt).Seconds()
+        }
+    }
+    price := receipt.EffectiveGasPrice
+    if price == nil {
+        tx, _, err := chain.eth.TransactionByHash(ctx, hash)
+        if err != nil {
+            return nil, err
+        }
+        price = effectiveGasPrice(receipt, tx, baseFee)
+    }
+    feeAmount := newAmount(new(big.Int).Mul(price, new(big.Int).SetUint64(receipt.GasUsed)), chain.Currency.Symbol, chain.Currency.Decimals)
+    r.Fee = &feeAmount
+    if head, err := chain.eth.BlockNumber(ctx); err == nil && head >= receipt.BlockNumber.Uint64() {
+        r.Confirmations = head - receipt.BlockNumber.Uint64() + 1
+    }
+    return r, nil
+}
+
+// HandleTransferReceipt serves the receipt of ?id= as JSON, or as an HTML
+// document with ?format=html. Non-admin clients only see their own transfers.
+func (ws *WalletService) HandleTransferReceipt(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+    if err != nil {
+        http.Error(w, "Invalid id", 400)
+        return
+    }
+    client := clientID(r.Context())
+    if c := clientFromContext(r.Context()); c != nil && c.Admin {
+        client = ""
+    }
+    receipt, err := transferReceipt(r.Context(), id, client)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    
+    name := "receipt-" + strconv.FormatInt(id, 10)
+    if r.URL.Query().Get("format") == "html" {
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.html"`)
+        receiptPage.Execute(w, receipt)
+        return
+    }
+    w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.json"`)
+    writeJSON(w, receipt)
+}
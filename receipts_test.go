@@ -0,0 +1,90 @@
+package main
+
+import (
+    "context"
+    "math/big"
+    "testing"
+
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/core/types"
+    "github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestTransferReceipt(t *testing.T) {
+    key, err := crypto.GenerateKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    to := common.HexToAddress("0x2222222222222222222222222222222222222222")
+    gwei := func(n int64) *big.Int { return new(big.Int).Mul(big.NewInt(n), big.NewInt(1e9)) }
+    tests := []struct {
+        name      string
+        tx        types.TxData
+        status    uint64
+        effective *big.Int
+        fee       string
+        want      string
+    }{
+        {"paid", &types.DynamicFeeTx{GasTipCap: gwei(2), GasFeeCap: gwei(30)}, types.ReceiptStatusSuccessful, gwei(11), "0.000231", "completed"},
+        {"no effective price, legacy", &types.LegacyTx{GasPrice: gwei(7)}, types.ReceiptStatusSuccessful, nil, "0.000147", "completed"},
+        {"no effective price, dynamic", &types.DynamicFeeTx{GasTipCap: gwei(2), GasFeeCap: gwei(30)}, types.ReceiptStatusSuccessful, nil, "0.000252", "completed"},
+        {"reverted", &types.DynamicFeeTx{GasTipCap: gwei(2), GasFeeCap: gwei(30)}, types.ReceiptStatusFailed, gwei(11), "0.000231", "failed"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            testDB(t)
+            node := testNode(t)
+            switch tx := tt.tx.(type) {
+            case *types.DynamicFeeTx:
+                tx.ChainID, tx.Gas, tx.To = chainID, 21000, &to
+            case *types.LegacyTx:
+                tx.Gas, tx.To = 21000, &to
+            }
+            tx, err := types.SignNewTx(key, types.LatestSignerForChainID(chainID), tt.tx)
+            if err != nil {
+                t.Fatal(err)
+            }
+            var id int64
+            err = db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status, tx_hash, created_at)
+                VALUES ('0x1111111111111111111111111111111111111111', $1, 1, 'completed', $2, now() - interval '1 hour') RETURNING id`,
+                to.Hex(), tx.Hash().Hex()).Scan(&id)
+            if err != nil {
+                t.Fatal(err)
+            }
+            mustExec(t, "INSERT INTO transfer_steps (transfer_id, step, created_at) VALUES ($1, $2, now() - interval '30 seconds')", id, stepBroadcast)
+            testMined(node, gwei(10), &types.Receipt{Status: tt.status, TxHash: tx.Hash(), BlockNumber: big.NewInt(10), GasUsed: 21000,
+                EffectiveGasPrice: tt.effective})
+            node.respond("eth_getTransactionByHash", tx)
+            node.respond("eth_blockNumber", "0xb")
+            
+            r, err := transferReceipt(context.Background(), id, "")
+            if err != nil {
+                t.Fatal(err)
+            }
+            if r.Status != tt.want {
+                t.Errorf("status %s, want %s", r.Status, tt.want)
+            }
+            if r.Fee == nil || r.Fee.Value != tt.fee {
+                t.Errorf("fee %+v, want %s", r.Fee, tt.fee)
+            }
+            // Confirmed about 30s after the broadcast, not an hour after
+            // submission.
+            if r.WaitSeconds < 25 || r.WaitSeconds > 40 {
+                t.Errorf("waited %.0fs, want about 30", r.WaitSeconds)
+            }
+            if r.Confirmations != 2 {
+                t.Errorf("%d confirmations, want 2", r.Confirmations)
+            }
+        })
+    }
+}
+
+func TestEffectiveGasPriceWithoutBaseFee(t *testing.T) {
+    tx := types.NewTx(&types.DynamicFeeTx{GasTipCap: big.NewInt(2), GasFeeCap: big.NewInt(30)})
+    if got := effectiveGasPrice(&types.Receipt{}, tx, nil); got.Int64() != 30 {
+        t.Errorf("got %s, want the fee cap", got)
+    }
+    if got := effectiveGasPrice(&types.Receipt{EffectiveGasPrice: big.NewInt(12)}, tx, big.NewInt(1)); got.Int64() != 12 {
+        t.Errorf("got %s, want the receipt's price", got)
+    }
+}
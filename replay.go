@@ -0,0 +1,161 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "os"
+    "strconv"
+    "text/tabwriter"
+    "time"
+)
+
+type replayResult struct {
+    TransferID int64
+    DecidedAt  time.Time
+    Req        TransactionRequest
+    Was        string
+    Now        Decision
+    // Rebuilt is set for transfers submitted before decisions were logged,
+    // whose request and previous outcome are rebuilt from the transfer.
+    Rebuilt bool
+}
+
+type replayFilter struct {
+    Since, Until, From string
+}
+
+// replayDecisions re-decides every logged transfer decision matching filter
+// with policy and the given lookalike action, including transfers that were
+// denied and never created. Each request is rebuilt from the context logged
+// with its decision and evaluated as of the time it was decided, for the
+// client that submitted it. Transfers without a logged decision, submitted
+// before decisions were logged, are rebuilt from the transfer itself and
+// evaluated as of their creation; their previous outcome is hold when they
+// are still held or were rejected and allow otherwise, so a held transfer
+// that was later approved counts as allowed. Wallet groups, tags and
+// balances are taken as they are now. Nothing is written.
+func replayDecisions(ctx context.Context, policy *Policy, lookalike string, filter replayFilter) ([]replayResult, error) {
+    rows, err := db.QueryContext(ctx, `SELECT * FROM (
+        SELECT COALESCE(transfer_id, 0), created_at, action, COALESCE(client_id, ''),
+        COALESCE(context->>'from', ''), COALESCE(context->>'to', ''), COALESCE((context->>'amount')::float8, 0),
+        COALESCE(context->>'priority', ''), false
+        FROM policy_decisions
+        WHERE kind = $1
+        AND ($2 = '' OR created_at >= $2::date)
+        AND ($3 = '' OR created_at < $3::date)
+        AND ($4 = '' OR context->>'from' = $4)
+        UNION ALL
+        SELECT id, created_at, CASE WHEN status IN ('held', 'rejected') THEN $5 ELSE $6 END, COALESCE(client_id, ''),
+        from_address, to_address, amount, priority, true
+        FROM transfers t
+        WHERE NOT EXISTS (SELECT 1 FROM policy_decisions d WHERE d.transfer_id = t.id AND d.kind = $1)
+        AND ($2 = '' OR created_at >= $2::date)
+        AND ($3 = '' OR created_at < $3::date)
+        AND ($4 = '' OR from_address = $4)
+        ) h ORDER BY 2, 1`, decisionTransfer, filter.Since, filter.Until, filter.From, actionHold, actionAllow)
+    if err != nil {
+        return nil, err
+    }
+    type historical struct {
+        replayResult
+        client string
+    }
+    var history []historical
+    for rows.Next() {
+        var h historical
+        err := rows.Scan(&h.TransferID, &h.DecidedAt, &h.Was, &h.client, &h.Req.From, &h.Req.To, &h.Req.Amount, &h.Req.Priority, &h.Rebuilt)
+        if err != nil {
+            rows.Close()
+            return nil, err
+        }
+        history = append(history, h)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    
+    results := make([]replayResult, 0, len(history))
+    for _, h := range history {
+        clientCtx := context.WithValue(ctx, clientContextKey, &APIClient{ID: h.client})
+        h.Now, _, err = decideTransfer(clientCtx, policy, lookalike, h.Req, h.DecidedAt)
+        if err != nil {
+            return nil, err
+        }
+        results = append(results, h.replayResult)
+    }
+    return results, nil
+}
+
+// runReplay evaluates historical transfer decisions against a candidate
+// policy file and prints what it would have decided. It only reads from the
+// database: no decisions are logged and no transfer is changed.
+func runReplay(args []string) error {
+    fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+    policyFile := fs.String("policy", "", "candidate policy file")
+    lookalike := fs.String("lookalike", lookalikeAction, "lookalike recipient action to replay with (warn, hold or block)")
+    var filter replayFilter
+    fs.StringVar(&filter.Since, "since", "", "only replay transfers submitted on or after this date (YYYY-MM-DD)")
+    fs.StringVar(&filter.Until, "until", "", "only replay transfers submitted before this date (YYYY-MM-DD)")
+    fs.StringVar(&filter.From, "from", "", "only replay transfers from this address")
+    verbose := fs.Bool("v", false, "list every transfer, not just changed outcomes")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if *policyFile == "" {
+        return fmt.Errorf("-policy is required")
+    }
+    switch *lookalike {
+    case "warn", "hold", "block":
+    default:
+        return fmt.Errorf("invalid -lookalike %q", *lookalike)
+    }
+    
+    source, err := os.ReadFile(*policyFile)
+    if err != nil {
+        return err
+    }
+    policy, err := compilePolicy(0, string(source))
+    if err != nil {
+        return fmt.Errorf("%s: %v", *policyFile, err)
+    }
+    
+    results, err := replayDecisions(context.Background(), policy, *lookalike, filter)
+    if err != nil {
+        return err
+    }
+    
+    counts := map[string]int{}
+    changed, rebuilt := 0, 0
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "ID\tDECIDED\tFROM\tTO\tAMOUNT\tWAS\tNOW\tRULE")
+    for _, res := range results {
+        counts[res.Now.Action]++
+        if res.Rebuilt {
+            rebuilt++
+        }
+        if res.Now.Action != res.Was {
+            changed++
+        }
+        if *verbose || res.Now.Action != res.Was {
+            id := "-"
+            if res.TransferID != 0 {
+                id = strconv.FormatInt(res.TransferID, 10)
+            }
+            fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%g\t%s\t%s\t%s\n", id, res.DecidedAt.Format(time.RFC3339),
+                res.Req.From, res.Req.To, res.Req.Amount, res.Was, res.Now.Action, res.Now.Rule)
+        }
+    }
+    w.Flush()
+    
+    fmt.Printf("\nReplayed %d transfers against %s\n", len(results), *policyFile)
+    for _, action := range []string{actionAllow, actionHold, actionDeny} {
+        fmt.Printf("  %-6s %d\n", action, counts[action])
+    }
+    fmt.Printf("  changed %d\n", changed)
+    if rebuilt > 0 {
+        fmt.Printf("  %d transfers had no logged decision and were rebuilt from the transfer\n", rebuilt)
+    }
+    return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+const (
+    replayFrom      = "0x1111111111111111111111111111111111111111"
+    replayKnown     = "0x2222222222222222222222222222222222222222"
+    replayLookalike = "0x2222000000000000000000000000000000002222"
+)
+
+func TestDecideTransfer(t *testing.T) {
+    testDB(t)
+    mustExec(t, "INSERT INTO wallet_groups (name, max_amount, require_approval) VALUES ('ops', 10, true)")
+    mustExec(t, "INSERT INTO wallets (address, balance, group_name) VALUES ($1, 100, 'ops'), ($2, 0, NULL)", replayFrom, replayKnown)
+    ctx := context.Background()
+    
+    tests := []struct {
+        name      string
+        policy    string
+        lookalike string
+        amount    float64
+        to        string
+        action    string
+        rule      string
+    }{
+        {"group limit before policy", "allow all: true", "warn", 11, replayKnown, actionDeny, "group:ops"},
+        {"policy deny before lookalike block", "deny big: amount > 5", "block", 6, replayLookalike, actionDeny, "big"},
+        {"lookalike block before policy hold", "hold all: true", "block", 1, replayLookalike, actionDeny, ruleLookalike},
+        {"policy hold before group hold", "hold all: true", "warn", 1, replayKnown, actionHold, "all"},
+        {"group hold", "", "hold", 1, replayLookalike, actionHold, "group:ops"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            policy, err := compilePolicy(1, tt.policy)
+            if err != nil {
+                t.Fatal(err)
+            }
+            req := TransactionRequest{From: replayFrom, To: tt.to, Amount: tt.amount, Priority: priorityNormal}
+            d, _, err := decideTransfer(ctx, policy, tt.lookalike, req, time.Now())
+            if err != nil {
+                t.Fatal(err)
+            }
+            if d.Action != tt.action || d.Rule != tt.rule {
+                t.Fatalf("got %s/%s, want %s/%s", d.Action, d.Rule, tt.action, tt.rule)
+            }
+        })
+    }
+}
+
+func TestReplayDecisions(t *testing.T) {
+    testDB(t)
+    addClient(t, &APIClient{ID: "tenant"})
+    mustExec(t, "INSERT INTO wallets (address, balance) VALUES ($1, 100), ($2, 0)", replayFrom, replayKnown)
+    ctx := context.WithValue(context.Background(), clientContextKey, &APIClient{ID: "tenant"})
+    
+    // One transfer was accepted, one denied and never created, and a
+    // signature decision must not be replayed.
+    var id int64
+    db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status, client_id)
+        VALUES ($1, $2, 1, 'pending', 'tenant') RETURNING id`, replayFrom, replayKnown).Scan(&id)
+    allow := Decision{Action: actionAllow, Rule: "default"}
+    deny := Decision{Action: actionDeny, Rule: "big"}
+    logDecision(ctx, decisionTransfer, id, map[string]interface{}{"from": replayFrom, "to": replayKnown, "amount": 1.0, "priority": "normal"}, allow)
+    logDecision(ctx, decisionTransfer, 0, map[string]interface{}{"from": replayFrom, "to": replayLookalike, "amount": 50.0, "priority": "normal"}, deny)
+    logDecision(ctx, decisionSignature, 0, map[string]interface{}{"from": replayFrom, "to": replayKnown, "amount": 0.0}, allow)
+    // A transfer held before decisions were logged is rebuilt from the
+    // transfer itself.
+    var held int64
+    db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status, client_id, created_at)
+        VALUES ($1, $2, 20, 'held', 'tenant', now() + interval '1 second') RETURNING id`, replayFrom, replayKnown).Scan(&held)
+    
+    policy, err := compilePolicy(0, "hold tenant: user == \"tenant\" and amount > 10")
+    if err != nil {
+        t.Fatal(err)
+    }
+    results, err := replayDecisions(context.Background(), policy, "block", replayFilter{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(results) != 3 {
+        t.Fatalf("replayed %d decisions, want 3", len(results))
+    }
+    if r := results[0]; r.TransferID != id || r.Was != actionAllow || r.Now.Action != actionAllow {
+        t.Errorf("accepted transfer replayed as %+v", r)
+    }
+    // The denied transfer went to a lookalike of a managed wallet, which the
+    // block action now refuses before the candidate policy would hold it.
+    if r := results[1]; r.TransferID != 0 || r.Was != actionDeny || r.Now.Rule != ruleLookalike {
+        t.Errorf("denied transfer replayed as %+v", r)
+    }
+    if r := results[2]; r.TransferID != held || !r.Rebuilt || r.Was != actionHold || r.Now.Rule != "tenant" {
+        t.Errorf("transfer without a logged decision replayed as %+v", r)
+    }
+    
+    results, err = replayDecisions(context.Background(), policy, "warn", replayFilter{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if r := results[1]; r.Now.Action != actionHold || r.Now.Rule != "tenant" {
+        t.Errorf("denied transfer replayed for its client as %+v", r.Now)
+    }
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "time"
+
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/common/hexutil"
+    "github.com/ethereum/go-ethereum/rpc"
+    "github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// Read-only methods forwarded to the node unchanged. Anything that would
+// sign or broadcast with a key the service does not manage is not proxied.
+var proxiedRPCMethods = map[string]bool{
+    "web3_clientVersion":        true,
+    "net_version":               true,
+    "eth_chainId":               true,
+    "eth_syncing":               true,
+    "eth_blockNumber":           true,
+    "eth_gasPrice":              true,
+    "eth_maxPriorityFeePerGas":  true,
+    "eth_feeHistory":            true,
+    "eth_getBalance":            true,
+    "eth_getCode":               true,
+    "eth_getStorageAt":          true,
+    "eth_getTransactionCount":   true,
+    "eth_getTransactionByHash":  true,
+    "eth_getTransactionReceipt": true,
+    "eth_getBlockByNumber":      true,
+    "eth_getBlockByHash":        true,
+    "eth_getLogs":               true,
+    "eth_call":                  true,
+    "eth_estimateGas":           true,
+}
+
+const rpcSendTimeout = 30 * time.Second
+
+var rpcMaxBatch = envInt("RPC_MAX_BATCH", 20)
+
+// EIP-712 messages that let a spender move the signer's tokens (EIP-2612 and
+// DAI permits, Uniswap Permit2). A signature over one is as good as an
+// on-chain approval, so PERMIT_ACTION decides whether they are refused
+// outright ("deny", the default) or signed only once an operator has
+// approved the request in a dapp session ("hold").
+var permitTypes = map[string]bool{
+    "Permit":                         true,
+    "PermitSingle":                   true,
+    "PermitBatch":                    true,
+    "PermitTransferFrom":             true,
+    "PermitBatchTransferFrom":        true,
+    "PermitWitnessTransferFrom":      true,
+    "PermitBatchWitnessTransferFrom": true,
+}
+
+var permitAction = os.Getenv("PERMIT_ACTION")
+
+func init() {
+    switch permitAction {
+    case "":
+        permitAction = actionDeny
+    case actionDeny, actionHold:
+    default:
+        log.Println("Ignoring invalid PERMIT_ACTION", permitAction)
+        permitAction = actionDeny
+    }
+}
+
+type rpcRequest struct {
+    JSONRPC string            `json:"jsonrpc"`
+    ID      json.RawMessage   `json:"id"`
+    Method  string            `json:"method"`
+    Params  []json.RawMessage `json:"params"`
+}
+
+type rpcError struct {
+    Code    int         `json:"code"`
+    Message string      `json:"message"`
+    Data    interface{} `json:"data,omitempty"`
+}
+
+type rpcResponse struct {
+    JSONRPC string          `json:"jsonrpc"`
+    ID      json.RawMessage `json:"id"`
+    Result  json.RawMessage `json:"result,omitempty"`
+    Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcSendArgs struct {
+    From  string          `json:"from"`
+    To    string          `json:"to"`
+    Value *hexutil.Big    `json:"value"`
+    Gas   *hexutil.Uint64 `json:"gas"`
+    Data  hexutil.Bytes   `json:"data"`
+    Input hexutil.Bytes   `json:"input"`
+}
+
+// transactionRequest keeps the value in wei, as the caller gave it.
+func (args rpcSendArgs) transactionRequest() TransactionRequest {
+    req := TransactionRequest{From: args.From, To: args.To, Data: hexutil.Encode(args.Data)}
+    if len(args.Input) > 0 {
+        req.Data = hexutil.Encode(args.Input)
+    }
+    if args.Value != nil {
+        req.Value, req.Unit = args.Value.ToInt().String(), unitWei
+    }
+    if args.Gas != nil {
+        req.Gas = uint64(*args.Gas)
+    }
+    return req
+}
+
+// HandleRPC serves an Ethereum JSON-RPC endpoint over the managed wallets.
+// Reads go straight to the node, while eth_sendTransaction and
+// eth_signTypedData go through the same checks as POST /transaction and are
+// signed with the managed keys. Batches are limited to RPC_MAX_BATCH calls.
+func (ws *WalletService) HandleRPC(w http.ResponseWriter, r *http.Request) {
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+    if err != nil {
+        http.Error(w, "Invalid request", 400)
+        return
+    }
+    ctx := r.Context()
+    
+    body = bytes.TrimSpace(body)
+    if len(body) > 0 && body[0] == '[' {
+        var batch []rpcRequest
+        if err := json.Unmarshal(body, &batch); err != nil {
+            writeJSON(w, rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: -32700, Message: "Parse error"}})
+            return
+        }
+        if len(batch) > rpcMaxBatch {
+            writeJSON(w, rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: -32600, Message: "Batch too large"}})
+            return
+        }
+        responses := make([]rpcResponse, len(batch))
+        for i, req := range batch {
+            responses[i] = handleRPCRequest(ctx, req)
+        }
+        writeJSON(w, responses)
+        return
+    }
+    
+    var req rpcRequest
+    if err := json.Unmarshal(body, &req); err != nil {
+        writeJSON(w, rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: -32700, Message: "Parse error"}})
+        return
+    }
+    writeJSON(w, handleRPCRequest(ctx, req))
+}
+
+func handleRPCRequest(ctx context.Context, req rpcRequest) rpcResponse {
+    resp := rpcResponse{JSONRPC: "2.0", ID: req.ID}
+    if resp.ID == nil {
+        resp.ID = json.RawMessage("null")
+    }
+    
+    var result interface{}
+    var rerr *rpcError
+    switch {
+    case proxiedRPCMethods[req.Method]:
+        result, rerr = proxyRPC(ctx, req)
+    case req.Method == "eth_accounts":
+        result, rerr = rpcAccounts(ctx)
+    case req.Method == "eth_sendTransaction":
+        result, rerr = rpcSendTransaction(ctx, req.Params)
+    case req.Method == "eth_signTypedData" || req.Method == "eth_signTypedData_v4":
+        result, rerr = rpcSignTypedData(ctx, req.Params)
+    default:
+        rerr = &rpcError{Code: -32601, Message: "Method not supported: " + req.Method}
+    }
+    
+    if rerr != nil {
+        resp.Error = rerr
+        return resp
+    }
+    raw, err := json.Marshal(result)
+    if err != nil {
+        resp.Error = &rpcError{Code: -32603, Message: err.Error()}
+        return resp
+    }
+    resp.Result = raw
+    return resp
+}
+
+// rpcAccounts lists the managed wallets the calling client may sign with.
+func rpcAccounts(ctx context.Context) (interface{}, *rpcError) {
+    addresses := []string{}
+    client := clientFromContext(ctx)
+    if client == nil || client.Admin {
+        for _, account := range keyStore.Accounts() {
+            addresses = append(addresses, account.Address.Hex())
+        }
+        return addresses, nil
+    }
+    
+    rows, err := db.QueryContext(ctx, "SELECT address FROM wallets WHERE client_id = $1 ORDER BY address", client.ID)
+    if err != nil {
+        return nil, submitErrorToRPC(err)
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var address string
+        if err := rows.Scan(&address); err != nil {
+            return nil, submitErrorToRPC(err)
+        }
+        if common.IsHexAddress(address) && keyStore.HasAddress(common.HexToAddress(address)) {
+            addresses = append(addresses, common.HexToAddress(address).Hex())
+        }
+    }
+    return addresses, nil
+}
+
+func proxyRPC(ctx context.Context, req rpcRequest) (interface{}, *rpcError) {
+    args := make([]interface{}, len(req.Params))
+    for i, p := range req.Params {
+        args[i] = p
+    }
+    var raw json.RawMessage
+    if err := ethClient.Client().CallContext(ctx, &raw, req.Method, args...); err != nil {
+        if e, ok := err.(rpc.Error); ok {
+            return nil, &rpcError{Code: e.ErrorCode(), Message: e.Error()}
+        }
+        return nil, &rpcError{Code: -32000, Message: err.Error()}
+    }
+    if raw == nil {
+        raw = json.RawMessage("null")
+    }
+    return raw, nil
+}
+
+func submitErrorToRPC(err error) *rpcError {
+    if re, ok := err.(*requestError); ok {
+        return &rpcError{Code: -32000, Message: re.message}
+    }
+    return &rpcError{Code: -32603, Message: "Internal error"}
+}
+
+// rpcSendTransaction submits the call as a transfer and waits for it to be
+// broadcast so the caller gets a transaction hash, as it would from a node.
+func rpcSendTransaction(ctx context.Context, params []json.RawMessage) (interface{}, *rpcError) {
+    var args rpcSendArgs
+    if len(params) < 1 || json.Unmarshal(params[0], &args) != nil {
+        return nil, &rpcError{Code: -32602, Message: "Invalid params"}
+    }
+    if args.To == "" {
+        return nil, &rpcError{Code: -32602, Message: "Contract creation is not supported"}
+    }
+    
+    id, status, _, err := submitTransfer(ctx, args.transactionRequest())
+    if err != nil {
+        return nil, submitErrorToRPC(err)
+    }
+    if status == "held" {
+        return nil, &rpcError{Code: -32000, Message: "Transaction held for approval", Data: map[string]int64{"transfer_id": id}}
+    }
+    
+    txHash, err := waitForBroadcast(ctx, id, rpcSendTimeout)
+    if err != nil {
+        return nil, &rpcError{Code: -32000, Message: err.Error(), Data: map[string]int64{"transfer_id": id}}
+    }
+    return txHash, nil
+}
+
+// waitForBroadcast polls a submitted transfer until it has a transaction hash.
+func waitForBroadcast(ctx context.Context, id int64, timeout time.Duration) (string, error) {
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+    ticker := time.NewTicker(250 * time.Millisecond)
+    defer ticker.Stop()
+    for {
+        var status, txHash string
+        err := db.QueryRowContext(ctx, "SELECT status, COALESCE(tx_hash, '') FROM transfers WHERE id = $1", id).Scan(&status, &txHash)
+        if err != nil && ctx.Err() == nil {
+            return "", err
+        }
+        if txHash != "" {
+            return txHash, nil
+        }
+        if status == "failed" {
+            return "", errors.New("Transaction failed")
+        }
+        select {
+        case <-ctx.Done():
+            return "", errors.New("Timed out waiting for broadcast")
+        case <-ticker.C:
+        }
+    }
+}
+
+func rpcSignTypedData(ctx context.Context, params []json.RawMessage) (interface{}, *rpcError) {
+    var address string
+    if len(params) < 2 || json.Unmarshal(params[0], &address) != nil {
+        return nil, &rpcError{Code: -32602, Message: "Invalid params"}
+    }
+    sig, err := signTypedData(ctx, address, params[1], false)
+    if err != nil {
+        return nil, submitErrorToRPC(err)
+    }
+    return sig, nil
+}
+
+func parseTypedData(raw json.RawMessage) (apitypes.TypedData, error) {
+    var encoded string
+    if json.Unmarshal(raw, &encoded) == nil {
+        raw = json.RawMessage(encoded)
+    }
+    var typedData apitypes.TypedData
+    err := json.Unmarshal(raw, &typedData)
+    return typedData, err
+}
+
+// signTypedData signs EIP-712 data after evaluating the active policy with
+// the verifying contract, or a permit's spender, as the counterparty and a
+// zero amount. Permits are only signed when approved by an operator and
+// PERMIT_ACTION allows it. The typed data may be given as a JSON object or as
+// a string containing one.
+func signTypedData(ctx context.Context, address string, raw json.RawMessage, approved bool) (string, error) {
+    if !common.IsHexAddress(address) {
+        return "", &requestError{400, "Invalid address"}
+    }
+    if err := checkWalletAccess(ctx, address); err != nil {
+        return "", err
+    }
+    typedData, err := parseTypedData(raw)
+    if err != nil {
+        return "", &requestError{400, "Invalid typed data"}
+    }
+    
+    counterparty := typedData.Domain.VerifyingContract
+    if permitTypes[typedData.PrimaryType] {
+        if permitAction == actionDeny {
+            return "", &requestError{403, "Permit signatures are not allowed"}
+        }
+        if !approved {
+            return "", &requestError{403, "Permit signatures require operator approval through a dapp session"}
+        }
+        if spender, ok := typedData.Message["spender"].(string); ok && common.IsHexAddress(spender) {
+            counterparty = spender
+        }
+    }
+    if counterparty == "" {
+        counterparty = address
+    }
+    if err := checkSignaturePolicy(ctx, address, counterparty); err != nil {
+        return "", err
+    }
+    
+    hash, _, err := apitypes.TypedDataAndHash(typedData)
+    if err != nil {
+        return "", &requestError{400, err.Error()}
+    }
+    sig, err := signHash(ctx, common.HexToAddress(address), hash)
+    if err != nil {
+        return "", err
+    }
+    return hexutil.Encode(sig), nil
+}
+
+func checkSignaturePolicy(ctx context.Context, address, counterparty string) error {
+    policy, err := activePolicy(ctx)
+    if err != nil {
+        return err
+    }
+    vars, err := policyContext(ctx, TransactionRequest{From: address, To: counterparty}, time.Now())
+    if err != nil {
+        return err
+    }
+    decision := policy.Evaluate(vars, false)
+    logDecision(ctx, decisionSignature, 0, vars, decision)
+    switch decision.Action {
+    case actionDeny:
+        return &requestError{403, "Denied by policy rule " + decision.Rule}
+    case actionHold:
+        return &requestError{403, "Signature requires approval by policy rule " + decision.Rule}
+    }
+    return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "math/big"
+    "strings"
+    "testing"
+
+    "github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+const permitTypedData = `{
+    "types": {
+        "EIP712Domain": [
+            {"name": "name", "type": "string"},
+            {"name": "chainId", "type": "uint256"},
+            {"name": "verifyingContract", "type": "address"}
+        ],
+        "Permit": [
+            {"name": "owner", "type": "address"},
+            {"name": "spender", "type": "address"},
+            {"name": "value", "type": "uint256"},
+            {"name": "nonce", "type": "uint256"},
+            {"name": "deadline", "type": "uint256"}
+        ]
+    },
+    "primaryType": "Permit",
+    "domain": {"name": "Token", "chainId": "1337", "verifyingContract": "0x3333333333333333333333333333333333333333"},
+    "message": {
+        "owner": "0x1111111111111111111111111111111111111111",
+        "spender": "0x4444444444444444444444444444444444444444",
+        "value": "1000000",
+        "nonce": "0",
+        "deadline": "9999999999"
+    }
+}`
+
+func TestRPCSendArgsKeepWei(t *testing.T) {
+    value, _ := new(big.Int).SetString("1000000000000000001", 10)
+    args := rpcSendArgs{From: "0x1", To: "0x2", Value: (*hexutil.Big)(value)}
+    req := args.transactionRequest()
+    if req.Value != "1000000000000000001" || req.Unit != unitWei {
+        t.Fatalf("got value %q unit %q, want the exact wei amount", req.Value, req.Unit)
+    }
+}
+
+func TestRPCBatchLimit(t *testing.T) {
+    calls := make([]string, rpcMaxBatch+1)
+    for i := range calls {
+        calls[i] = `{"jsonrpc":"2.0","id":1,"method":"web3_clientVersion"}`
+    }
+    w := serve(new(WalletService).HandleRPC, nil, "POST", "/rpc", "["+strings.Join(calls, ",")+"]")
+    var resp rpcResponse
+    if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+        t.Fatal(err)
+    }
+    if resp.Error == nil || resp.Error.Code != -32600 {
+        t.Fatalf("got %s, want a batch too large error", w.Body)
+    }
+}
+
+func TestSignTypedDataRefusesPermits(t *testing.T) {
+    defer func(action string) { permitAction = action }(permitAction)
+    address := "0x1111111111111111111111111111111111111111"
+    tests := []struct {
+        action   string
+        approved bool
+    }{
+        {actionDeny, true},
+        {actionHold, false},
+    }
+    for _, tt := range tests {
+        permitAction = tt.action
+        _, err := signTypedData(context.Background(), address, json.RawMessage(permitTypedData), tt.approved)
+        if re, ok := err.(*requestError); !ok || re.status != 403 {
+            t.Errorf("%s, approved %v: got %v, want a 403", tt.action, tt.approved, err)
+        }
+    }
+}
+
+func TestRPCWalletOwnership(t *testing.T) {
+    testDB(t)
+    testKeyStore(t)
+    account, err := keyStore.NewAccount("")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := keyStore.Unlock(account, ""); err != nil {
+        t.Fatal(err)
+    }
+    address := account.Address.Hex()
+    owner := addClient(t, &APIClient{ID: "owner"})
+    other := addClient(t, &APIClient{ID: "other"})
+    mustExec(t, "INSERT INTO wallets (address, balance, client_id) VALUES ($1, 1, 'owner')", address)
+    
+    typedData := strings.ReplaceAll(permitTypedData, `"Permit"`, `"Order"`)
+    for _, tt := range []struct {
+        client   *APIClient
+        accounts int
+        signs    bool
+    }{{owner, 1, true}, {other, 0, false}} {
+        ctx := context.WithValue(context.Background(), clientContextKey, tt.client)
+        accounts, rerr := rpcAccounts(ctx)
+        if rerr != nil {
+            t.Fatal(rerr.Message)
+        }
+        if n := len(accounts.([]string)); n != tt.accounts {
+            t.Errorf("%s: eth_accounts lists %d wallets, want %d", tt.client.ID, n, tt.accounts)
+        }
+        _, err := signTypedData(ctx, address, json.RawMessage(typedData), false)
+        if signed := err == nil; signed != tt.signs {
+            t.Errorf("%s: signed %v, want %v (%v)", tt.client.ID, signed, tt.signs, err)
+        }
+        _, err = signHash(ctx, account.Address, make([]byte, 32))
+        if signed := err == nil; signed != tt.signs {
+            t.Errorf("%s: signHash signed %v, want %v (%v)", tt.client.ID, signed, tt.signs, err)
+        }
+    }
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "log"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/core/types"
+    "github.com/lib/pq"
+)
+
+// A transfer is executed as a saga whose progress is kept in transfer_steps,
+// one row per step that has happened:
+//
+//     signed     the transaction was signed and its raw bytes stored with the nonce
+//     broadcast  the node accepted it
+//     debited    the ledger was debited and the transfer marked completed
+//     confirmed  its receipt succeeded and is deep enough
+//     failed     the transfer was abandoned; a debit, if any, was credited back
+//
+// Each step is recorded in the same database transaction as the change it
+// stands for, and a step that is already recorded is never applied again, so
+// any step can be retried; settlement.go keeps concurrent writers from
+// applying one twice. After a crash, or when the node's answer was lost, the
+// saga is moved forward from the last recorded step: transactions that
+// were signed but may not have been broadcast are re-sent, broadcasts are
+// debited, and debited transfers whose transaction reverted or was dropped
+// are compensated by crediting the ledger back.
+
+const (
+    stepSigned    = "signed"
+    stepBroadcast = "broadcast"
+    stepDebited   = "debited"
+    stepConfirmed = "confirmed"
+    stepFailed    = "failed"
+)
+
+// How long a signed transfer may go without a recorded broadcast before the
+// watcher re-sends it.
+const sagaResendAfter = 2 * time.Minute
+
+// sagaClaimLease is how long a worker may hold a claimed transfer without
+// signing it before the transfer is taken to be abandoned by a replica that
+// died, and requeued.
+var sagaClaimLease = time.Duration(envInt("SAGA_CLAIM_LEASE", 300)) * time.Second
+
+type execer interface {
+    ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// recordStep records a step of a transfer and reports whether it is new.
+func recordStep(ctx context.Context, ex execer, id int64, step, detail string) (bool, error) {
+    res, err := ex.ExecContext(ctx, `INSERT INTO transfer_steps (transfer_id, step, detail) VALUES ($1, $2, NULLIF($3, ''))
+        ON CONFLICT (transfer_id, step) DO NOTHING`, id, step, detail)
+    if err != nil {
+        return false, err
+    }
+    n, _ := res.RowsAffected()
+    return n > 0, nil
+}
+
+func transferSteps(ctx context.Context, id int64) (map[string]time.Time, error) {
+    rows, err := db.QueryContext(ctx, "SELECT step, created_at FROM transfer_steps WHERE transfer_id = $1", id)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    steps := map[string]time.Time{}
+    for rows.Next() {
+        var step string
+        var at time.Time
+        if err := rows.Scan(&step, &at); err != nil {
+            return nil, err
+        }
+        steps[step] = at
+    }
+    return steps, rows.Err()
+}
+
+// broadcastAccepted reports whether a send error still means the node has
+// the transaction.
+func broadcastAccepted(err error) bool {
+    msg := strings.ToLower(err.Error())
+    return strings.Contains(msg, "already known") || strings.Contains(msg, "known transaction")
+}
+
+// rejectedByNode reports whether the node answered and refused the
+// transaction. Any other error (timeouts, dropped connections, an open
+// breaker) leaves it unknown whether the node received it. "nonce too low"
+// is not taken as a refusal: the transaction may itself have used the nonce.
+func rejectedByNode(err error) bool {
+    var rpcErr interface{ ErrorCode() int }
+    return errors.As(err, &rpcErr) && !strings.Contains(strings.ToLower(err.Error()), "nonce too low")
+}
+
+// completeTransfer records the broadcast of tx and debits the ledger once.
+func completeTransfer(ctx context.Context, id int64, tx *types.Transaction) error {
+    dbTx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer dbTx.Rollback()
+    
+    status, version, err := transferState(ctx, dbTx, id)
+    if err != nil || status != "processing" {
+        return err
+    }
+    if _, err := recordStep(ctx, dbTx, id, stepBroadcast, tx.Hash().Hex()); err != nil {
+        return err
+    }
+    debit, err := recordStep(ctx, dbTx, id, stepDebited, "")
+    if err != nil || !debit {
+        return err
+    }
+    if ok, err := transitionTransfer(ctx, dbTx, id, version, "completed", "processing"); err != nil || !ok {
+        return err
+    }
+    var from string
+    var amount float64
+    err = dbTx.QueryRowContext(ctx, `UPDATE transfers SET tx_hash = $2 WHERE id = $1
+        RETURNING from_address, amount`, id, tx.Hash().Hex()).Scan(&from, &amount)
+    if err != nil {
+        return err
+    }
+    if _, err := dbTx.ExecContext(ctx, "UPDATE wallets SET balance = balance - $2 WHERE address = $1", from, amount); err != nil {
+        return err
+    }
+    if err := dbTx.Commit(); err != nil {
+        return err
+    }
+    log.Println("Transaction completed")
+    return nil
+}
+
+// failTransfer abandons a transfer, crediting back its debit if it had one.
+// A confirmed transfer is left alone.
+func failTransfer(ctx context.Context, id int64, reason string) error {
+    dbTx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer dbTx.Rollback()
+    
+    status, version, err := transferState(ctx, dbTx, id)
+    if err != nil || (status != "processing" && status != "completed") {
+        return err
+    }
+    var confirmed, debited bool
+    err = dbTx.QueryRowContext(ctx, `SELECT
+        EXISTS (SELECT 1 FROM transfer_steps WHERE transfer_id = $1 AND step = $2),
+        EXISTS (SELECT 1 FROM transfer_steps WHERE transfer_id = $1 AND step = $3)`, id, stepConfirmed, stepDebited).Scan(&confirmed, &debited)
+    if err != nil || confirmed {
+        return err
+    }
+    failed, err := recordStep(ctx, dbTx, id, stepFailed, reason)
+    if err != nil || !failed {
+        return err
+    }
+    if ok, err := transitionTransfer(ctx, dbTx, id, version, "failed", "processing", "completed"); err != nil || !ok {
+        return err
+    }
+    var from string
+    var amount float64
+    err = dbTx.QueryRowContext(ctx, "SELECT from_address, amount FROM transfers WHERE id = $1", id).Scan(&from, &amount)
+    if err != nil {
+        return err
+    }
+    if debited {
+        if _, err := dbTx.ExecContext(ctx, "UPDATE wallets SET balance = balance + $2 WHERE address = $1", from, amount); err != nil {
+            return err
+        }
+    }
+    if err := queueCallback(ctx, dbTx, id); err != nil {
+        return err
+    }
+    if err := dbTx.Commit(); err != nil {
+        return err
+    }
+    
+    log.Println("Transfer", id, "failed:", reason)
+    wakeCallbacks()
+    go notifyTransfer(id, eventFailed)
+    return nil
+}
+
+// signedTransaction returns the transaction stored for a transfer's nonce.
+func signedTransaction(ctx context.Context, id int64) (*types.Transaction, common.Address, error) {
+    var address, raw string
+    err := db.QueryRowContext(ctx, "SELECT address, raw_tx FROM nonces WHERE transfer_id = $1 AND raw_tx IS NOT NULL ORDER BY nonce DESC LIMIT 1", id).
+        Scan(&address, &raw)
+    if err != nil {
+        return nil, common.Address{}, err
+    }
+    tx := new(types.Transaction)
+    if err := tx.UnmarshalBinary(common.FromHex(raw)); err != nil {
+        return nil, common.Address{}, err
+    }
+    return tx, common.HexToAddress(address), nil
+}
+
+// resendTransfer re-broadcasts a signed transfer whose broadcast is not
+// recorded to conn's chain and moves it on according to the node's answer.
+func resendTransfer(ctx context.Context, conn *chainConn, id int64) error {
+    tx, from, err := signedTransaction(ctx, id)
+    if err != nil {
+        return err
+    }
+    err = conn.eth.SendTransaction(ctx, tx)
+    if err == nil || broadcastAccepted(err) {
+        return completeTransfer(ctx, id, tx)
+    }
+    if !rejectedByNode(err) {
+        return err
+    }
+    // The transaction may already be mined, in which case the node refuses
+    // it as a duplicate.
+    if _, rerr := conn.eth.TransactionReceipt(ctx, tx.Hash()); rerr == nil {
+        return completeTransfer(ctx, id, tx)
+    }
+    releaseNonce(conn, from, tx.Nonce())
+    return failTransfer(ctx, id, err.Error())
+}
+
+// advanceSagas moves every unfinished transfer forward: signed transfers
+// without a recorded broadcast for a while are re-sent, and debited
+// transfers are checked against their receipts, settling after as many
+// confirmations as the owner's definition of the transfer's chain asks for.
+func advanceSagas(ctx context.Context) error {
+    rows, err := db.QueryContext(ctx, `SELECT t.id, COALESCE(t.client_id, ''), t.chain_id, bool_or(s.step = $1) FROM transfers t JOIN transfer_steps s ON s.transfer_id = t.id
+        WHERE t.status IN ('processing', 'completed')
+        GROUP BY t.id
+        HAVING NOT bool_or(s.step IN ($2, $3))
+        AND (bool_or(s.step = $1) OR max(s.created_at) < now() - make_interval(secs => $4))
+        ORDER BY t.id LIMIT 200`, stepDebited, stepConfirmed, stepFailed, sagaResendAfter.Seconds())
+    if err != nil {
+        return err
+    }
+    type pendingSaga struct {
+        id      int64
+        client  string
+        chain   int64
+        debited bool
+    }
+    var sagas []pendingSaga
+    for rows.Next() {
+        var s pendingSaga
+        if err := rows.Scan(&s.id, &s.client, &s.chain, &s.debited); err != nil {
+            rows.Close()
+            return err
+        }
+        sagas = append(sagas, s)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil || len(sagas) == 0 {
+        return err
+    }
+    
+    // A chain that cannot be reached only holds up its own transfers.
+    conns := map[string]*chainConn{}
+    latest := map[int64]uint64{}
+    for _, s := range sagas {
+        key := s.client + ":" + strconv.FormatInt(s.chain, 10)
+        conn, ok := conns[key]
+        if !ok {
+            if conn, err = openChain(ctx, s.client, s.chain); err != nil {
+                log.Println("Chain", storedChainID(s.chain), "unavailable for", s.client, err)
+            }
+            conns[key] = conn
+        }
+        if conn == nil {
+            continue
+        }
+        if s.debited {
+            head, ok := latest[s.chain]
+            if !ok {
+                if head, err = conn.eth.BlockNumber(ctx); err != nil {
+                    log.Println("Chain", storedChainID(s.chain), "unavailable:", err)
+                    conns[key] = nil
+                    continue
+                }
+                latest[s.chain] = head
+            }
+            err = checkReceipt(ctx, conn, s.id, head)
+        } else {
+            err = resendTransfer(ctx, conn, s.id)
+        }
+        if err != nil {
+            log.Println("Failed to advance transfer", s.id, err)
+        }
+    }
+    return nil
+}
+
+// requeueAbandonedClaims puts transfers claimed longer than sagaClaimLease
+// ago and never signed back in the queue, releasing any nonce they reserved,
+// and wakes their senders' queues. Younger claims may belong to a worker of
+// another replica that is still running, so they are left alone.
+func requeueAbandonedClaims(ctx context.Context) error {
+    dbTx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer dbTx.Rollback()
+    
+    rows, err := dbTx.QueryContext(ctx, `UPDATE transfers SET status = 'pending', version = version + 1, claimed_at = NULL
+        WHERE status = 'processing' AND (claimed_at IS NULL OR claimed_at < now() - $2::int * interval '1 second')
+        AND NOT EXISTS (SELECT 1 FROM transfer_steps WHERE transfer_id = transfers.id AND step = $1) RETURNING id, from_address`,
+        stepSigned, int(sagaClaimLease/time.Second))
+    if err != nil {
+        return err
+    }
+    var ids []int64
+    senders := map[string]bool{}
+    for rows.Next() {
+        var id int64
+        var from string
+        if err := rows.Scan(&id, &from); err != nil {
+            rows.Close()
+            return err
+        }
+        ids = append(ids, id)
+        senders[from] = true
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil || len(ids) == 0 {
+        return err
+    }
+    if _, err := dbTx.ExecContext(ctx, "DELETE FROM nonces WHERE raw_tx IS NULL AND transfer_id = ANY($1)", pq.Array(ids)); err != nil {
+        return err
+    }
+    if err := dbTx.Commit(); err != nil {
+        return err
+    }
+    for from := range senders {
+        queue.wake(from)
+    }
+    log.Println("Requeued", len(ids), "transfers interrupted before signing")
+    return nil
+}
+
+// recoverSagas runs at startup, before any worker: abandoned claims go back
+// to the queue and the rest are moved forward.
+func recoverSagas() error {
+    ctx := context.Background()
+    if err := requeueAbandonedClaims(ctx); err != nil {
+        return err
+    }
+    return advanceSagas(ctx)
+}
+
+func runSagaWatcher() {
+    for {
+        time.Sleep(15 * time.Second)
+        if chainBreaker.retryAfter() > 0 {
+            continue
+        }
+        if err := requeueAbandonedClaims(context.Background()); err != nil {
+            log.Println("Saga watcher failed:", err)
+        }
+        if err := advanceSagas(context.Background()); err != nil {
+            log.Println("Saga watcher failed:", err)
+        }
+    }
+}
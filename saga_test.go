@@ -0,0 +1,110 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "math/big"
+    "testing"
+
+    "github.com/ethereum/go-ethereum/common"
+)
+
+func TestRequeueAbandonedClaims(t *testing.T) {
+    testDB(t)
+    claimed := func(age string) int64 {
+        var id int64
+        err := db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status, claimed_at)
+            VALUES ('0xa', '0xb', 1, 'processing', now() - $1::interval) RETURNING id`, age).Scan(&id)
+        if err != nil {
+            t.Fatal(err)
+        }
+        mustExec(t, "INSERT INTO nonces (address, nonce, transfer_id) VALUES ('0xa', $1, $1)", id)
+        return id
+    }
+    abandoned := claimed("1 hour")
+    running := claimed("5 seconds")
+    signed := claimed("1 hour")
+    mustExec(t, "INSERT INTO transfer_steps (transfer_id, step) VALUES ($1, $2)", signed, stepSigned)
+    // With a worker already draining 0xa, a wake asks it to look again.
+    defer func(q *transferQueue) { queue = q }(queue)
+    queue = &transferQueue{running: map[string]bool{"0xa": true}, again: map[string]bool{}}
+    
+    if err := requeueAbandonedClaims(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if !queue.again["0xa"] {
+        t.Error("the queue of the requeued transfer was not woken")
+    }
+    for _, tt := range []struct {
+        name   string
+        id     int64
+        status string
+        nonces int
+    }{
+        {"abandoned", abandoned, "pending", 0},
+        {"claimed by a running worker", running, "processing", 1},
+        {"signed", signed, "processing", 1},
+    } {
+        if n := countRows(t, "SELECT COUNT(*) FROM transfers WHERE id = $1 AND status = $2", tt.id, tt.status); n != 1 {
+            t.Errorf("%s transfer is not %s", tt.name, tt.status)
+        }
+        if n := countRows(t, "SELECT COUNT(*) FROM nonces WHERE transfer_id = $1", tt.id); n != tt.nonces {
+            t.Errorf("%s transfer has %d nonces, want %d", tt.name, n, tt.nonces)
+        }
+    }
+}
+
+// A transfer the node refuses gives its nonce back, and the next transfer
+// takes it even though a later nonce is still reserved.
+func TestRejectedTransferNonceIsReused(t *testing.T) {
+    testDB(t)
+    testKeyStore(t)
+    node := testNode(t)
+    account, err := keyStore.NewAccount("")
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyStore.Unlock(account, "")
+    from := account.Address
+    to := common.HexToAddress("0x2222222222222222222222222222222222222222")
+    testFees(t, node, big.NewInt(1e9), big.NewInt(1e9))
+    node.respond("eth_getTransactionCount", "0x0")
+    reject := true
+    node.handle("eth_sendRawTransaction", func([]json.RawMessage) (interface{}, error) {
+        if reject {
+            return nil, errors.New("insufficient funds for gas * price + value")
+        }
+        return common.Hash{}.Hex(), nil
+    })
+    newTransfer := func() int64 {
+        var id int64
+        err := db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status)
+            VALUES ($1, $2, 1, 'processing') RETURNING id`, from.Hex(), to.Hex()).Scan(&id)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return id
+    }
+    // Nonce 1 is held by a transfer still in flight.
+    mustExec(t, "INSERT INTO nonces (address, nonce, transfer_id) VALUES ($1, 1, $2)", nonceKey(from), newTransfer())
+    req := TransactionRequest{From: from.Hex(), To: to.Hex(), Amount: 1}
+    
+    rejected := newTransfer()
+    processTransaction(rejected, req)
+    if n := countRows(t, "SELECT COUNT(*) FROM transfers WHERE id = $1 AND status = 'failed'", rejected); n != 1 {
+        t.Fatal("the rejected transfer did not fail")
+    }
+    if n := countRows(t, "SELECT COUNT(*) FROM nonces WHERE address = $1 AND nonce = 0", nonceKey(from)); n != 0 {
+        t.Fatal("the rejected transfer kept nonce 0")
+    }
+    
+    reject = false
+    tx, err := sendTransfer(context.Background(), connectedChain(t, ""), newTransfer(), req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if tx.Nonce() != 0 {
+        t.Errorf("next transfer got nonce %d, want the released 0", tx.Nonce())
+    }
+}
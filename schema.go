@@ -0,0 +1,294 @@
+package main
+
+const schema = `
+CREATE TABLE IF NOT EXISTS wallets (
+    address TEXT PRIMARY KEY,
+    balance DOUBLE PRECISION NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS transfers (
+    id BIGSERIAL PRIMARY KEY,
+    from_address TEXT NOT NULL,
+    to_address TEXT NOT NULL,
+    amount DOUBLE PRECISION NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS transfers_from_status_idx ON transfers (from_address, status);
+
+CREATE TABLE IF NOT EXISTS wallet_groups (
+    name TEXT PRIMARY KEY,
+    max_amount DOUBLE PRECISION,
+    require_approval BOOLEAN NOT NULL DEFAULT false,
+    sweep_to TEXT
+);
+
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS label TEXT NOT NULL DEFAULT '';
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS group_name TEXT REFERENCES wallet_groups(name) ON DELETE SET NULL;
+
+CREATE TABLE IF NOT EXISTS wallet_tags (
+    address TEXT NOT NULL REFERENCES wallets(address) ON DELETE CASCADE,
+    tag TEXT NOT NULL,
+    PRIMARY KEY (address, tag)
+);
+
+CREATE TABLE IF NOT EXISTS policies (
+    version BIGSERIAL PRIMARY KEY,
+    source TEXT NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS policies_active_idx ON policies (active) WHERE active;
+
+CREATE TABLE IF NOT EXISTS policy_decisions (
+    id BIGSERIAL PRIMARY KEY,
+    transfer_id BIGINT REFERENCES transfers(id),
+    version BIGINT NOT NULL,
+    rule TEXT NOT NULL,
+    action TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    context JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS api_clients (
+    id TEXT PRIMARY KEY,
+    key_hash TEXT NOT NULL UNIQUE,
+    admin BOOLEAN NOT NULL DEFAULT false,
+    monthly_api_calls BIGINT,
+    monthly_transfers BIGINT,
+    monthly_gas_wei NUMERIC(78, 0)
+);
+
+CREATE TABLE IF NOT EXISTS usage_daily (
+    client_id TEXT NOT NULL REFERENCES api_clients(id),
+    day DATE NOT NULL,
+    api_calls BIGINT NOT NULL DEFAULT 0,
+    transfers BIGINT NOT NULL DEFAULT 0,
+    gas_wei NUMERIC(78, 0) NOT NULL DEFAULT 0,
+    PRIMARY KEY (client_id, day)
+);
+
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS client_id TEXT;
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS tx_hash TEXT;
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS data TEXT;
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS gas BIGINT;
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS queue_position DOUBLE PRECISION;
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS on_hold BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS priority TEXT NOT NULL DEFAULT 'normal';
+
+CREATE INDEX IF NOT EXISTS transfers_backlog_idx ON transfers (client_id) WHERE status IN ('pending', 'processing');
+
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS callback_url TEXT;
+
+CREATE TABLE IF NOT EXISTS callbacks (
+    id BIGSERIAL PRIMARY KEY,
+    transfer_id BIGINT NOT NULL REFERENCES transfers(id),
+    url TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    delivered_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS callbacks_due_idx ON callbacks (next_attempt) WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS notification_targets (
+    client_id TEXT NOT NULL REFERENCES api_clients(id),
+    channel TEXT NOT NULL,
+    target TEXT NOT NULL DEFAULT '',
+    locale TEXT NOT NULL DEFAULT 'en',
+    PRIMARY KEY (client_id, channel, target)
+);
+
+CREATE TABLE IF NOT EXISTS notification_templates (
+    client_id TEXT NOT NULL DEFAULT '',
+    event TEXT NOT NULL,
+    channel TEXT NOT NULL DEFAULT '',
+    locale TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    body TEXT NOT NULL,
+    PRIMARY KEY (client_id, event, channel, locale)
+);
+
+CREATE TABLE IF NOT EXISTS notifications (
+    id BIGSERIAL PRIMARY KEY,
+    client_id TEXT NOT NULL REFERENCES api_clients(id),
+    event TEXT NOT NULL,
+    transfer_id BIGINT REFERENCES transfers(id),
+    locale TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    body TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    read_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS notifications_client_idx ON notifications (client_id, id);
+
+CREATE TABLE IF NOT EXISTS gas_receipts (
+    tx_hash TEXT PRIMARY KEY,
+    address TEXT NOT NULL,
+    lane TEXT NOT NULL,
+    block_number BIGINT NOT NULL,
+    fee_cap NUMERIC(78, 0) NOT NULL,
+    tip_cap NUMERIC(78, 0) NOT NULL,
+    effective_price NUMERIC(78, 0) NOT NULL,
+    base_fee NUMERIC(78, 0) NOT NULL,
+    gas_limit BIGINT NOT NULL,
+    gas_used BIGINT NOT NULL,
+    sent_at TIMESTAMPTZ NOT NULL,
+    mined_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS gas_receipts_sent_idx ON gas_receipts (sent_at);
+
+CREATE TABLE IF NOT EXISTS scanner_state (
+    name TEXT PRIMARY KEY,
+    block BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS deposits (
+    id BIGSERIAL PRIMARY KEY,
+    tx_hash TEXT NOT NULL,
+    log_index INTEGER NOT NULL,
+    wallet TEXT NOT NULL,
+    sender TEXT NOT NULL,
+    asset TEXT NOT NULL,
+    amount NUMERIC(78, 0) NOT NULL,
+    block_number BIGINT NOT NULL,
+    dust BOOLEAN NOT NULL,
+    resembles TEXT,
+    flagged BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (tx_hash, log_index)
+);
+
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS max_base_fee NUMERIC(78, 0);
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS deadline TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS transfers_deferred_idx ON transfers (from_address) WHERE status = 'pending' AND max_base_fee IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS chains (
+    client_id TEXT NOT NULL DEFAULT '',
+    chain_id BIGINT NOT NULL,
+    name TEXT NOT NULL,
+    rpc_urls TEXT NOT NULL,
+    currency_symbol TEXT NOT NULL,
+    currency_decimals INTEGER NOT NULL DEFAULT 18,
+    fee_model TEXT NOT NULL DEFAULT 'eip1559',
+    confirmations INTEGER NOT NULL DEFAULT 12,
+    explorer_url TEXT,
+    PRIMARY KEY (client_id, chain_id)
+);
+
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS transfer_steps (
+    transfer_id BIGINT NOT NULL REFERENCES transfers(id),
+    step TEXT NOT NULL,
+    detail TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (transfer_id, step)
+);
+
+CREATE TABLE IF NOT EXISTS dust_thresholds (
+    asset TEXT PRIMARY KEY,
+    threshold NUMERIC(78, 0) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS dapp_sessions (
+    id TEXT PRIMARY KEY,
+    wallet TEXT NOT NULL,
+    dapp_name TEXT NOT NULL,
+    dapp_url TEXT NOT NULL DEFAULT '',
+    client_id TEXT,
+    status TEXT NOT NULL DEFAULT 'active',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS session_requests (
+    id BIGSERIAL PRIMARY KEY,
+    session_id TEXT NOT NULL REFERENCES dapp_sessions(id),
+    method TEXT NOT NULL,
+    params JSONB NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    result JSONB,
+    error TEXT,
+    decided_by TEXT,
+    decided_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS abi_registry (
+    address TEXT PRIMARY KEY,
+    name TEXT NOT NULL DEFAULT '',
+    abi JSONB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS method_signatures (
+    selector TEXT NOT NULL,
+    signature TEXT NOT NULL,
+    PRIMARY KEY (selector, signature)
+);
+
+CREATE TABLE IF NOT EXISTS nonces (
+    address TEXT NOT NULL,
+    nonce BIGINT NOT NULL,
+    transfer_id BIGINT REFERENCES transfers(id),
+    tx_hash TEXT,
+    raw_tx TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (address, nonce)
+);
+
+CREATE TABLE IF NOT EXISTS tokens (
+    address TEXT PRIMARY KEY,
+    symbol TEXT NOT NULL,
+    decimals INTEGER NOT NULL
+);
+
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS client_id TEXT REFERENCES api_clients(id);
+ALTER TABLE api_clients ADD COLUMN IF NOT EXISTS approver_for TEXT REFERENCES api_clients(id);
+
+ALTER TABLE policies ADD COLUMN IF NOT EXISTS client_id TEXT NOT NULL DEFAULT '';
+DROP INDEX IF EXISTS policies_active_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS policies_active_client_idx ON policies (client_id) WHERE active;
+ALTER TABLE policy_decisions ADD COLUMN IF NOT EXISTS client_id TEXT;
+ALTER TABLE policy_decisions ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT 'transfer';
+
+CREATE TABLE IF NOT EXISTS usage_monthly (
+    client_id TEXT NOT NULL REFERENCES api_clients(id),
+    month DATE NOT NULL,
+    api_calls BIGINT NOT NULL DEFAULT 0,
+    transfers BIGINT NOT NULL DEFAULT 0,
+    gas_wei NUMERIC(78, 0) NOT NULL DEFAULT 0,
+    PRIMARY KEY (client_id, month)
+);
+
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS amount_wei NUMERIC(78, 0);
+
+ALTER TABLE nonces ADD COLUMN IF NOT EXISTS sent_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS nonces_sent_idx ON nonces (sent_at);
+ALTER TABLE gas_receipts ADD COLUMN IF NOT EXISTS chain_id BIGINT;
+
+ALTER TABLE scanner_state ADD COLUMN IF NOT EXISTS hash TEXT;
+
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS claimed_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS wallets_client_idx ON wallets (client_id);
+
+ALTER TABLE transfers ADD COLUMN IF NOT EXISTS chain_id BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE nonces ADD COLUMN IF NOT EXISTS chain_id BIGINT NOT NULL DEFAULT 0;
+CREATE UNIQUE INDEX IF NOT EXISTS nonces_chain_idx ON nonces (address, chain_id, nonce);
+ALTER TABLE nonces DROP CONSTRAINT IF EXISTS nonces_pkey;
+`
+
+func migrate() error {
+    _, err := db.Exec(schema)
+    return err
+}
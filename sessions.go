@@ -0,0 +1,479 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "unicode/utf8"
+
+    "github.com/ethereum/go-ethereum/accounts"
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Dapp sessions connect one managed wallet to one dapp. The dapp talks to the
+// relay endpoints with the session id as its credential; every request it
+// makes waits in a queue until an operator approves or rejects it. Sessions
+// belong to the client that created them: only that client, its approver
+// and admins see and decide its requests, and approved requests run as that
+// client.
+
+const maxRelayWait = 25 * time.Second
+
+// sessionExecuteTimeout is how long a request may stay executing before the
+// janitor assumes the replica running it died and fails it.
+var sessionExecuteTimeout = time.Duration(envInt("SESSION_EXECUTE_TIMEOUT", 300)) * time.Second
+
+var sessionMethods = map[string]bool{
+    "eth_sendTransaction":  true,
+    "eth_signTypedData":    true,
+    "eth_signTypedData_v4": true,
+    "personal_sign":        true,
+}
+
+type DappSession struct {
+    ID        string    `json:"id"`
+    Wallet    string    `json:"wallet"`
+    DappName  string    `json:"dapp_name"`
+    DappURL   string    `json:"dapp_url"`
+    Status    string    `json:"status"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+type SessionRequest struct {
+    ID        int64           `json:"id"`
+    SessionID string          `json:"session_id,omitempty"`
+    DappName  string          `json:"dapp_name,omitempty"`
+    Wallet    string          `json:"wallet,omitempty"`
+    Method    string          `json:"method"`
+    Params    json.RawMessage `json:"params,omitempty"`
+    Details   interface{}     `json:"details,omitempty"`
+    Status    string          `json:"status"`
+    Result    json.RawMessage `json:"result,omitempty"`
+    Error     string          `json:"error,omitempty"`
+    CreatedAt time.Time       `json:"created_at"`
+}
+
+func (ws *WalletService) HandleSessions(w http.ResponseWriter, r *http.Request) {
+    if r.Method == http.MethodPost {
+        var s DappSession
+        if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s.DappName == "" {
+            http.Error(w, "Invalid request", 400)
+            return
+        }
+        if !common.IsHexAddress(s.Wallet) || !keyStore.HasAddress(common.HexToAddress(s.Wallet)) {
+            http.Error(w, errUnmanagedAddress.Error(), 400)
+            return
+        }
+        if err := checkWalletAccess(r.Context(), s.Wallet); err != nil {
+            writeError(w, err)
+            return
+        }
+        buf := make([]byte, 32)
+        if _, err := rand.Read(buf); err != nil {
+            writeError(w, err)
+            return
+        }
+        s.ID = hex.EncodeToString(buf)
+        _, err := db.ExecContext(r.Context(), "INSERT INTO dapp_sessions (id, wallet, dapp_name, dapp_url, client_id) VALUES ($1, $2, $3, $4, NULLIF($5, ''))",
+            s.ID, s.Wallet, s.DappName, s.DappURL, clientID(r.Context()))
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        writeJSON(w, map[string]string{"id": s.ID})
+        return
+    }
+    
+    conds, args := sessionFilter(r.Context(), "client_id", []string{"status = 'active'"}, nil)
+    rows, err := db.QueryContext(r.Context(), "SELECT id, wallet, dapp_name, dapp_url, status, created_at FROM dapp_sessions"+
+        whereClause(conds)+" ORDER BY created_at", args...)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer rows.Close()
+    
+    sessions := []DappSession{}
+    for rows.Next() {
+        var s DappSession
+        if err := rows.Scan(&s.ID, &s.Wallet, &s.DappName, &s.DappURL, &s.Status, &s.CreatedAt); err != nil {
+            writeError(w, err)
+            return
+        }
+        sessions = append(sessions, s)
+    }
+    writeJSON(w, sessions)
+}
+
+func (ws *WalletService) HandleDisconnectSession(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", 405)
+        return
+    }
+    id := r.URL.Query().Get("id")
+    conds, args := sessionFilter(r.Context(), "client_id", []string{"id = $1", "status = 'active'"}, []interface{}{id})
+    res, err := db.ExecContext(r.Context(), "UPDATE dapp_sessions SET status = 'disconnected'"+whereClause(conds), args...)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        http.Error(w, "Session not found", 404)
+        return
+    }
+    db.ExecContext(r.Context(), "UPDATE session_requests SET status = 'rejected', error = 'Session disconnected', decided_at = now() WHERE session_id = $1 AND status = 'pending'", id)
+    w.Write([]byte("Session disconnected"))
+}
+
+// sessionFilter is tenantFilter for sessions: besides the owning client, the
+// client's approver sees them too.
+func sessionFilter(ctx context.Context, column string, conds []string, args []interface{}) ([]string, []interface{}) {
+    client := clientFromContext(ctx)
+    if client == nil || client.Admin {
+        return conds, args
+    }
+    args = append(args, client.ID, client.ApproverFor)
+    return append(conds, fmt.Sprintf("%s IN ($%d, $%d)", column, len(args)-1, len(args))), args
+}
+
+// sessionRequestDetails renders a request the way an operator needs to see it
+// before approving.
+func sessionRequestDetails(ctx context.Context, method string, params json.RawMessage) interface{} {
+    var args []json.RawMessage
+    json.Unmarshal(params, &args)
+    
+    switch method {
+    case "eth_sendTransaction":
+        var tx rpcSendArgs
+        if len(args) < 1 || json.Unmarshal(args[0], &tx) != nil {
+            return nil
+        }
+        req := tx.transactionRequest()
+        details := map[string]interface{}{"from": req.From, "to": req.To, "amount": req.Amount, "gas": req.Gas, "data": req.Data}
+        if decoded, err := decodeCall(ctx, req.To, req.Data); err == nil && decoded != nil {
+            details["decoded"] = decoded
+        }
+        if conn, err := openChain(ctx, clientID(ctx), 0); err == nil {
+            if sim, err := simulateTransfer(ctx, conn, req); err == nil {
+                details["simulation"] = sim
+            }
+        }
+        return details
+    case "eth_signTypedData", "eth_signTypedData_v4":
+        if len(args) < 2 {
+            return nil
+        }
+        typedData, err := parseTypedData(args[1])
+        if err != nil {
+            return nil
+        }
+        return map[string]interface{}{"domain": typedData.Domain, "primary_type": typedData.PrimaryType, "message": typedData.Message}
+    case "personal_sign":
+        var data hexutil.Bytes
+        if len(args) < 1 || json.Unmarshal(args[0], &data) != nil {
+            return nil
+        }
+        if utf8.Valid(data) {
+            return map[string]string{"message": string(data)}
+        }
+        return map[string]string{"message": hexutil.Encode(data)}
+    }
+    return nil
+}
+
+// requestSigner returns the address a dapp request would sign with.
+func requestSigner(method string, params json.RawMessage) string {
+    var args []json.RawMessage
+    json.Unmarshal(params, &args)
+    var address string
+    switch method {
+    case "eth_sendTransaction":
+        var tx rpcSendArgs
+        if len(args) > 0 && json.Unmarshal(args[0], &tx) == nil {
+            address = tx.From
+        }
+    case "eth_signTypedData", "eth_signTypedData_v4":
+        if len(args) > 0 {
+            json.Unmarshal(args[0], &address)
+        }
+    case "personal_sign":
+        if len(args) > 1 {
+            json.Unmarshal(args[1], &address)
+        }
+    }
+    return address
+}
+
+func (ws *WalletService) HandleSessionRequests(w http.ResponseWriter, r *http.Request) {
+    status := r.URL.Query().Get("status")
+    if status == "" {
+        status = "pending"
+    }
+    conds, args := sessionFilter(r.Context(), "s.client_id", []string{"q.status = $1"}, []interface{}{status})
+    rows, err := db.QueryContext(r.Context(), `SELECT q.id, q.session_id, s.dapp_name, s.wallet, q.method, q.params, q.status,
+        COALESCE(q.result::text, ''), COALESCE(q.error, ''), q.created_at
+        FROM session_requests q JOIN dapp_sessions s ON s.id = q.session_id`+whereClause(conds)+" ORDER BY q.id", args...)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer rows.Close()
+    
+    requests := []SessionRequest{}
+    for rows.Next() {
+        var q SessionRequest
+        var params, result string
+        if err := rows.Scan(&q.ID, &q.SessionID, &q.DappName, &q.Wallet, &q.Method, &params, &q.Status, &result, &q.Error, &q.CreatedAt); err != nil {
+            writeError(w, err)
+            return
+        }
+        q.Params = json.RawMessage(params)
+        if result != "" {
+            q.Result = json.RawMessage(result)
+        }
+        q.Details = sessionRequestDetails(r.Context(), q.Method, q.Params)
+        requests = append(requests, q)
+    }
+    writeJSON(w, requests)
+}
+
+// executeSessionRequest performs an approved request with the managed key of
+// the session wallet. Transactions go through submitTransfer like any other
+// transfer, so policies still apply after operator approval.
+func executeSessionRequest(ctx context.Context, method string, params json.RawMessage) (interface{}, error) {
+    var args []json.RawMessage
+    if err := json.Unmarshal(params, &args); err != nil {
+        return nil, &requestError{400, "Invalid params"}
+    }
+    
+    switch method {
+    case "eth_sendTransaction":
+        var tx rpcSendArgs
+        if len(args) < 1 || json.Unmarshal(args[0], &tx) != nil || tx.To == "" {
+            return nil, &requestError{400, "Invalid params"}
+        }
+        id, status, _, err := submitTransfer(ctx, tx.transactionRequest())
+        if err != nil {
+            return nil, err
+        }
+        if status == "held" {
+            return map[string]interface{}{"transfer_id": id, "status": status}, nil
+        }
+        txHash, err := waitForBroadcast(ctx, id, rpcSendTimeout)
+        if err != nil {
+            return nil, &requestError{502, err.Error()}
+        }
+        return map[string]interface{}{"transfer_id": id, "tx_hash": txHash}, nil
+    case "eth_signTypedData", "eth_signTypedData_v4":
+        var address string
+        if len(args) < 2 || json.Unmarshal(args[0], &address) != nil {
+            return nil, &requestError{400, "Invalid params"}
+        }
+        return signTypedData(ctx, address, args[1], true)
+    case "personal_sign":
+        var data hexutil.Bytes
+        var address string
+        if len(args) < 2 || json.Unmarshal(args[0], &data) != nil || json.Unmarshal(args[1], &address) != nil {
+            return nil, &requestError{400, "Invalid params"}
+        }
+        if err := checkWalletAccess(ctx, address); err != nil {
+            return nil, err
+        }
+        if err := checkSignaturePolicy(ctx, address, address); err != nil {
+            return nil, err
+        }
+        sig, err := signHash(ctx, common.HexToAddress(address), accounts.TextHash(data))
+        if err != nil {
+            return nil, err
+        }
+        return hexutil.Encode(sig), nil
+    }
+    return nil, &requestError{400, "Method not supported: " + method}
+}
+
+func (ws *WalletService) HandleApproveSessionRequest(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", 405)
+        return
+    }
+    id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+    if err != nil {
+        http.Error(w, "Invalid id", 400)
+        return
+    }
+    
+    var method, params string
+    var owner sql.NullString
+    client := clientFromContext(r.Context())
+    err = db.QueryRowContext(r.Context(), `UPDATE session_requests q SET status = 'executing', decided_at = now(), decided_by = $2
+        FROM dapp_sessions s
+        WHERE q.id = $1 AND q.status = 'pending' AND s.id = q.session_id AND ($3 OR s.client_id IN ($2, $4))
+        RETURNING q.method, q.params::text, s.client_id`, id, client.ID, client.Admin, client.ApproverFor).Scan(&method, &params, &owner)
+    if err != nil {
+        http.Error(w, "No pending request with that id", 404)
+        return
+    }
+    
+    // The request runs as the client that owns the session, whoever
+    // approved it, and runs to the end even if the operator goes away.
+    ctx := context.WithoutCancel(r.Context())
+    if owner.Valid && owner.String != client.ID {
+        client, err = scanClient(db.QueryRowContext(ctx, "SELECT "+clientColumns+" FROM api_clients WHERE id = $1", owner.String))
+        if err != nil {
+            db.ExecContext(ctx, "UPDATE session_requests SET status = 'failed', error = $2 WHERE id = $1 AND status = 'executing'", id, err.Error())
+            writeError(w, err)
+            return
+        }
+        ctx = context.WithValue(ctx, clientContextKey, client)
+    }
+    
+    result, err := executeSessionRequest(ctx, method, json.RawMessage(params))
+    if err != nil {
+        db.ExecContext(ctx, "UPDATE session_requests SET status = 'failed', error = $2 WHERE id = $1 AND status = 'executing'", id, err.Error())
+        writeError(w, err)
+        return
+    }
+    raw, _ := json.Marshal(result)
+    db.ExecContext(ctx, "UPDATE session_requests SET status = 'approved', result = $2 WHERE id = $1 AND status = 'executing'", id, string(raw))
+    writeJSON(w, result)
+}
+
+func (ws *WalletService) HandleRejectSessionRequest(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", 405)
+        return
+    }
+    client := clientFromContext(r.Context())
+    res, err := db.ExecContext(r.Context(), `UPDATE session_requests q SET status = 'rejected', error = 'Rejected by operator', decided_at = now(), decided_by = $2
+        FROM dapp_sessions s
+        WHERE q.id = $1 AND q.status = 'pending' AND s.id = q.session_id AND ($3 OR s.client_id IN ($2, $4))`,
+        r.URL.Query().Get("id"), client.ID, client.Admin, client.ApproverFor)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        http.Error(w, "No pending request with that id", 404)
+        return
+    }
+    w.Write([]byte("Request rejected"))
+}
+
+// HandleRelayRequest is the dapp side of the relay: it queues a request on
+// an active session. Requests are not signed; the session id authenticates
+// the dapp, and a request is refused unless the address it would sign or
+// send from is the session wallet.
+func (ws *WalletService) HandleRelayRequest(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", 405)
+        return
+    }
+    var body struct {
+        Method string          `json:"method"`
+        Params json.RawMessage `json:"params"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !sessionMethods[body.Method] {
+        http.Error(w, "Invalid request", 400)
+        return
+    }
+    
+    session := r.URL.Query().Get("session")
+    var wallet string
+    err := db.QueryRowContext(r.Context(), "SELECT wallet FROM dapp_sessions WHERE id = $1 AND status = 'active'", session).Scan(&wallet)
+    if err == sql.ErrNoRows {
+        http.Error(w, "Session not found", 404)
+        return
+    }
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if !strings.EqualFold(requestSigner(body.Method, body.Params), wallet) {
+        http.Error(w, "Request is not for the session wallet", 403)
+        return
+    }
+    
+    var id int64
+    err = db.QueryRowContext(r.Context(), "INSERT INTO session_requests (session_id, method, params) VALUES ($1, $2, $3) RETURNING id",
+        session, body.Method, string(body.Params)).Scan(&id)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJSON(w, map[string]int64{"id": id})
+}
+
+// HandleRelayResult lets the dapp wait for the outcome of a request. It
+// returns as soon as the request is decided or after wait seconds.
+func (ws *WalletService) HandleRelayResult(w http.ResponseWriter, r *http.Request) {
+    wait, _ := strconv.Atoi(r.URL.Query().Get("wait"))
+    timeout := time.Duration(wait) * time.Second
+    if timeout > maxRelayWait {
+        timeout = maxRelayWait
+    }
+    ctx, cancel := context.WithTimeout(r.Context(), timeout)
+    defer cancel()
+    
+    for {
+        var q SessionRequest
+        var result string
+        err := db.QueryRowContext(r.Context(), `SELECT id, method, status, COALESCE(result::text, ''), COALESCE(error, ''), created_at
+            FROM session_requests WHERE id = $1 AND session_id = $2`, r.URL.Query().Get("id"), r.URL.Query().Get("session")).
+            Scan(&q.ID, &q.Method, &q.Status, &result, &q.Error, &q.CreatedAt)
+        if err == sql.ErrNoRows {
+            http.Error(w, "Request not found", 404)
+            return
+        }
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        if result != "" {
+            q.Result = json.RawMessage(result)
+        }
+        if (q.Status != "pending" && q.Status != "executing") || ctx.Err() != nil {
+            writeJSON(w, q)
+            return
+        }
+        select {
+        case <-ctx.Done():
+        case <-time.After(500 * time.Millisecond):
+        }
+    }
+}
+
+// failInterruptedRequests fails requests left executing for longer than
+// sessionExecuteTimeout, which only happens when the replica running them
+// died mid-request. A transaction may or may not have been submitted, so the
+// error tells the operator to check before the dapp retries.
+func failInterruptedRequests(ctx context.Context) (int64, error) {
+    res, err := db.ExecContext(ctx, `UPDATE session_requests SET status = 'failed', error = 'Execution interrupted; check transfers before retrying'
+        WHERE status = 'executing' AND decided_at < now() - $1::int * interval '1 second'`, int(sessionExecuteTimeout/time.Second))
+    if err != nil {
+        return 0, err
+    }
+    return res.RowsAffected()
+}
+
+func runSessionJanitor() {
+    for {
+        time.Sleep(time.Minute)
+        n, err := failInterruptedRequests(context.Background())
+        if err != nil {
+            log.Println("Session janitor failed:", err)
+            continue
+        }
+        if n > 0 {
+            log.Println("Failed", n, "interrupted session requests")
+        }
+    }
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "testing"
+)
+
+func TestSessionCreationRequiresWalletOwnership(t *testing.T) {
+    testDB(t)
+    testKeyStore(t)
+    account, err := keyStore.NewAccount("")
+    if err != nil {
+        t.Fatal(err)
+    }
+    owner := addClient(t, &APIClient{ID: "owner"})
+    other := addClient(t, &APIClient{ID: "other"})
+    mustExec(t, "INSERT INTO wallets (address, balance, client_id) VALUES ($1, 0, 'owner')", account.Address.Hex())
+    
+    body := fmt.Sprintf(`{"wallet":%q,"dapp_name":"dapp"}`, account.Address.Hex())
+    ws := new(WalletService)
+    if w := serve(ws.HandleSessions, other, "POST", "/sessions", body); w.Code != 403 {
+        t.Errorf("other client: status %d, want 403", w.Code)
+    }
+    if w := serve(ws.HandleSessions, owner, "POST", "/sessions", body); w.Code != 200 {
+        t.Errorf("owner: status %d, want 200 (%s)", w.Code, w.Body)
+    }
+    if w := serve(ws.HandleSessions, other, "GET", "/sessions", ""); w.Body.String() != "[]\n" {
+        t.Errorf("other client lists %s, want no sessions", w.Body)
+    }
+}
+
+func TestSessionRequestDecisionsAreTenantScoped(t *testing.T) {
+    testDB(t)
+    addClient(t, &APIClient{ID: "owner"})
+    tests := []struct {
+        client  *APIClient
+        allowed bool
+    }{
+        {addClient(t, &APIClient{ID: "other"}), false},
+        {addClient(t, &APIClient{ID: "approver", ApproverFor: "other"}), false},
+        {addClient(t, &APIClient{ID: "owner-approver", ApproverFor: "owner"}), true},
+        {addClient(t, &APIClient{ID: "admin", Admin: true}), true},
+        {&APIClient{ID: "owner"}, true},
+    }
+    mustExec(t, "INSERT INTO dapp_sessions (id, wallet, dapp_name, client_id) VALUES ('s', '0x1', 'dapp', 'owner')")
+    ws := new(WalletService)
+    for _, tt := range tests {
+        // The params are invalid, so an approval that gets past the tenant
+        // check fails with a 400 instead of signing anything.
+        approve, reject := 404, 404
+        if tt.allowed {
+            approve, reject = 400, 200
+        }
+        var id int64
+        db.QueryRow("INSERT INTO session_requests (session_id, method, params) VALUES ('s', 'personal_sign', '{}') RETURNING id").Scan(&id)
+        
+        w := serve(ws.HandleSessionRequests, tt.client, "GET", "/sessions/requests", "")
+        if listed := w.Body.String() != "[]\n"; listed != tt.allowed {
+            t.Errorf("%s: listed %v, want %v", tt.client.ID, listed, tt.allowed)
+        }
+        if w := serve(ws.HandleApproveSessionRequest, tt.client, "POST", fmt.Sprintf("/sessions/requests/approve?id=%d", id), ""); w.Code != approve {
+            t.Errorf("%s: approve status %d, want %d", tt.client.ID, w.Code, approve)
+        }
+        db.QueryRow("INSERT INTO session_requests (session_id, method, params) VALUES ('s', 'personal_sign', '{}') RETURNING id").Scan(&id)
+        if w := serve(ws.HandleRejectSessionRequest, tt.client, "POST", fmt.Sprintf("/sessions/requests/reject?id=%d", id), ""); w.Code != reject {
+            t.Errorf("%s: reject status %d, want %d", tt.client.ID, w.Code, reject)
+        }
+        mustExec(t, "DELETE FROM session_requests")
+    }
+}
+
+func TestFailInterruptedRequests(t *testing.T) {
+    testDB(t)
+    mustExec(t, "INSERT INTO dapp_sessions (id, wallet, dapp_name) VALUES ('s', '0x1', 'dapp')")
+    mustExec(t, `INSERT INTO session_requests (session_id, method, params, status, decided_at) VALUES
+        ('s', 'personal_sign', '[]', 'executing', now() - interval '1 hour'),
+        ('s', 'personal_sign', '[]', 'executing', now()),
+        ('s', 'personal_sign', '[]', 'pending', NULL)`)
+    
+    n, err := failInterruptedRequests(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if n != 1 {
+        t.Fatalf("failed %d requests, want only the stale executing one", n)
+    }
+    if n := countRows(t, "SELECT COUNT(*) FROM session_requests WHERE status = 'executing'"); n != 1 {
+        t.Errorf("%d requests still executing, want the fresh one", n)
+    }
+}
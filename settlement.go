@@ -0,0 +1,115 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "strconv"
+    "strings"
+
+    "github.com/ethereum/go-ethereum"
+    "github.com/ethereum/go-ethereum/core/types"
+)
+
+// Settlement has to happen exactly once per transfer, even with receipt
+// watchers running in several replicas or replaying after a restart. Two
+// things make sure of it. A saga step is a row keyed by (transfer, step), so
+// its effects are only applied by the database transaction that inserted it.
+// And every status change is a compare-and-swap: it names the statuses it
+// expects and the version it read, bumps the version, and changes nothing
+// when another writer got there first. A duplicate receipt event finds its
+// step already recorded or loses the swap, and its transaction is rolled back.
+
+type querier interface {
+    execer
+    QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func transferState(ctx context.Context, q querier, id int64) (string, int64, error) {
+    var status string
+    var version int64
+    err := q.QueryRowContext(ctx, "SELECT status, version FROM transfers WHERE id = $1", id).Scan(&status, &version)
+    return status, version, err
+}
+
+// transitionTransfer sets the status of a transfer still at version and in
+// one of the given statuses, and reports whether it did.
+func transitionTransfer(ctx context.Context, ex execer, id, version int64, to string, from ...string) (bool, error) {
+    args := []interface{}{id, version, to}
+    var placeholders []string
+    for _, status := range from {
+        args = append(args, status)
+        placeholders = append(placeholders, "$"+strconv.Itoa(len(args)))
+    }
+    res, err := ex.ExecContext(ctx, "UPDATE transfers SET status = $3, version = version + 1 WHERE id = $1 AND version = $2 AND status IN ("+
+        strings.Join(placeholders, ", ")+")", args...)
+    if err != nil {
+        return false, err
+    }
+    n, _ := res.RowsAffected()
+    return n > 0, nil
+}
+
+// checkReceipt looks up the receipt of a debited transfer on conn's chain
+// and settles it after the chain's confirmations. When there is no receipt but the transaction's nonce has been used, the
+// transaction was dropped or replaced and the transfer fails.
+func checkReceipt(ctx context.Context, conn *chainConn, id int64, head uint64) error {
+    tx, from, err := signedTransaction(ctx, id)
+    if err != nil {
+        return err
+    }
+    receipt, err := conn.eth.TransactionReceipt(ctx, tx.Hash())
+    if err == ethereum.NotFound {
+        mined, err := conn.eth.NonceAt(ctx, from, nil)
+        if err != nil {
+            return err
+        }
+        if mined > tx.Nonce() {
+            return failTransfer(ctx, id, "transaction dropped or replaced")
+        }
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    return settleReceipt(ctx, id, receipt, head, conn.Confirmations)
+}
+
+// settleReceipt applies a receipt event to a completed transfer: a reverted
+// transaction fails it, a successful one confirms it once it is deep enough.
+// Applying the same receipt again has no effect.
+func settleReceipt(ctx context.Context, id int64, receipt *types.Receipt, head uint64, confirmations int) error {
+    if receipt.Status != types.ReceiptStatusSuccessful {
+        return failTransfer(ctx, id, "transaction reverted")
+    }
+    if head+1 < receipt.BlockNumber.Uint64()+uint64(confirmations) {
+        return nil
+    }
+    
+    dbTx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer dbTx.Rollback()
+    
+    status, version, err := transferState(ctx, dbTx, id)
+    if err != nil || status != "completed" {
+        return err
+    }
+    confirmed, err := recordStep(ctx, dbTx, id, stepConfirmed, receipt.BlockNumber.String())
+    if err != nil || !confirmed {
+        return err
+    }
+    if ok, err := transitionTransfer(ctx, dbTx, id, version, "completed", "completed"); err != nil || !ok {
+        return err
+    }
+    if err := queueCallback(ctx, dbTx, id); err != nil {
+        return err
+    }
+    if err := dbTx.Commit(); err != nil {
+        return err
+    }
+    wakeCallbacks()
+    go notifyTransfer(id, eventSent)
+    go notifyTransfer(id, eventReceived)
+    return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+    "context"
+    "math/big"
+    "sync"
+    "testing"
+
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/core/types"
+)
+
+// Every settlement operation may run more than once, from a retry or from
+// another replica, and must take effect exactly once.
+func TestSettlementIsIdempotent(t *testing.T) {
+    const from = "0x1111111111111111111111111111111111111111"
+    to := common.HexToAddress("0x2222222222222222222222222222222222222222")
+    tx := types.NewTx(&types.DynamicFeeTx{ChainID: big.NewInt(1337), GasFeeCap: big.NewInt(1), Gas: 21000, To: &to, Value: big.NewInt(1e18)})
+    receipt := func(status uint64) *types.Receipt {
+        return &types.Receipt{Status: status, BlockNumber: big.NewInt(10), TxHash: tx.Hash()}
+    }
+    ctx := context.Background()
+    
+    tests := []struct {
+        name      string
+        debited   bool // whether the transfer was broadcast and debited beforehand
+        op        func(id int64) error
+        status    string
+        balance   float64
+        callbacks int
+    }{
+        {"complete", false, func(id int64) error { return completeTransfer(ctx, id, tx) }, "completed", 9, 0},
+        {"settle", true, func(id int64) error { return settleReceipt(ctx, id, receipt(types.ReceiptStatusSuccessful), 20, 1) }, "completed", 9, 1},
+        {"settle reverted", true, func(id int64) error { return settleReceipt(ctx, id, receipt(types.ReceiptStatusFailed), 20, 1) }, "failed", 10, 1},
+        {"fail before debit", false, func(id int64) error { return failTransfer(ctx, id, "test") }, "failed", 10, 1},
+        {"fail after debit", true, func(id int64) error { return failTransfer(ctx, id, "test") }, "failed", 10, 1},
+    }
+    for _, tt := range tests {
+        for _, concurrent := range []bool{false, true} {
+            name := tt.name + "/twice"
+            if concurrent {
+                name = tt.name + "/concurrently"
+            }
+            t.Run(name, func(t *testing.T) {
+                testDB(t)
+                mustExec(t, "INSERT INTO wallets (address, balance) VALUES ($1, 10)", from)
+                var id int64
+                err := db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status, callback_url)
+                    VALUES ($1, $2, 1, 'processing', 'https://8.8.8.8/hook') RETURNING id`, from, to.Hex()).Scan(&id)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if tt.debited {
+                    if err := completeTransfer(ctx, id, tx); err != nil {
+                        t.Fatal(err)
+                    }
+                }
+                var version int64
+                db.QueryRow("SELECT version FROM transfers WHERE id = $1", id).Scan(&version)
+                
+                runs := 2
+                if concurrent {
+                    runs = 8
+                }
+                errs := make(chan error, runs)
+                var wg sync.WaitGroup
+                for i := 0; i < runs; i++ {
+                    wg.Add(1)
+                    run := func() {
+                        defer wg.Done()
+                        errs <- tt.op(id)
+                    }
+                    if concurrent {
+                        go run()
+                    } else {
+                        run()
+                    }
+                }
+                wg.Wait()
+                close(errs)
+                for err := range errs {
+                    if err != nil {
+                        t.Fatal(err)
+                    }
+                }
+                
+                if n := countRows(t, "SELECT COUNT(*) FROM transfers WHERE id = $1 AND status = $2 AND version = $3", id, tt.status, version+1); n != 1 {
+                    t.Errorf("transfer is not %s at version %d", tt.status, version+1)
+                }
+                var balance float64
+                db.QueryRow("SELECT balance FROM wallets WHERE address = $1", from).Scan(&balance)
+                if balance != tt.balance {
+                    t.Errorf("balance %v, want %v", balance, tt.balance)
+                }
+                if n := countRows(t, "SELECT COUNT(*) FROM callbacks WHERE transfer_id = $1", id); n != tt.callbacks {
+                    t.Errorf("%d callbacks, want %d", n, tt.callbacks)
+                }
+            })
+        }
+    }
+}
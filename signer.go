@@ -0,0 +1,139 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log"
+    "math/big"
+    "os"
+
+    "github.com/ethereum/go-ethereum"
+    "github.com/ethereum/go-ethereum/accounts"
+    "github.com/ethereum/go-ethereum/accounts/keystore"
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/core/types"
+)
+
+var keyStore *keystore.KeyStore
+var chainID *big.Int
+
+var errUnmanagedAddress = errors.New("Address is not a managed wallet")
+
+// openKeyStore loads the managed keys from KEYSTORE_DIR and unlocks them with
+// KEYSTORE_PASSWORD so transfers can be signed without a passphrase.
+func openKeyStore() {
+    dir := os.Getenv("KEYSTORE_DIR")
+    if dir == "" {
+        dir = "./keystore"
+    }
+    keyStore = keystore.NewKeyStore(dir, keystore.StandardScryptN, keystore.StandardScryptP)
+    
+    password := os.Getenv("KEYSTORE_PASSWORD")
+    for _, account := range keyStore.Accounts() {
+        if err := keyStore.Unlock(account, password); err != nil {
+            log.Println("Failed to unlock", account.Address.Hex(), err)
+        }
+    }
+}
+
+func (req TransactionRequest) gas() uint64 {
+    if req.Gas > 0 {
+        return req.Gas
+    }
+    return gasLimit
+}
+
+// sendTransfer signs req with the managed key of its From address and
+// broadcasts it on conn's chain. Contract calls without an explicit gas limit are estimated.
+// A nil transaction means nothing was signed; a transaction with an error
+// means it was signed but the broadcast failed.
+func sendTransfer(ctx context.Context, conn *chainConn, id int64, req TransactionRequest) (*types.Transaction, error) {
+    from := common.HexToAddress(req.From)
+    to := common.HexToAddress(req.To)
+    if !keyStore.HasAddress(from) {
+        return nil, errUnmanagedAddress
+    }
+    
+    value := req.weiAmount()
+    data := common.FromHex(req.Data)
+    gas := req.gas()
+    if req.Gas == 0 && len(data) > 0 {
+        estimated, err := conn.eth.EstimateGas(ctx, ethereum.CallMsg{From: from, To: &to, Value: value, Data: data})
+        if err != nil {
+            return nil, err
+        }
+        gas = estimated
+    }
+    
+    nonce, err := allocateNonce(ctx, conn, from, id)
+    if err != nil {
+        return nil, err
+    }
+    signed, err := signAndSend(ctx, conn, from, nonce, to, value, data, gas, laneFor(req.Priority))
+    if signed == nil {
+        releaseNonce(conn, from, nonce)
+    }
+    return signed, err
+}
+
+// signAndSend signs and broadcasts a transaction with a nonce already
+// reserved in the nonce table, recording the raw transaction first so it can
+// be re-sent if it never reaches the node. Fees follow the lane's pricing;
+// with conn's chain on the legacy fee model the lane's fee cap is the gas
+// price. The signed
+// transaction is returned even when broadcasting it fails.
+func signAndSend(ctx context.Context, conn *chainConn, from common.Address, nonce uint64, to common.Address, value *big.Int, data []byte, gas uint64,
+    l *lane) (*types.Transaction, error) {
+    fees, err := currentFees(ctx, conn)
+    if err != nil {
+        return nil, err
+    }
+    feeCap, tip := l.feeCap(fees), l.tip(fees)
+    
+    id := big.NewInt(conn.ChainID)
+    var tx *types.Transaction
+    if conn.FeeModel == feeModelLegacy {
+        tx = types.NewTx(&types.LegacyTx{Nonce: nonce, GasPrice: feeCap, Gas: gas, To: &to, Value: value, Data: data})
+    } else {
+        tx = types.NewTx(&types.DynamicFeeTx{
+            ChainID:   id,
+            Nonce:     nonce,
+            GasTipCap: tip,
+            GasFeeCap: feeCap,
+            Gas:       gas,
+            To:        &to,
+            Value:     value,
+            Data:      data,
+        })
+    }
+    signed, err := keyStore.SignTx(accounts.Account{Address: from}, tx, id)
+    if err != nil {
+        return nil, err
+    }
+    if err := recordSignedNonce(ctx, conn, from, signed); err != nil {
+        return nil, err
+    }
+    err = conn.eth.SendTransaction(ctx, signed)
+    if err == nil || broadcastAccepted(err) {
+        markNonceSent(ctx, conn, from, nonce)
+    }
+    return signed, err
+}
+
+// signHash signs a 32-byte hash with a managed key the calling client owns
+// and returns the signature with the recovery id in Ethereum's 27/28 form.
+// Errors are request errors.
+func signHash(ctx context.Context, address common.Address, hash []byte) ([]byte, error) {
+    if !keyStore.HasAddress(address) {
+        return nil, &requestError{400, errUnmanagedAddress.Error()}
+    }
+    if err := checkWalletAccess(ctx, address.Hex()); err != nil {
+        return nil, err
+    }
+    sig, err := keyStore.SignHash(accounts.Account{Address: address}, hash)
+    if err != nil {
+        return nil, &requestError{400, err.Error()}
+    }
+    sig[64] += 27
+    return sig, nil
+}
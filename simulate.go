@@ -0,0 +1,326 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "math/big"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/ethereum/go-ethereum"
+    "github.com/ethereum/go-ethereum/accounts/abi"
+    "github.com/ethereum/go-ethereum/common"
+    "github.com/ethereum/go-ethereum/common/hexutil"
+    "github.com/ethereum/go-ethereum/crypto"
+)
+
+// Transfers are simulated with debug_traceCall against the latest block of
+// their chain:
+// the prestate tracer in diff mode gives native balance changes and the call
+// tracer gives emitted logs, from which token transfers are derived. Nodes
+// without the debug API fall back to eth_call, which can only tell whether
+// the call reverts; no local EVM is run.
+
+var (
+    transferEventTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+    approvalEventTopic = crypto.Keccak256Hash([]byte("Approval(address,address,uint256)"))
+)
+
+type BalanceChange struct {
+    Wallet  string `json:"wallet"`
+    Asset   string `json:"asset"`
+    Token   string `json:"token,omitempty"`
+    Delta   string `json:"delta"`
+    Display string `json:"display"`
+}
+
+type SimulatedEvent struct {
+    Address string   `json:"address"`
+    Name    string   `json:"name,omitempty"`
+    Topics  []string `json:"topics"`
+    Data    string   `json:"data"`
+}
+
+type Simulation struct {
+    Method         string           `json:"method"`
+    Success        bool             `json:"success"`
+    Error          string           `json:"error,omitempty"`
+    GasUsed        uint64           `json:"gas_used,omitempty"`
+    StateDiff      bool             `json:"state_diff"`
+    BalanceChanges []BalanceChange  `json:"balance_changes"`
+    Events         []SimulatedEvent `json:"events"`
+}
+
+type traceLog struct {
+    Address common.Address `json:"address"`
+    Topics  []common.Hash  `json:"topics"`
+    Data    hexutil.Bytes  `json:"data"`
+}
+
+type callFrame struct {
+    GasUsed      hexutil.Uint64 `json:"gasUsed"`
+    Error        string         `json:"error"`
+    RevertReason string         `json:"revertReason"`
+    Calls        []callFrame    `json:"calls"`
+    Logs         []traceLog     `json:"logs"`
+}
+
+type prestateAccount struct {
+    Balance *hexutil.Big `json:"balance"`
+}
+
+type prestateDiff struct {
+    Pre  map[common.Address]prestateAccount `json:"pre"`
+    Post map[common.Address]prestateAccount `json:"post"`
+}
+
+// collectLogs returns the logs of frame and its successful subcalls in
+// emission order. Logs of reverted frames are dropped as the chain would.
+func (frame callFrame) collectLogs() []traceLog {
+    if frame.Error != "" {
+        return nil
+    }
+    logs := append([]traceLog{}, frame.Logs...)
+    for _, call := range frame.Calls {
+        logs = append(logs, call.collectLogs()...)
+    }
+    return logs
+}
+
+func isManagedWallet(ctx context.Context, address common.Address) bool {
+    if keyStore.HasAddress(address) {
+        return true
+    }
+    // Addresses are stored as submitted, so match both spellings rather than
+    // lower() the column, which would bypass the primary key index.
+    var exists bool
+    db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM wallets WHERE address IN ($1, $2))",
+        address.Hex(), strings.ToLower(address.Hex())).Scan(&exists)
+    return exists
+}
+
+func simulateTransfer(ctx context.Context, conn *chainConn, req TransactionRequest) (*Simulation, error) {
+    from := common.HexToAddress(req.From)
+    to := common.HexToAddress(req.To)
+    value := req.weiAmount()
+    data := common.FromHex(req.Data)
+    
+    call := map[string]interface{}{
+        "from":  from,
+        "to":    to,
+        "value": (*hexutil.Big)(value),
+        "data":  hexutil.Bytes(data),
+    }
+    if req.Gas > 0 {
+        call["gas"] = hexutil.Uint64(req.Gas)
+    }
+    
+    var frame callFrame
+    err := conn.eth.Client().CallContext(ctx, &frame, "debug_traceCall", call, "latest",
+        map[string]interface{}{"tracer": "callTracer", "tracerConfig": map[string]interface{}{"withLog": true}})
+    if err != nil {
+        return simulateWithCall(ctx, conn, from, to, value, data)
+    }
+    var diff prestateDiff
+    err = conn.eth.Client().CallContext(ctx, &diff, "debug_traceCall", call, "latest",
+        map[string]interface{}{"tracer": "prestateTracer", "tracerConfig": map[string]interface{}{"diffMode": true}})
+    if err != nil {
+        return simulateWithCall(ctx, conn, from, to, value, data)
+    }
+    
+    sim := &Simulation{Method: "debug_traceCall", Success: frame.Error == "", GasUsed: uint64(frame.GasUsed), StateDiff: true,
+        BalanceChanges: []BalanceChange{}, Events: []SimulatedEvent{}}
+    if !sim.Success {
+        sim.Error = frame.Error
+        if frame.RevertReason != "" {
+            sim.Error += ": " + frame.RevertReason
+        }
+        return sim, nil
+    }
+    
+    // An account missing from pre did not exist before the call, so its
+    // balance was zero. A nil post balance means the balance did not change.
+    for address, post := range diff.Post {
+        if post.Balance == nil || !isManagedWallet(ctx, address) {
+            continue
+        }
+        delta := new(big.Int).Set(post.Balance.ToInt())
+        if pre := diff.Pre[address]; pre.Balance != nil {
+            delta.Sub(delta, pre.Balance.ToInt())
+        }
+        if delta.Sign() != 0 {
+            sim.BalanceChanges = append(sim.BalanceChanges, nativeChange(address, delta))
+        }
+    }
+    
+    logs := frame.collectLogs()
+    tokenChanges, err := tokenBalanceChanges(ctx, logs)
+    if err != nil {
+        return nil, err
+    }
+    sim.BalanceChanges = append(sim.BalanceChanges, tokenChanges...)
+    for _, l := range logs {
+        sim.Events = append(sim.Events, describeLog(ctx, l))
+    }
+    return sim, nil
+}
+
+func nativeChange(wallet common.Address, delta *big.Int) BalanceChange {
+    return BalanceChange{Wallet: wallet.Hex(), Asset: "ETH", Delta: delta.String(), Display: formatUnits(delta, 18) + " ETH"}
+}
+
+func simulateWithCall(ctx context.Context, conn *chainConn, from, to common.Address, value *big.Int, data []byte) (*Simulation, error) {
+    sim := &Simulation{Method: "eth_call", Success: true, BalanceChanges: []BalanceChange{}, Events: []SimulatedEvent{}}
+    msg := ethereum.CallMsg{From: from, To: &to, Value: value, Data: data}
+    if _, err := conn.eth.CallContract(ctx, msg, nil); err != nil {
+        sim.Success = false
+        sim.Error = err.Error()
+        return sim, nil
+    }
+    if gas, err := conn.eth.EstimateGas(ctx, msg); err == nil {
+        sim.GasUsed = gas
+    }
+    if value.Sign() > 0 {
+        if isManagedWallet(ctx, from) {
+            sim.BalanceChanges = append(sim.BalanceChanges, nativeChange(from, new(big.Int).Neg(value)))
+        }
+        if isManagedWallet(ctx, to) {
+            sim.BalanceChanges = append(sim.BalanceChanges, nativeChange(to, value))
+        }
+    }
+    return sim, nil
+}
+
+// tokenBalanceChanges nets ERC-20 Transfer events per managed wallet and
+// token. ERC-721 transfers, which carry the token id as a topic, are skipped.
+func tokenBalanceChanges(ctx context.Context, logs []traceLog) ([]BalanceChange, error) {
+    type key struct{ wallet, token common.Address }
+    deltas := map[key]*big.Int{}
+    var order []key
+    add := func(k key, v *big.Int) {
+        if deltas[k] == nil {
+            deltas[k] = new(big.Int)
+            order = append(order, k)
+        }
+        deltas[k].Add(deltas[k], v)
+    }
+    for _, l := range logs {
+        if len(l.Topics) != 3 || l.Topics[0] != transferEventTopic || len(l.Data) != 32 {
+            continue
+        }
+        amount := new(big.Int).SetBytes(l.Data)
+        from := common.BytesToAddress(l.Topics[1].Bytes())
+        to := common.BytesToAddress(l.Topics[2].Bytes())
+        if isManagedWallet(ctx, from) {
+            add(key{from, l.Address}, new(big.Int).Neg(amount))
+        }
+        if isManagedWallet(ctx, to) {
+            add(key{to, l.Address}, amount)
+        }
+    }
+    
+    changes := []BalanceChange{}
+    for _, k := range order {
+        if deltas[k].Sign() == 0 {
+            continue
+        }
+        change := BalanceChange{Wallet: k.wallet.Hex(), Asset: k.token.Hex(), Token: k.token.Hex(), Delta: deltas[k].String(), Display: deltas[k].String()}
+        token, err := lookupToken(ctx, k.token.Hex())
+        if err != nil {
+            return nil, err
+        }
+        if token != nil {
+            change.Asset = token.Symbol
+            change.Display = formatUnits(deltas[k], token.Decimals) + " " + token.Symbol
+        }
+        changes = append(changes, change)
+    }
+    return changes, nil
+}
+
+func describeLog(ctx context.Context, l traceLog) SimulatedEvent {
+    ev := SimulatedEvent{Address: l.Address.Hex(), Data: hexutil.Encode(l.Data), Topics: []string{}}
+    for _, topic := range l.Topics {
+        ev.Topics = append(ev.Topics, topic.Hex())
+    }
+    if len(l.Topics) == 0 {
+        return ev
+    }
+    switch l.Topics[0] {
+    case transferEventTopic:
+        ev.Name = "Transfer"
+    case approvalEventTopic:
+        ev.Name = "Approval"
+    default:
+        var contractABI string
+        err := db.QueryRowContext(ctx, "SELECT abi::text FROM abi_registry WHERE address = $1", strings.ToLower(l.Address.Hex())).Scan(&contractABI)
+        if err != nil && err != sql.ErrNoRows {
+            return ev
+        }
+        if parsed, err := abi.JSON(strings.NewReader(contractABI)); err == nil {
+            if event, err := parsed.EventByID(l.Topics[0]); err == nil {
+                ev.Name = event.Name
+            }
+        }
+    }
+    return ev
+}
+
+// HandleSimulate simulates either a stored transfer (?id=) or the transfer
+// in the request body. Clients may only simulate their own transfers and
+// transfers from their own wallets.
+func (ws *WalletService) HandleSimulate(w http.ResponseWriter, r *http.Request) {
+    var req TransactionRequest
+    owner := clientID(r.Context())
+    if id := r.URL.Query().Get("id"); id != "" {
+        transferID, err := strconv.ParseInt(id, 10, 64)
+        if err != nil {
+            http.Error(w, "Invalid id", 400)
+            return
+        }
+        conds, args := tenantFilter(r.Context(), "client_id", []string{"id = $1"}, []interface{}{transferID})
+        var wei string
+        err = db.QueryRowContext(r.Context(), "SELECT from_address, to_address, amount, "+amountWeiSQL+", COALESCE(data, ''), chain_id, COALESCE(client_id, '') FROM transfers"+
+            whereClause(conds), args...).Scan(&req.From, &req.To, &req.Amount, &wei, &req.Data, &req.ChainID, &owner)
+        if err == sql.ErrNoRows {
+            http.Error(w, "Transfer not found", 404)
+            return
+        }
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        req.wei = parseWei(wei)
+    } else {
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            http.Error(w, "Invalid request", 400)
+            return
+        }
+        if err := req.normalizeAmount(); err != nil {
+            writeError(w, err)
+            return
+        }
+        if err := checkWalletAccess(r.Context(), req.From); err != nil {
+            writeError(w, err)
+            return
+        }
+    }
+    if !common.IsHexAddress(req.From) || !common.IsHexAddress(req.To) {
+        http.Error(w, "Invalid address", 400)
+        return
+    }
+    
+    conn, err := openChain(r.Context(), owner, req.ChainID)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    sim, err := simulateTransfer(r.Context(), conn, req)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJSON(w, sim)
+}
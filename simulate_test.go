@@ -0,0 +1,99 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "strconv"
+    "strings"
+    "testing"
+
+    "github.com/ethereum/go-ethereum/common"
+)
+
+func TestSimulateCountsNewAccountsFromZero(t *testing.T) {
+    testDB(t)
+    testKeyStore(t)
+    node := testNode(t)
+    from := "0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+    to := "0xbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+    // The recipient is stored checksummed and the sender lower-case; both
+    // must be recognised as managed.
+    mustExec(t, "INSERT INTO wallets (address, balance) VALUES ($1, 1), ($2, 0)", from, common.HexToAddress(to).Hex())
+    node.handle("debug_traceCall", func(params []json.RawMessage) (interface{}, error) {
+        if strings.Contains(string(params[2]), "prestateTracer") {
+            // The recipient did not exist before the call, so it has no pre.
+            return map[string]interface{}{
+                "pre":  map[string]interface{}{from: map[string]string{"balance": "0xde0b6b3a7640000"}},
+                "post": map[string]interface{}{from: map[string]string{"balance": "0x0"}, to: map[string]string{"balance": "0xde0b6b3a7640000"}},
+            }, nil
+        }
+        return map[string]interface{}{"gasUsed": "0x5208"}, nil
+    })
+    
+    sim, err := simulateTransfer(context.Background(), connectedChain(t, ""), TransactionRequest{From: from, To: to, Amount: 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    deltas := map[string]string{}
+    for _, c := range sim.BalanceChanges {
+        deltas[strings.ToLower(c.Wallet)] = c.Delta
+    }
+    if deltas[from] != "-1000000000000000000" || deltas[to] != "1000000000000000000" {
+        t.Fatalf("got balance changes %v, want one ether moved to the new account", deltas)
+    }
+}
+
+func TestSimulateIsTenantScoped(t *testing.T) {
+    testDB(t)
+    tenant := addClient(t, &APIClient{ID: "tenant"})
+    addClient(t, &APIClient{ID: "other"})
+    mustExec(t, "INSERT INTO wallets (address, balance, client_id) VALUES ('0x1111111111111111111111111111111111111111', 5, 'other')")
+    var id int64
+    db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status, client_id)
+        VALUES ('0x1111111111111111111111111111111111111111', '0x2222222222222222222222222222222222222222', 1, 'pending', 'other')
+        RETURNING id`).Scan(&id)
+    
+    ws := new(WalletService)
+    if w := serve(ws.HandleSimulate, tenant, "POST", "/simulate?id="+strconv.FormatInt(id, 10), ""); w.Code != 404 {
+        t.Errorf("other tenant's transfer: status %d, want 404", w.Code)
+    }
+    body := `{"from":"0x1111111111111111111111111111111111111111","to":"0x2222222222222222222222222222222222222222","amount":1}`
+    if w := serve(ws.HandleSimulate, tenant, "POST", "/simulate", body); w.Code != 403 {
+        t.Errorf("other tenant's wallet: status %d, want 403", w.Code)
+    }
+}
+
+func TestSimulateStoredTransferUsesExactWei(t *testing.T) {
+    testDB(t)
+    testKeyStore(t)
+    node := testNode(t)
+    var id int64
+    db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, amount_wei, status)
+        VALUES ('0x1111111111111111111111111111111111111111', '0x2222222222222222222222222222222222222222', 1, 1000000000000000001, 'pending')
+        RETURNING id`).Scan(&id)
+    var values []string
+    node.handle("debug_traceCall", func(params []json.RawMessage) (interface{}, error) {
+        var call struct {
+            Value string `json:"value"`
+        }
+        json.Unmarshal(params[0], &call)
+        values = append(values, call.Value)
+        if strings.Contains(string(params[2]), "prestateTracer") {
+            return map[string]interface{}{"pre": map[string]interface{}{}, "post": map[string]interface{}{}}, nil
+        }
+        return map[string]interface{}{"gasUsed": "0x5208"}, nil
+    })
+    
+    ws := new(WalletService)
+    if w := serve(ws.HandleSimulate, nil, "POST", "/simulate?id="+strconv.FormatInt(id, 10), ""); w.Code != 200 {
+        t.Fatalf("status %d: %s", w.Code, w.Body)
+    }
+    if len(values) == 0 {
+        t.Fatal("nothing simulated")
+    }
+    for _, v := range values {
+        if v != "0xde0b6b3a7640001" {
+            t.Errorf("simulated with value %s, want 1000000000000000001 wei", v)
+        }
+    }
+}
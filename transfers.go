@@ -0,0 +1,187 @@
+package main
+
+import (
+    "database/sql"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+type Transfer struct {
+    ID          int64        `json:"id"`
+    From        string       `json:"from"`
+    To          string       `json:"to"`
+    Amount      float64      `json:"amount"`
+    AmountUnits Amount       `json:"amount_units"`
+    Status      string       `json:"status"`
+    ChainID     int64        `json:"chain_id"`
+    Data        string       `json:"data,omitempty"`
+    Decoded     *DecodedCall `json:"decoded,omitempty"`
+    DecodeError string       `json:"decode_error,omitempty"`
+    Simulation  *Simulation  `json:"simulation,omitempty"`
+    TxHash      string       `json:"tx_hash,omitempty"`
+    TxURL       string       `json:"tx_url,omitempty"`
+    ReceiptURL  string       `json:"receipt_url"`
+    CreatedAt   time.Time    `json:"created_at"`
+}
+
+func (ws *WalletService) HandleListTransfers(w http.ResponseWriter, r *http.Request) {
+    unit, err := responseUnit(r)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    conds, args := walletFilter(r, "from_address", nil)
+    conds, args = tenantFilter(r.Context(), "client_id", conds, args)
+    if status := r.URL.Query().Get("status"); status != "" {
+        args = append(args, status)
+        conds = append(conds, "status = $"+strconv.Itoa(len(args)))
+    }
+    query := "SELECT id, from_address, to_address, amount, " + amountWeiSQL + ", status, COALESCE(data, ''), COALESCE(tx_hash, ''), created_at, chain_id," +
+        " COALESCE(client_id, '') FROM transfers" + whereClause(conds) + " ORDER BY id DESC LIMIT 500"
+    
+    rows, err := db.QueryContext(r.Context(), query, args...)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer rows.Close()
+    
+    // Transfers link to the explorer of their own chain as their owner
+    // defines it.
+    transfers := []Transfer{}
+    owners := []string{}
+    keys := []int64{}
+    for rows.Next() {
+        var t Transfer
+        var wei, owner string
+        var key int64
+        if err := rows.Scan(&t.ID, &t.From, &t.To, &t.Amount, &wei, &t.Status, &t.Data, &t.TxHash, &t.CreatedAt, &key, &owner); err != nil {
+            writeError(w, err)
+            return
+        }
+        t.ChainID = storedChainID(key)
+        t.AmountUnits = newAmount(parseWei(wei), unit, nativeUnits[unit])
+        t.ReceiptURL = "/transfers/receipt?id=" + strconv.FormatInt(t.ID, 10)
+        transfers = append(transfers, t)
+        owners, keys = append(owners, owner), append(keys, key)
+    }
+    rows.Close()
+    
+    chains := map[string]*Chain{}
+    for i := range transfers {
+        t := &transfers[i]
+        name := owners[i] + ":" + strconv.FormatInt(keys[i], 10)
+        chain, ok := chains[name]
+        if !ok {
+            if chain, err = lookupChain(r.Context(), owners[i], t.ChainID); err != nil {
+                writeError(w, err)
+                return
+            }
+            chains[name] = chain
+        }
+        if chain != nil {
+            t.TxURL = chain.txURL(t.TxHash)
+        }
+    }
+    
+    var to, calldata []string
+    for _, t := range transfers {
+        if t.Data != "" {
+            to, calldata = append(to, t.To), append(calldata, t.Data)
+        }
+    }
+    decoder, err := loadDecoder(r.Context(), to, calldata)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    
+    // Calldata that does not decode is reported on its transfer rather than
+    // failing the whole listing.
+    simulate := r.URL.Query().Get("simulate") == "true"
+    for i := range transfers {
+        t := &transfers[i]
+        if simulate && (t.Status == "held" || t.Status == "pending") {
+            conn, err := openChain(r.Context(), owners[i], keys[i])
+            if err != nil {
+                writeError(w, err)
+                return
+            }
+            sim, err := simulateTransfer(r.Context(), conn, TransactionRequest{From: t.From, To: t.To, Amount: t.Amount, Data: t.Data})
+            if err != nil {
+                writeError(w, err)
+                return
+            }
+            t.Simulation = sim
+        }
+        if t.Data == "" {
+            continue
+        }
+        t.Decoded, err = decoder.decode(t.To, t.Data)
+        if err != nil {
+            t.DecodeError = err.Error()
+        }
+    }
+    writeJSON(w, transfers)
+}
+
+func (ws *WalletService) HandleApproveTransfer(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", 405)
+        return
+    }
+    id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+    if err != nil {
+        http.Error(w, "Invalid id", 400)
+        return
+    }
+    client := clientFromContext(r.Context())
+    if !client.Admin && client.ApproverFor == "" {
+        http.Error(w, "Forbidden", 403)
+        return
+    }
+    
+    // The submitting client never approves its own transfer, and approvers
+    // only see the held transfers of the client they approve for.
+    var from string
+    err = db.QueryRowContext(r.Context(), `UPDATE transfers SET status = 'pending', version = version + 1
+        WHERE id = $1 AND status = 'held' AND client_id IS DISTINCT FROM $2 AND ($3 OR client_id = $4)
+        RETURNING from_address`, id, client.ID, client.Admin, client.ApproverFor).
+        Scan(&from)
+    if err != nil {
+        http.Error(w, "No held transfer with that id", 404)
+        return
+    }
+    
+    queue.wake(from)
+    
+    w.Write([]byte("Transaction started"))
+}
+
+func (ws *WalletService) HandleRejectTransfer(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", 405)
+        return
+    }
+    id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+    if err != nil {
+        http.Error(w, "Invalid id", 400)
+        return
+    }
+    
+    // Besides admins and approvers, the submitting client may withdraw its own
+    // held transfer.
+    client := clientFromContext(r.Context())
+    err = finishQueuedTransfer(r.Context(), id, `UPDATE transfers SET status = 'rejected', version = version + 1
+        WHERE id = $1 AND status = 'held' AND ($2 OR client_id = $3 OR client_id = $4)`, client.Admin, client.ID, client.ApproverFor)
+    if err == sql.ErrNoRows {
+        http.Error(w, "No held transfer with that id", 404)
+        return
+    }
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    w.Write([]byte("Transaction rejected"))
+}
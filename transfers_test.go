@@ -0,0 +1,115 @@
+package main
+
+import (
+    "encoding/json"
+    "strconv"
+    "testing"
+)
+
+func TestApproveTransfer(t *testing.T) {
+    testDB(t)
+    // Keep approved transfers in the queue instead of sending them.
+    queue = &transferQueue{running: map[string]bool{"0xa": true}, again: map[string]bool{}}
+    tenant := addClient(t, &APIClient{ID: "tenant"})
+    other := addClient(t, &APIClient{ID: "other"})
+    approver := addClient(t, &APIClient{ID: "approver", ApproverFor: "tenant"})
+    admin := addClient(t, &APIClient{ID: "admin", Admin: true})
+    
+    tests := []struct {
+        name   string
+        client *APIClient
+        status int
+    }{
+        {"submitter", tenant, 403},
+        {"other tenant", other, 403},
+        {"approver for another tenant", addClient(t, &APIClient{ID: "approver2", ApproverFor: "other"}), 404},
+        {"approver", approver, 200},
+        {"admin", admin, 200},
+        {"admin approving its own", &APIClient{ID: "tenant", Admin: true}, 404},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var id int64
+            err := db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status, client_id)
+                VALUES ('0xa', '0xb', 1, 'held', 'tenant') RETURNING id`).Scan(&id)
+            if err != nil {
+                t.Fatal(err)
+            }
+            w := serve(new(WalletService).HandleApproveTransfer, tt.client, "POST", "/transfers/approve?id="+strconv.FormatInt(id, 10), "")
+            if w.Code != tt.status {
+                t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+            }
+            want := "held"
+            if tt.status == 200 {
+                want = "pending"
+            }
+            if n := countRows(t, "SELECT COUNT(*) FROM transfers WHERE id = $1 AND status = $2", id, want); n != 1 {
+                t.Fatalf("transfer is not %s", want)
+            }
+        })
+    }
+}
+
+func TestRejectTransfer(t *testing.T) {
+    testDB(t)
+    tenant := addClient(t, &APIClient{ID: "tenant"})
+    other := addClient(t, &APIClient{ID: "other"})
+    for _, tt := range []struct {
+        client *APIClient
+        status int
+    }{{other, 404}, {tenant, 200}} {
+        var id int64
+        err := db.QueryRow(`INSERT INTO transfers (from_address, to_address, amount, status, client_id)
+            VALUES ('0xa', '0xb', 1, 'held', 'tenant') RETURNING id`).Scan(&id)
+        if err != nil {
+            t.Fatal(err)
+        }
+        w := serve(new(WalletService).HandleRejectTransfer, tt.client, "POST", "/transfers/reject?id="+strconv.FormatInt(id, 10), "")
+        if w.Code != tt.status {
+            t.Fatalf("%s: status %d, want %d", tt.client.ID, w.Code, tt.status)
+        }
+    }
+}
+
+func TestListingsAreTenantScoped(t *testing.T) {
+    testDB(t)
+    testNode(t)
+    tenant := addClient(t, &APIClient{ID: "tenant"})
+    admin := addClient(t, &APIClient{ID: "admin", Admin: true})
+    addClient(t, &APIClient{ID: "other"})
+    mustExec(t, "INSERT INTO wallets (address, balance, client_id) VALUES ('0xa', 1, 'tenant'), ('0xb', 2, 'other'), ('0xc', 3, NULL)")
+    mustExec(t, `INSERT INTO transfers (from_address, to_address, amount, status, client_id)
+        VALUES ('0xa', '0xb', 1, 'pending', 'tenant'), ('0xb', '0xa', 1, 'pending', 'other')`)
+    
+    ws := new(WalletService)
+    for _, tt := range []struct {
+        client    *APIClient
+        wallets   int
+        transfers int
+    }{{tenant, 1, 1}, {admin, 3, 2}} {
+        var wallets []Wallet
+        json.Unmarshal(serve(ws.HandleListWallets, tt.client, "GET", "/wallets", "").Body.Bytes(), &wallets)
+        if len(wallets) != tt.wallets {
+            t.Errorf("%s sees %d wallets, want %d", tt.client.ID, len(wallets), tt.wallets)
+        }
+        var transfers []Transfer
+        json.Unmarshal(serve(ws.HandleListTransfers, tt.client, "GET", "/transfers", "").Body.Bytes(), &transfers)
+        if len(transfers) != tt.transfers {
+            t.Errorf("%s sees %d transfers, want %d", tt.client.ID, len(transfers), tt.transfers)
+        }
+    }
+}
+
+func TestWalletAdminEndpoints(t *testing.T) {
+    tenant := &APIClient{ID: "tenant"}
+    ws := new(WalletService)
+    if w := serve(ws.HandleUpdateWallet, tenant, "POST", "/wallets/update", `{"address":"0xa","client":"tenant"}`); w.Code != 403 {
+        t.Errorf("wallet update: status %d, want 403", w.Code)
+    }
+    if w := serve(ws.HandleGroups, tenant, "POST", "/groups", `{"name":"g"}`); w.Code != 403 {
+        t.Errorf("group save: status %d, want 403", w.Code)
+    }
+    if w := serve(ws.HandleSweepGroup, tenant, "POST", "/groups/sweep?group=g", ""); w.Code != 403 {
+        t.Errorf("sweep: status %d, want 403", w.Code)
+    }
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "math/big"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// Amounts cross the API in one of a few named units. Native amounts use wei,
+// gwei or ether; token amounts use "base" (the integer the contract stores)
+// or "display" (scaled by the token's decimals). Conversions go through the
+// integer base amount so nothing is lost to floating point.
+//
+// That exactness covers each transfer, not the ledger. A transfer keeps its
+// exact wei amount (amount_wei) from submission to signing, and listings,
+// receipts, notifications and callbacks report it. Wallet balances and the
+// transfers.amount column are still double-precision ether. Ledger debits
+// and credits, balance reports and policy or group limits therefore work on
+// rounded values: an amount with more than about 15 significant digits may
+// be off in its last wei there.
+
+const (
+    unitWei     = "wei"
+    unitGwei    = "gwei"
+    unitEther   = "ether"
+    unitBase    = "base"
+    unitDisplay = "display"
+)
+
+var nativeUnits = map[string]int{
+    unitWei:   0,
+    unitGwei:  9,
+    unitEther: 18,
+    "eth":     18,
+}
+
+var errInvalidAmount = errors.New("invalid amount")
+
+// Amount is an amount as returned by the API: the value in the requested
+// unit alongside the exact integer in base units.
+type Amount struct {
+    Value string `json:"value"`
+    Unit  string `json:"unit"`
+    Base  string `json:"base"`
+}
+
+func newAmount(base *big.Int, unit string, decimals int) Amount {
+    return Amount{Value: formatUnits(base, decimals), Unit: unit, Base: base.String()}
+}
+
+func etherAmount(ether float64, unit string) Amount {
+    return newAmount(toWei(ether), unit, nativeUnits[unit])
+}
+
+// parseUnits reads a non-negative decimal string as an integer number of base
+// units, given how many decimals the unit has. More fractional digits than
+// the unit allows is an error rather than a silent rounding.
+func parseUnits(s string, decimals int) (*big.Int, error) {
+    s = strings.TrimSpace(s)
+    whole, frac := s, ""
+    if i := strings.IndexByte(s, '.'); i >= 0 {
+        whole, frac = s[:i], s[i+1:]
+    }
+    if whole == "" && frac == "" || len(frac) > decimals || strings.ContainsAny(whole+frac, "+-") {
+        return nil, errInvalidAmount
+    }
+    v, ok := new(big.Int).SetString("0"+whole+frac+strings.Repeat("0", decimals-len(frac)), 10)
+    if !ok {
+        return nil, errInvalidAmount
+    }
+    return v, nil
+}
+
+// formatUnits renders an integer amount of base units with the given number
+// of decimals, without trailing zeros.
+func formatUnits(v *big.Int, decimals int) string {
+    s := new(big.Int).Abs(v).String()
+    if decimals > 0 {
+        if len(s) <= decimals {
+            s = strings.Repeat("0", decimals-len(s)+1) + s
+        }
+        s = s[:len(s)-decimals] + "." + s[len(s)-decimals:]
+        s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+    }
+    if v.Sign() < 0 {
+        s = "-" + s
+    }
+    return s
+}
+
+func toWei(amount float64) *big.Int {
+    wei, err := parseUnits(strconv.FormatFloat(amount, 'f', -1, 64), 18)
+    if err != nil {
+        wei, _ = new(big.Float).Mul(big.NewFloat(amount), big.NewFloat(1e18)).Int(nil)
+    }
+    return wei
+}
+
+// amountWeiSQL selects a transfer's exact wei amount as text, derived from
+// the ether amount for transfers recorded before amount_wei existed.
+const amountWeiSQL = "COALESCE(amount_wei, round(amount::numeric * 1e18))::text"
+
+// parseWei reads an integer as selected by amountWeiSQL.
+func parseWei(s string) *big.Int {
+    wei, ok := new(big.Int).SetString(s, 10)
+    if !ok {
+        return new(big.Int)
+    }
+    return wei
+}
+
+func toEther(wei *big.Int) float64 {
+    ether, _ := strconv.ParseFloat(formatUnits(wei, 18), 64)
+    return ether
+}
+
+// unitDecimals resolves a unit name. With a token address the unit must be
+// base or display; without one it must be a native unit.
+func unitDecimals(ctx context.Context, unit, token string) (int, error) {
+    unit = strings.ToLower(unit)
+    if token == "" {
+        decimals, ok := nativeUnits[unit]
+        if !ok {
+            return 0, &requestError{400, "Unknown unit " + unit}
+        }
+        return decimals, nil
+    }
+    t, err := lookupToken(ctx, token)
+    if err != nil {
+        return 0, err
+    }
+    if t == nil {
+        return 0, &requestError{400, "Unknown token"}
+    }
+    switch unit {
+    case unitBase:
+        return 0, nil
+    case unitDisplay:
+        return t.Decimals, nil
+    }
+    return 0, &requestError{400, "Unknown unit " + unit + " for token"}
+}
+
+// responseUnit is the native unit named by the unit query parameter, ether by
+// default.
+func responseUnit(r *http.Request) (string, error) {
+    unit := strings.ToLower(r.URL.Query().Get("unit"))
+    if unit == "" {
+        return unitEther, nil
+    }
+    if _, ok := nativeUnits[unit]; !ok {
+        return "", &requestError{400, "Unknown unit " + unit}
+    }
+    return unit, nil
+}
+
+// weiAmount is the amount of req in wei: exact when it was given as value
+// and unit or read back from amount_wei, otherwise converted from Amount.
+func (req *TransactionRequest) weiAmount() *big.Int {
+    if req.wei != nil {
+        return new(big.Int).Set(req.wei)
+    }
+    return toWei(req.Amount)
+}
+
+// normalizeAmount converts a request given as value and unit, or as amount in
+// a unit other than ether, into the ether amount the ledger uses, keeping the
+// exact wei amount for the transfer itself.
+func (req *TransactionRequest) normalizeAmount() error {
+    if req.Value == "" && req.Unit == "" {
+        return nil
+    }
+    unit := strings.ToLower(req.Unit)
+    if unit == "" {
+        unit = unitEther
+    }
+    decimals, ok := nativeUnits[unit]
+    if !ok {
+        return &requestError{400, "Unknown unit " + req.Unit}
+    }
+    value := req.Value
+    if value == "" {
+        value = strconv.FormatFloat(req.Amount, 'f', -1, 64)
+    }
+    wei, err := parseUnits(value, decimals)
+    if err != nil {
+        return &requestError{400, "Invalid amount " + value + " " + unit}
+    }
+    req.Amount, req.wei = toEther(wei), wei
+    return nil
+}
+
+// HandleConvertUnits converts value between two units, e.g.
+// ?value=1.5&from=ether&to=gwei, or between base and display units of a
+// registered token with &token=<address>.
+func (ws *WalletService) HandleConvertUnits(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    from, err := unitDecimals(r.Context(), q.Get("from"), q.Get("token"))
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    to, err := unitDecimals(r.Context(), q.Get("to"), q.Get("token"))
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    base, err := parseUnits(q.Get("value"), from)
+    if err != nil {
+        http.Error(w, "Invalid value", 400)
+        return
+    }
+    writeJSON(w, newAmount(base, strings.ToLower(q.Get("to")), to))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+    "context"
+    "testing"
+)
+
+func TestNormalizeAmountKeepsExactWei(t *testing.T) {
+    tests := []struct {
+        value, unit, wei string
+    }{
+        {"1000000000000000001", "wei", "1000000000000000001"},
+        {"1.000000000000000001", "ether", "1000000000000000001"},
+        {"123456789.123456789", "gwei", "123456789123456789"},
+    }
+    for _, tt := range tests {
+        req := TransactionRequest{Value: tt.value, Unit: tt.unit}
+        if err := req.normalizeAmount(); err != nil {
+            t.Fatal(err)
+        }
+        if got := req.weiAmount().String(); got != tt.wei {
+            t.Errorf("%s %s: %s wei, want %s", tt.value, tt.unit, got, tt.wei)
+        }
+    }
+    
+    req := TransactionRequest{Amount: 0.5}
+    if got := req.weiAmount().String(); got != "500000000000000000" {
+        t.Errorf("amount 0.5: %s wei", got)
+    }
+}
+
+func TestQueuedTransferKeepsExactWei(t *testing.T) {
+    testDB(t)
+    mustExec(t, `INSERT INTO transfers (from_address, to_address, amount, amount_wei, status, priority)
+        VALUES ('0xa', '0xb', 1, 1000000000000000001, 'pending', 'normal')`)
+    mustExec(t, `INSERT INTO transfers (from_address, to_address, amount, status, priority, created_at)
+        VALUES ('0xa', '0xb', 0.25, 'pending', 'normal', now() + interval '1 second')`)
+    
+    for _, want := range []string{"1000000000000000001", "250000000000000000"} {
+        _, req, err := claimNextTransfer("0xa", "normal")
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := req.weiAmount().String(); got != want {
+            t.Errorf("claimed %s wei, want %s", got, want)
+        }
+    }
+}
+
+func TestSubmitRejectsNonPositiveAmount(t *testing.T) {
+    for _, req := range []TransactionRequest{
+        {Amount: -1},
+        {Amount: 0},
+        {Value: "0", Unit: "wei"},
+        {Value: "0.000", Unit: "ether"},
+    } {
+        req.From = "0x1111111111111111111111111111111111111111"
+        req.To = "0x2222222222222222222222222222222222222222"
+        _, _, _, err := submitTransfer(context.Background(), req)
+        if re, ok := err.(*requestError); !ok || re.status != 400 {
+            t.Errorf("amount %v value %q %s: %v, want 400", req.Amount, req.Value, req.Unit, err)
+        }
+    }
+}
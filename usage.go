@@ -0,0 +1,299 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "log"
+    "math/big"
+    "net/http"
+    "time"
+)
+
+const clientContextKey contextKey = "client"
+
+type APIClient struct {
+    ID               string
+    Admin            bool
+    ApproverFor      string
+    MonthlyAPICalls  sql.NullInt64
+    MonthlyTransfers sql.NullInt64
+    MonthlyGasWei    sql.NullString
+}
+
+type UsageDay struct {
+    Client    string `json:"client"`
+    Day       string `json:"day"`
+    APICalls  int64  `json:"api_calls"`
+    Transfers int64  `json:"transfers"`
+    GasWei    string `json:"gas_wei"`
+}
+
+func hashAPIKey(key string) string {
+    sum := sha256.Sum256([]byte(key))
+    return hex.EncodeToString(sum[:])
+}
+
+func clientFromContext(ctx context.Context) *APIClient {
+    client, _ := ctx.Value(clientContextKey).(*APIClient)
+    return client
+}
+
+func clientID(ctx context.Context) string {
+    if client := clientFromContext(ctx); client != nil {
+        return client.ID
+    }
+    return ""
+}
+
+// requireAdmin rejects the request unless it comes from an admin client.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+    if client := clientFromContext(r.Context()); client == nil || !client.Admin {
+        http.Error(w, "Forbidden", 403)
+        return false
+    }
+    return true
+}
+
+func usageDay(t time.Time) string {
+    return t.UTC().Format("2006-01-02")
+}
+
+func usageMonth(t time.Time) string {
+    return t.UTC().Format("2006-01") + "-01"
+}
+
+// Quotas are enforced on usage_monthly, whose counters are reserved before
+// the work they count so that concurrent requests cannot overshoot a limit.
+// usage_daily keeps the per-day breakdown for reporting. A client's row for
+// the month is seeded from its daily usage the first time it is needed.
+func ensureUsageMonth(ctx context.Context, client, month string) error {
+    _, err := db.ExecContext(ctx, `INSERT INTO usage_monthly (client_id, month, api_calls, transfers, gas_wei)
+        SELECT $1, $2::date, COALESCE(SUM(api_calls), 0), COALESCE(SUM(transfers), 0), COALESCE(SUM(gas_wei), 0)
+        FROM usage_daily WHERE client_id = $1 AND day >= $2::date AND day < $2::date + interval '1 month'
+        ON CONFLICT (client_id, month) DO NOTHING`, client, month)
+    return err
+}
+
+// reserveUsage counts calls and transfers against the client's monthly
+// quotas in a single conditional update. With checkTransfers the transfer and
+// gas quotas must also have room left. It returns the quota that is used up,
+// or "" when the usage was reserved.
+func reserveUsage(ctx context.Context, client *APIClient, calls, transfers int64, checkTransfers bool) (string, error) {
+    month := usageMonth(time.Now())
+    if err := ensureUsageMonth(ctx, client.ID, month); err != nil {
+        return "", err
+    }
+    var reserved int64
+    err := db.QueryRowContext(ctx, `UPDATE usage_monthly SET api_calls = api_calls + $3, transfers = transfers + $4
+        WHERE client_id = $1 AND month = $2
+        AND ($5::bigint IS NULL OR api_calls + $3 <= $5)
+        AND (NOT $8 OR (($6::bigint IS NULL OR transfers < $6) AND ($7::numeric IS NULL OR gas_wei < $7)))
+        RETURNING api_calls`, client.ID, month, calls, transfers,
+        client.MonthlyAPICalls, client.MonthlyTransfers, client.MonthlyGasWei, checkTransfers).Scan(&reserved)
+    if err == sql.ErrNoRows {
+        return quotaExceeded(ctx, client, month)
+    }
+    return "", err
+}
+
+// releaseUsage gives back usage reserved for work that did not happen.
+func releaseUsage(ctx context.Context, client *APIClient, calls, transfers int64) {
+    _, err := db.ExecContext(ctx, `UPDATE usage_monthly SET api_calls = api_calls - $3, transfers = transfers - $4
+        WHERE client_id = $1 AND month = $2`, client.ID, usageMonth(time.Now()), calls, transfers)
+    if err != nil {
+        log.Println("Failed to release usage for", client.ID, err)
+    }
+}
+
+// recordUsage adds to the client's bucket for the current UTC day. Gas is
+// also added to the monthly total, as it is only known once the transaction
+// is mined; calls and transfers were already reserved there.
+func recordUsage(ctx context.Context, client string, calls, transfers int64, gasWei *big.Int) {
+    if client == "" {
+        return
+    }
+    if gasWei == nil {
+        gasWei = new(big.Int)
+    }
+    if gasWei.Sign() > 0 {
+        month := usageMonth(time.Now())
+        err := ensureUsageMonth(ctx, client, month)
+        if err == nil {
+            _, err = db.ExecContext(ctx, "UPDATE usage_monthly SET gas_wei = gas_wei + $3 WHERE client_id = $1 AND month = $2",
+                client, month, gasWei.String())
+        }
+        if err != nil {
+            log.Println("Failed to record gas usage for", client, err)
+        }
+    }
+    _, err := db.ExecContext(ctx, `INSERT INTO usage_daily (client_id, day, api_calls, transfers, gas_wei)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (client_id, day) DO UPDATE SET
+            api_calls = usage_daily.api_calls + EXCLUDED.api_calls,
+            transfers = usage_daily.transfers + EXCLUDED.transfers,
+            gas_wei = usage_daily.gas_wei + EXCLUDED.gas_wei`,
+        client, usageDay(time.Now()), calls, transfers, gasWei.String())
+    if err != nil {
+        log.Println("Failed to record usage for", client, err)
+    }
+}
+
+// quotaExceeded reports which monthly quota the client has used up after a
+// reservation was refused.
+func quotaExceeded(ctx context.Context, client *APIClient, month string) (string, error) {
+    var calls, transfers int64
+    var gas string
+    err := db.QueryRowContext(ctx, "SELECT api_calls, transfers, gas_wei::text FROM usage_monthly WHERE client_id = $1 AND month = $2",
+        client.ID, month).Scan(&calls, &transfers, &gas)
+    if err != nil {
+        return "", err
+    }
+    if client.MonthlyAPICalls.Valid && calls >= client.MonthlyAPICalls.Int64 {
+        return "Monthly API call quota exceeded", nil
+    }
+    if client.MonthlyTransfers.Valid && transfers >= client.MonthlyTransfers.Int64 {
+        return "Monthly transfer quota exceeded", nil
+    }
+    if client.MonthlyGasWei.Valid {
+        used, _ := new(big.Int).SetString(gas, 10)
+        limit, _ := new(big.Int).SetString(client.MonthlyGasWei.String, 10)
+        if used != nil && limit != nil && used.Cmp(limit) >= 0 {
+            return "Monthly gas quota exceeded", nil
+        }
+    }
+    return "Monthly quota exceeded", nil
+}
+
+// clientColumns and scanClient read an api_clients row into an APIClient.
+const clientColumns = `id, admin, COALESCE(approver_for, ''), monthly_api_calls, monthly_transfers, monthly_gas_wei::text`
+
+func scanClient(row *sql.Row) (*APIClient, error) {
+    client := &APIClient{}
+    err := row.Scan(&client.ID, &client.Admin, &client.ApproverFor, &client.MonthlyAPICalls, &client.MonthlyTransfers, &client.MonthlyGasWei)
+    if err != nil {
+        return nil, err
+    }
+    return client, nil
+}
+
+// metered authenticates the caller by its X-API-Key header and reserves the
+// call against its monthly quotas. Requests that create transfers are refused
+// up front when the transfer or gas quota is already used up; the transfer
+// itself is reserved when it is accepted.
+func (ws *WalletService) metered(next http.HandlerFunc, createsTransfers bool) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        key := r.Header.Get("X-API-Key")
+        if key == "" {
+            http.Error(w, "Missing API key", 401)
+            return
+        }
+        
+        client, err := scanClient(db.QueryRowContext(r.Context(), "SELECT "+clientColumns+" FROM api_clients WHERE key_hash = $1", hashAPIKey(key)))
+        if err == sql.ErrNoRows {
+            http.Error(w, "Invalid API key", 401)
+            return
+        }
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        
+        reason, err := reserveUsage(r.Context(), client, 1, 0, createsTransfers)
+        if err != nil {
+            writeError(w, err)
+            return
+        }
+        if reason != "" {
+            http.Error(w, reason, 429)
+            return
+        }
+        
+        recordUsage(r.Context(), client.ID, 1, 0, nil)
+        next(w, r.WithContext(context.WithValue(r.Context(), clientContextKey, client)))
+    }
+}
+
+// HandleUsage reports daily usage for a month (YYYY-MM, default current).
+// Clients see their own usage; admin clients may pass client or omit it to
+// see every client.
+func (ws *WalletService) HandleUsage(w http.ResponseWriter, r *http.Request) {
+    caller := clientFromContext(r.Context())
+    month := r.URL.Query().Get("month")
+    if month == "" {
+        month = time.Now().UTC().Format("2006-01")
+    }
+    start, err := time.Parse("2006-01", month)
+    if err != nil {
+        http.Error(w, "Invalid month", 400)
+        return
+    }
+    
+    client := r.URL.Query().Get("client")
+    if !caller.Admin {
+        if client != "" && client != caller.ID {
+            http.Error(w, "Forbidden", 403)
+            return
+        }
+        client = caller.ID
+    }
+    
+    rows, err := db.QueryContext(r.Context(), `SELECT client_id, day, api_calls, transfers, gas_wei::text FROM usage_daily
+        WHERE ($1 = '' OR client_id = $1) AND day >= $2 AND day < $3 ORDER BY client_id, day`,
+        client, start, start.AddDate(0, 1, 0))
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer rows.Close()
+    
+    days := []UsageDay{}
+    for rows.Next() {
+        var d UsageDay
+        var day time.Time
+        if err := rows.Scan(&d.Client, &day, &d.APICalls, &d.Transfers, &d.GasWei); err != nil {
+            writeError(w, err)
+            return
+        }
+        d.Day = day.Format("2006-01-02")
+        days = append(days, d)
+    }
+    writeJSON(w, days)
+}
+
+// runCreateClient registers an API client and prints its key, which is not
+// stored and cannot be shown again.
+func runCreateClient(args []string) error {
+    fs := flag.NewFlagSet("client", flag.ContinueOnError)
+    id := fs.String("id", "", "client id")
+    admin := fs.Bool("admin", false, "allow the client to read every client's usage")
+    approverFor := fs.String("approver-for", "", "client whose held transfers this client may approve")
+    calls := fs.Int64("calls", 0, "monthly API call quota (0 for unlimited)")
+    transfers := fs.Int64("transfers", 0, "monthly transfer quota (0 for unlimited)")
+    gas := fs.String("gas", "", "monthly gas quota in wei (empty for unlimited)")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if *id == "" {
+        return fmt.Errorf("-id is required")
+    }
+    
+    buf := make([]byte, 24)
+    if _, err := rand.Read(buf); err != nil {
+        return err
+    }
+    key := hex.EncodeToString(buf)
+    
+    _, err := db.Exec(`INSERT INTO api_clients (id, key_hash, admin, approver_for, monthly_api_calls, monthly_transfers, monthly_gas_wei)
+        VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, 0), NULLIF($6, 0), NULLIF($7, '')::numeric)`,
+        *id, hashAPIKey(key), *admin, *approverFor, *calls, *transfers, *gas)
+    if err != nil {
+        return err
+    }
+    fmt.Println(key)
+    return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestReserveUsageIsAtomic(t *testing.T) {
+    testDB(t)
+    client := addClient(t, &APIClient{ID: "tenant"})
+    client.MonthlyAPICalls = sql.NullInt64{Int64: 5, Valid: true}
+    client.MonthlyTransfers = sql.NullInt64{Int64: 3, Valid: true}
+    ctx := context.Background()
+    
+    tests := []struct {
+        name      string
+        calls     int64
+        transfers int64
+        want      int
+    }{
+        {"api calls", 1, 0, 5},
+        {"transfers", 0, 1, 3},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            mustExec(t, "DELETE FROM usage_monthly")
+            var mu sync.Mutex
+            var wg sync.WaitGroup
+            reserved := 0
+            for i := 0; i < 20; i++ {
+                wg.Add(1)
+                go func() {
+                    defer wg.Done()
+                    reason, err := reserveUsage(ctx, client, tt.calls, tt.transfers, tt.transfers > 0)
+                    if err != nil {
+                        t.Error(err)
+                        return
+                    }
+                    if reason == "" {
+                        mu.Lock()
+                        reserved++
+                        mu.Unlock()
+                    }
+                }()
+            }
+            wg.Wait()
+            if reserved != tt.want {
+                t.Fatalf("%d reservations succeeded, want %d", reserved, tt.want)
+            }
+        })
+    }
+}
+
+func TestReserveUsageSeedsFromDailyUsage(t *testing.T) {
+    testDB(t)
+    client := addClient(t, &APIClient{ID: "tenant"})
+    client.MonthlyAPICalls = sql.NullInt64{Int64: 10, Valid: true}
+    mustExec(t, "INSERT INTO usage_daily (client_id, day, api_calls) VALUES ('tenant', $1, 10)", usageDay(time.Now()))
+    
+    reason, err := reserveUsage(context.Background(), client, 1, 0, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if reason != "Monthly API call quota exceeded" {
+        t.Fatalf("got %q, want the API call quota to be exceeded", reason)
+    }
+}
+
+func TestTokenAndABIRegistrationRequireAdmin(t *testing.T) {
+    tenant := &APIClient{ID: "tenant"}
+    ws := new(WalletService)
+    for target, handler := range map[string]func(*APIClient) int{
+        "/abi": func(c *APIClient) int {
+            return serve(ws.HandleRegisterABI, c, "POST", "/abi", `{}`).Code
+        },
+        "/signatures": func(c *APIClient) int {
+            return serve(ws.HandleRegisterSignature, c, "POST", "/signatures", `{}`).Code
+        },
+        "/tokens": func(c *APIClient) int {
+            return serve(ws.HandleTokens, c, "POST", "/tokens", `{}`).Code
+        },
+    } {
+        if code := handler(tenant); code != 403 {
+            t.Errorf("%s: status %d, want 403", target, code)
+        }
+    }
+}
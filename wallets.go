@@ -0,0 +1,234 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+
+    "github.com/ethereum/go-ethereum/common"
+)
+
+type Wallet struct {
+    Address      string   `json:"address"`
+    Label        string   `json:"label"`
+    Group        string   `json:"group,omitempty"`
+    Tags         []string `json:"tags"`
+    Balance      float64  `json:"balance"`
+    BalanceUnits Amount   `json:"balance_units"`
+}
+
+type WalletUpdate struct {
+    Address string    `json:"address"`
+    Label   *string   `json:"label"`
+    Group   *string   `json:"group"`
+    Tags    *[]string `json:"tags"`
+    Client  *string   `json:"client"`
+}
+
+// walletFilter turns the tag and group query parameters into conditions on
+// column, which must hold a wallet address. Placeholders are numbered after
+// the arguments already in args.
+func walletFilter(r *http.Request, column string, args []interface{}) ([]string, []interface{}) {
+    var conds []string
+    if tag := r.URL.Query().Get("tag"); tag != "" {
+        args = append(args, tag)
+        conds = append(conds, fmt.Sprintf("%s IN (SELECT address FROM wallet_tags WHERE tag = $%d)", column, len(args)))
+    }
+    if group := r.URL.Query().Get("group"); group != "" {
+        args = append(args, group)
+        conds = append(conds, fmt.Sprintf("%s IN (SELECT address FROM wallets WHERE group_name = $%d)", column, len(args)))
+    }
+    return conds, args
+}
+
+// tenantFilter limits non-admin callers to rows whose column names their own
+// client. Admins and internal callers see every row.
+func tenantFilter(ctx context.Context, column string, conds []string, args []interface{}) ([]string, []interface{}) {
+    client := clientFromContext(ctx)
+    if client == nil || client.Admin {
+        return conds, args
+    }
+    args = append(args, client.ID)
+    return append(conds, fmt.Sprintf("%s = $%d", column, len(args))), args
+}
+
+// checkWalletAccess refuses a client acting on a wallet it does not own.
+// Admins and internal callers without a client may use every wallet.
+func checkWalletAccess(ctx context.Context, address string) error {
+    client := clientFromContext(ctx)
+    if client == nil || client.Admin {
+        return nil
+    }
+    owner, err := walletOwner(ctx, address)
+    if err != nil {
+        return err
+    }
+    if owner != client.ID {
+        return &requestError{403, "Wallet does not belong to this client"}
+    }
+    return nil
+}
+
+// walletOwner is the client owning the wallet at address, or "" when the
+// wallet is unknown or unassigned.
+func walletOwner(ctx context.Context, address string) (string, error) {
+    var owner sql.NullString
+    err := db.QueryRowContext(ctx, "SELECT client_id FROM wallets WHERE address IN ($1, $2, $3)",
+        address, common.HexToAddress(address).Hex(), strings.ToLower(address)).Scan(&owner)
+    if err != nil && err != sql.ErrNoRows {
+        return "", err
+    }
+    return owner.String, nil
+}
+
+func whereClause(conds []string) string {
+    if len(conds) == 0 {
+        return ""
+    }
+    return " WHERE " + strings.Join(conds, " AND ")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(v)
+}
+
+func (ws *WalletService) HandleListWallets(w http.ResponseWriter, r *http.Request) {
+    unit, err := responseUnit(r)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    conds, args := walletFilter(r, "w.address", nil)
+    conds, args = tenantFilter(r.Context(), "w.client_id", conds, args)
+    query := `SELECT w.address, w.label, COALESCE(w.group_name, ''), w.balance,
+        COALESCE((SELECT string_agg(tag, ',' ORDER BY tag) FROM wallet_tags t WHERE t.address = w.address), '')
+        FROM wallets w` + whereClause(conds) + " ORDER BY w.address"
+    
+    rows, err := db.QueryContext(r.Context(), query, args...)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer rows.Close()
+    
+    wallets := []Wallet{}
+    for rows.Next() {
+        var wallet Wallet
+        var tags string
+        if err := rows.Scan(&wallet.Address, &wallet.Label, &wallet.Group, &wallet.Balance, &tags); err != nil {
+            writeError(w, err)
+            return
+        }
+        wallet.BalanceUnits = etherAmount(wallet.Balance, unit)
+        wallet.Tags = []string{}
+        if tags != "" {
+            wallet.Tags = strings.Split(tags, ",")
+        }
+        wallets = append(wallets, wallet)
+    }
+    writeJSON(w, wallets)
+}
+
+func (ws *WalletService) HandleUpdateWallet(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", 405)
+        return
+    }
+    if !requireAdmin(w, r) {
+        return
+    }
+    var update WalletUpdate
+    if err := json.NewDecoder(r.Body).Decode(&update); err != nil || update.Address == "" {
+        http.Error(w, "Invalid request", 400)
+        return
+    }
+    
+    tx, err := db.BeginTx(r.Context(), nil)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer tx.Rollback()
+    
+    res, err := tx.Exec("UPDATE wallets SET label = COALESCE($2, label) WHERE address = $1", update.Address, update.Label)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        http.Error(w, "Wallet not found", 404)
+        return
+    }
+    if update.Group != nil {
+        group := sql.NullString{String: *update.Group, Valid: *update.Group != ""}
+        if _, err := tx.Exec("UPDATE wallets SET group_name = $2 WHERE address = $1", update.Address, group); err != nil {
+            http.Error(w, "Unknown group", 400)
+            return
+        }
+    }
+    if update.Client != nil {
+        client := sql.NullString{String: *update.Client, Valid: *update.Client != ""}
+        if _, err := tx.Exec("UPDATE wallets SET client_id = $2 WHERE address = $1", update.Address, client); err != nil {
+            http.Error(w, "Unknown client", 400)
+            return
+        }
+    }
+    if update.Tags != nil {
+        if _, err := tx.Exec("DELETE FROM wallet_tags WHERE address = $1", update.Address); err != nil {
+            writeError(w, err)
+            return
+        }
+        for _, tag := range *update.Tags {
+            if _, err := tx.Exec("INSERT INTO wallet_tags (address, tag) VALUES ($1, $2) ON CONFLICT DO NOTHING", update.Address, tag); err != nil {
+                writeError(w, err)
+                return
+            }
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        writeError(w, err)
+        return
+    }
+    w.Write([]byte("Wallet updated"))
+}
+
+func (ws *WalletService) HandleBalanceReport(w http.ResponseWriter, r *http.Request) {
+    unit, err := responseUnit(r)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    conds, args := walletFilter(r, "address", nil)
+    conds, args = tenantFilter(r.Context(), "client_id", conds, args)
+    query := "SELECT COALESCE(group_name, ''), COUNT(*), COALESCE(SUM(balance), 0) FROM wallets" +
+        whereClause(conds) + " GROUP BY group_name ORDER BY group_name"
+    
+    rows, err := db.QueryContext(r.Context(), query, args...)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer rows.Close()
+    
+    type groupBalance struct {
+        Group        string  `json:"group"`
+        Wallets      int     `json:"wallets"`
+        Balance      float64 `json:"balance"`
+        BalanceUnits Amount  `json:"balance_units"`
+    }
+    report := []groupBalance{}
+    for rows.Next() {
+        var g groupBalance
+        if err := rows.Scan(&g.Group, &g.Wallets, &g.Balance); err != nil {
+            writeError(w, err)
+            return
+        }
+        g.BalanceUnits = etherAmount(g.Balance, unit)
+        report = append(report, g)
+    }
+    writeJSON(w, report)
+}